@@ -0,0 +1,36 @@
+// Command agent runs test targets for the harness server on this host. It
+// registers the architectures the host runs natively, long-polls the server
+// for targets and streams their output and results back.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/agent"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/provisioner"
+)
+
+func main() {
+	logging.Init()
+	cfg := config.LoadAgent()
+
+	prov, err := provisioner.New(cfg.Provisioner, cfg.Container)
+	if err != nil {
+		log.Fatalf("provisioner error: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	a := agent.New(agent.NewClient(cfg.ServerURL, cfg.Token), prov, cfg.Name, cfg.Architectures, cfg.Slots)
+	logging.Logger.Info("agent_starting", "server", cfg.ServerURL, "name", cfg.Name, "architectures", cfg.Architectures, "slots", cfg.Slots)
+	if err := a.Run(ctx); err != nil {
+		log.Fatalf("agent error: %v", err)
+	}
+}
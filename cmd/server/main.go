@@ -5,18 +5,30 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/api"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/capability"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/jobspec"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/provisioner"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/runner"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
 )
 
 func main() {
 	logging.Init()
-	config.Load()
+	cfg := config.Load()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("migrate error: %v", err)
+		}
+		return
+	}
 	addr := ":8080"
 	if v := os.Getenv("MTH_LISTEN_ADDR"); v != "" {
 		addr = v
@@ -25,16 +37,94 @@ func main() {
 	builder := store.NewStoreBuilder()
 	switch storeType {
 	case "sqlite":
-		builder.WithSQLite("data.db")
+		builder.WithSQLite(cfg.SQLitePath)
+	case "postgres":
+		builder.WithPostgres(cfg.PostgresDSN)
 	default:
 		builder.WithMemoryStore()
 	}
+	if cfg.SecretKey != "" {
+		box, err := store.NewSecretBox(cfg.SecretKey)
+		if err != nil {
+			log.Fatalf("secret key error: %v", err)
+		}
+		builder.WithSecrets(box)
+	}
 
-	st := builder.Build()
+	st, err := builder.Build()
+	if err != nil {
+		log.Fatalf("store error: %v", err)
+	}
+
+	logs, err := newLogStore(cfg, storeType)
+	if err != nil {
+		log.Fatalf("log store error: %v", err)
+	}
+	if s, ok := st.(*store.SQLiteStore); ok {
+		moved, err := s.MoveLogs(logs)
+		if err != nil {
+			log.Fatalf("move logs error: %v", err)
+		}
+		if moved > 0 {
+			logging.Logger.Info("logs_moved", "count", moved)
+		}
+	}
+
+	prov, err := provisioner.New(cfg.Provisioner, cfg.Container)
+	if err != nil {
+		log.Fatalf("provisioner error: %v", err)
+	}
+	rn := runner.NewRunner(st, cfg, prov)
+	prober := capability.NewProber(nil)
+	if d, ok := prov.(*provisioner.Docker); ok {
+		prober.HostArch = d.Architecture
+	}
+	rn.SetProber(prober)
+	rn.SetLogStore(logs)
+	if cfg.AgentToken == "" {
+		logging.Logger.Info("agents_disabled", "reason", "MTH_AGENT_TOKEN is not set")
+	}
+	if err := rn.Start(context.Background()); err != nil {
+		log.Fatalf("runner error: %v", err)
+	}
 
-	srv := api.NewServer(addr, st)
+	srv := api.NewServer(addr, st, rn)
+	if cfg.SpecFileSSH {
+		srv.SetSpecFetcher(jobspec.GitFetchWithSSH)
+	}
 
 	if err := srv.Start(); err != nil {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// newLogStore returns the configured log store. Logs are kept in memory
+// along with jobs in the memory store, in S3 along with the postgres store,
+// whose replicas all serve every log, and in files otherwise.
+func newLogStore(cfg *config.Config, storeType string) (store.LogStore, error) {
+	kind := cfg.LogStore
+	if kind == "" {
+		switch storeType {
+		case "sqlite":
+			kind = "file"
+		case "postgres":
+			kind = "s3"
+		default:
+			kind = "memory"
+		}
+	}
+	if storeType == "postgres" && kind != "s3" {
+		return nil, fmt.Errorf("the postgres store needs the s3 log store, so that every replica can read every log; got %q", kind)
+	}
+	switch kind {
+	case "file":
+		return store.NewFileLogStore(cfg.LogDir)
+	case "s3":
+		b := cfg.LogS3
+		return store.NewS3LogStore(b.Endpoint, b.Bucket, b.AccessKey, b.SecretKey)
+	case "memory":
+		return store.NewMemoryLogStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown log store %q", kind)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+)
+
+// runMigrate implements "server migrate [status|up]" for the sqlite and
+// postgres stores, picked by MTH_STORE. status lists the migrations and
+// when they were applied, up applies the pending ones, which the server
+// otherwise does on startup.
+func runMigrate(cfg *config.Config, args []string) error {
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	postgres := os.Getenv("MTH_STORE") == "postgres"
+	switch cmd {
+	case "status":
+		var status []store.MigrationStatus
+		var err error
+		if postgres {
+			status, err = store.PostgresMigrationStatus(cfg.PostgresDSN)
+		} else {
+			status, err = store.SQLiteMigrationStatus(cfg.SQLitePath)
+		}
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	case "up":
+		var applied []store.Migration
+		var err error
+		if postgres {
+			applied, err = store.MigratePostgres(cfg.PostgresDSN)
+		} else {
+			applied, err = store.MigrateSQLite(cfg.SQLitePath)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, want status or up", cmd)
+	}
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/provisioner"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/runner"
+)
+
+const (
+	// pollWait is how long a single long-poll waits on the server
+	pollWait = 30 * time.Second
+	// retryDelay spaces out requests after the server could not be reached
+	retryDelay = 5 * time.Second
+	// reportAttempts bounds how often a result is sent before giving up
+	reportAttempts = 5
+)
+
+// Agent pulls targets for its architectures from the server and executes
+// them on the local provisioner
+type Agent struct {
+	client *Client
+	prov   provisioner.Provisioner
+	name   string
+	archs  []string
+	slots  int
+
+	mu sync.Mutex
+	id string
+}
+
+// New returns an agent that runs up to slots targets at the same time
+func New(client *Client, prov provisioner.Provisioner, name string, archs []string, slots int) *Agent {
+	if slots < 1 {
+		slots = 1
+	}
+	return &Agent{
+		client: client,
+		prov:   prov,
+		name:   name,
+		archs:  archs,
+		slots:  slots,
+	}
+}
+
+// Run registers the agent and executes assigned targets until ctx is done
+func (a *Agent) Run(ctx context.Context) error {
+	if _, err := a.register(ctx); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < a.slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// register obtains an agent ID from the server, or registers the current
+// one again so that targets still running keep their assignment
+func (a *Agent) register(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	agent, err := a.client.Register(ctx, a.id, a.name, a.archs)
+	if err != nil {
+		return "", err
+	}
+	a.id = agent.ID
+	logging.Logger.Info("agent_registered", "agent_id", agent.ID, "name", a.name, "architectures", a.archs)
+	return agent.ID, nil
+}
+
+func (a *Agent) agentID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.id
+}
+
+func (a *Agent) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		id := a.agentID()
+		as, err := a.client.Poll(ctx, id, pollWait)
+		if errors.Is(err, ErrUnknownAgent) {
+			// the server forgot us, most likely it restarted
+			_, err = a.register(ctx)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				logging.Logger.Warn("agent_poll_failed", "agent_id", id, "error", err)
+				sleep(ctx, retryDelay)
+			}
+			continue
+		}
+		if as != nil {
+			a.execute(ctx, id, as)
+		}
+	}
+}
+
+// execute runs an assigned target and reports its outcome
+func (a *Agent) execute(ctx context.Context, agentID string, as *runner.Assignment) {
+	jobID, arch := as.Job.ID, as.Arch
+	logging.Logger.Info("target_start",
+		"agent_id", agentID,
+		"job_id", jobID,
+		"arch", arch,
+		"attempt", as.Attempt,
+	)
+
+	tctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timeout, err := time.ParseDuration(as.Timeout)
+	if err == nil && timeout > 0 {
+		var stop context.CancelFunc
+		tctx, stop = context.WithTimeout(tctx, timeout)
+		defer stop()
+	}
+
+	up := newUploader(a.client, agentID, jobID, arch, cancel)
+	res := runner.Execute(tctx, a.prov, as, up, up)
+	up.Close()
+
+	logging.Logger.Info("target_done",
+		"agent_id", agentID,
+		"job_id", jobID,
+		"arch", arch,
+		"exit_code", res.ExitCode,
+		"reason", res.Reason,
+	)
+
+	// the result is sent even while shutting down so the target is not lost
+	for i := 0; i < reportAttempts; i++ {
+		rctx, stop := context.WithTimeout(context.Background(), pollWait)
+		err = a.client.Report(rctx, agentID, jobID, arch, res)
+		stop()
+		if err == nil || errors.Is(err, ErrUnknownAgent) || errors.Is(err, ErrNotAssigned) {
+			break
+		}
+		logging.Logger.Warn("agent_report_failed", "job_id", jobID, "arch", arch, "error", err)
+		time.Sleep(retryDelay)
+	}
+	if err != nil {
+		logging.Logger.Error("agent_result_dropped", "job_id", jobID, "arch", arch, "error", err)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
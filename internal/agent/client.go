@@ -0,0 +1,148 @@
+// Package agent implements the remote executor that pulls targets from the
+// server, runs them on its own host and streams the output back.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/runner"
+)
+
+// ErrUnknownAgent is returned when the server no longer knows the agent,
+// e.g. after a restart, and the agent has to register again
+var ErrUnknownAgent = errors.New("agent not registered")
+
+// ErrNotAssigned is returned when the server no longer considers the target
+// assigned to the agent
+var ErrNotAssigned = errors.New("target not assigned to agent")
+
+// Client talks to the server's /agents endpoints
+type Client struct {
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Token:   token,
+		HTTP:    &http.Client{},
+	}
+}
+
+// Register announces the agent and the architectures it runs natively. id
+// is empty on the first registration and the previous ID afterwards.
+func (c *Client) Register(ctx context.Context, id, name string, archs []string) (*runner.Agent, error) {
+	body, _ := json.Marshal(map[string]interface{}{"id": id, "name": name, "architectures": archs})
+	resp, err := c.do(ctx, "/agents", nil, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var agent runner.Agent
+	if err := json.NewDecoder(resp.Body).Decode(&agent); err != nil {
+		return nil, fmt.Errorf("decode registration: %w", err)
+	}
+	return &agent, nil
+}
+
+// Poll waits up to wait for a target assignment. It returns nil without an
+// error when none arrived.
+func (c *Client) Poll(ctx context.Context, agentID string, wait time.Duration) (*runner.Assignment, error) {
+	q := url.Values{"wait": {wait.String()}}
+	resp, err := c.do(ctx, "/agents/"+agentID+"/poll", q, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	var as runner.Assignment
+	if err := json.NewDecoder(resp.Body).Decode(&as); err != nil {
+		return nil, fmt.Errorf("decode assignment: %w", err)
+	}
+	return &as, nil
+}
+
+// AppendLog uploads target output. The returned flag is set when the
+// target was cancelled on the server.
+func (c *Client) AppendLog(ctx context.Context, agentID, jobID, arch string, chunk []byte) (bool, error) {
+	q := url.Values{"job_id": {jobID}, "arch": {arch}}
+	resp, err := c.do(ctx, "/agents/"+agentID+"/log", q, "text/plain", chunk)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Cancel bool `json:"cancel"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, fmt.Errorf("decode log response: %w", err)
+	}
+	return out.Cancel, nil
+}
+
+// Report sends the outcome of a target
+func (c *Client) Report(ctx context.Context, agentID, jobID, arch string, res runner.Result) error {
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	q := url.Values{"job_id": {jobID}, "arch": {arch}}
+	resp, err := c.do(ctx, "/agents/"+agentID+"/result", q, "application/json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a POST request and turns error statuses into errors
+func (c *Client) do(ctx context.Context, path string, q url.Values, contentType string, body []byte) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrUnknownAgent
+	case http.StatusConflict:
+		return nil, ErrNotAssigned
+	default:
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/runner"
+)
+
+const (
+	uploadInterval = time.Second
+	// heartbeatInterval is the longest the agent stays silent while a target
+	// runs; every upload also tells it whether the target was cancelled
+	heartbeatInterval = 5 * time.Second
+	// flushSize is how much output starts an upload before the next tick
+	flushSize = 64 << 10
+	// maxPending caps output held back while uploads fail
+	maxPending = 1 << 20
+)
+
+// uploader buffers target output and sends it to the server once a second,
+// or sooner when flushSize bytes are waiting. Output is only dropped, oldest
+// first, while uploads fail and more than maxPending bytes are held back.
+// It cancels the target when the server reports it as cancelled or no
+// longer assigned. It is safe for concurrent use, so stdout and stderr can
+// share one uploader.
+type uploader struct {
+	client  *Client
+	agentID string
+	jobID   string
+	arch    string
+	cancel  context.CancelCauseFunc
+
+	mu       sync.Mutex
+	buf      []byte
+	lastSent time.Time
+	failing  bool
+	dropped  int
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newUploader(c *Client, agentID, jobID, arch string, cancel context.CancelCauseFunc) *uploader {
+	u := &uploader{
+		client:   c,
+		agentID:  agentID,
+		jobID:    jobID,
+		arch:     arch,
+		cancel:   cancel,
+		lastSent: time.Now(),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go u.loop()
+	return u
+}
+
+func (u *uploader) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.buf = append(u.buf, p...)
+	if u.failing {
+		u.trim()
+	} else if len(u.buf) >= flushSize {
+		select {
+		case u.kick <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// trim drops the oldest output beyond maxPending. The caller holds u.mu.
+func (u *uploader) trim() {
+	if over := len(u.buf) - maxPending; over > 0 {
+		u.buf = u.buf[over:]
+		u.dropped += over
+	}
+}
+
+// Close sends the remaining output and stops the periodic upload
+func (u *uploader) Close() error {
+	close(u.stop)
+	<-u.done
+	u.flush(true)
+	return nil
+}
+
+func (u *uploader) loop() {
+	defer close(u.done)
+	ticker := time.NewTicker(uploadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stop:
+			return
+		case <-ticker.C:
+			u.flush(false)
+		case <-u.kick:
+			u.flush(false)
+		}
+	}
+}
+
+// flush sends buffered output, or an empty heartbeat when nothing was sent
+// for a while. Only one flush runs at a time, which keeps chunks in order.
+func (u *uploader) flush(force bool) {
+	u.mu.Lock()
+	chunk := u.buf
+	u.buf = nil
+	idle := time.Since(u.lastSent) >= heartbeatInterval
+	u.mu.Unlock()
+	if len(chunk) == 0 && !idle && !force {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pollWait)
+	defer cancel()
+	cancelled, err := u.client.AppendLog(ctx, u.agentID, u.jobID, u.arch, chunk)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.reportDropped()
+	u.failing = false
+	switch {
+	case errors.Is(err, ErrNotAssigned) || errors.Is(err, ErrUnknownAgent):
+		logging.Logger.Warn("agent_target_revoked", "job_id", u.jobID, "arch", u.arch, "error", err)
+		u.cancel(runner.ErrCancelled)
+	case err != nil:
+		// keep the output for the next upload
+		logging.Logger.Warn("agent_log_upload_failed", "job_id", u.jobID, "arch", u.arch, "error", err)
+		u.failing = true
+		u.buf = append(chunk, u.buf...)
+		u.trim()
+		return
+	case cancelled:
+		logging.Logger.Info("target_cancel_requested", "job_id", u.jobID, "arch", u.arch)
+		u.cancel(runner.ErrCancelled)
+	}
+	u.lastSent = time.Now()
+}
+
+// reportDropped logs output dropped since the last report. The caller holds
+// u.mu.
+func (u *uploader) reportDropped() {
+	if u.dropped == 0 {
+		return
+	}
+	logging.Logger.Warn("agent_log_dropped", "job_id", u.jobID, "arch", u.arch, "bytes", u.dropped)
+	u.dropped = 0
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logging.Init()
+	os.Exit(m.Run())
+}
+
+// logServer accepts log uploads, or fails them while down is set
+type logServer struct {
+	mu       sync.Mutex
+	down     bool
+	received []byte
+}
+
+func (s *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.received = append(s.received, body...)
+	w.Write([]byte(`{"cancel":false}`))
+}
+
+func (s *logServer) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.received)
+}
+
+func testUploader(t *testing.T, srv *logServer) *uploader {
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	_, cancel := context.WithCancelCause(context.Background())
+	t.Cleanup(func() { cancel(nil) })
+	// no loop: the tests flush themselves
+	return &uploader{
+		client:   NewClient(ts.URL, ""),
+		agentID:  "agent",
+		jobID:    "job",
+		arch:     "amd64",
+		cancel:   cancel,
+		lastSent: time.Now(),
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+func TestUploaderFlushesLargeOutputEarly(t *testing.T) {
+	srv := &logServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	_, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	u := newUploader(NewClient(ts.URL, ""), "agent", "job", "amd64", cancel)
+	defer u.Close()
+	u.Write(bytes.Repeat([]byte("x"), flushSize))
+
+	// well before the first tick
+	assert.Eventually(t, func() bool { return srv.len() == flushSize }, uploadInterval/2, 10*time.Millisecond)
+}
+
+func TestUploaderKeepsOutputWhileServerIsReachable(t *testing.T) {
+	srv := &logServer{}
+	u := testUploader(t, srv)
+
+	u.Write(bytes.Repeat([]byte("x"), 2*maxPending))
+	assert.Len(t, u.buf, 2*maxPending)
+	assert.Len(t, u.kick, 1)
+
+	u.flush(false)
+	assert.Equal(t, 2*maxPending, srv.len())
+	assert.Empty(t, u.buf)
+}
+
+func TestUploaderDropsOutputOnlyWhileUploadsFail(t *testing.T) {
+	srv := &logServer{down: true}
+	u := testUploader(t, srv)
+
+	u.Write([]byte("first"))
+	u.flush(false)
+	assert.True(t, u.failing)
+	assert.Equal(t, "first", string(u.buf))
+
+	u.Write(bytes.Repeat([]byte("x"), maxPending))
+	assert.Len(t, u.buf, maxPending)
+	assert.Equal(t, len("first"), u.dropped)
+
+	srv.mu.Lock()
+	srv.down = false
+	srv.mu.Unlock()
+	u.flush(false)
+	assert.False(t, u.failing)
+	assert.Zero(t, u.dropped)
+	assert.Equal(t, maxPending, srv.len())
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/runner"
+)
+
+const (
+	defaultPollWait = 30 * time.Second
+	maxPollWait     = 60 * time.Second
+	// maxLogChunk bounds a single log upload from an agent
+	maxLogChunk = 1 << 20
+)
+
+type registerAgentRequest struct {
+	// ID re-registers a known agent, keeping the targets it still runs
+	ID            string   `json:"id,omitempty"`
+	Name          string   `json:"name"`
+	Architectures []string `json:"architectures"`
+}
+
+type agentLogResponse struct {
+	// Cancel asks the agent to stop the target
+	Cancel bool `json:"cancel"`
+}
+
+// agentAuthorized checks the bearer token agents send against
+// MTH_AGENT_TOKEN; without it set, agents are refused
+func (s *Server) agentAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	err := s.runner.AgentAuthorized(token)
+	switch {
+	case errors.Is(err, runner.ErrAgentsDisabled):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	}
+	return err == nil
+}
+
+// @Summary Register an agent or list agents
+// @Description POST registers a remote agent for the architectures it runs natively and returns its ID. GET lists registered agents. Agents authenticate with the bearer token MTH_AGENT_TOKEN and are refused when it is not set.
+// @Tags agents
+// @Accept json
+// @Produce json
+// @Param body body registerAgentRequest false "Agent registration"
+// @Success 200 {object} runner.Agent
+// @Failure 400 {string} string "Invalid registration"
+// @Failure 401 {string} string "Invalid agent token"
+// @Failure 403 {string} string "Agents are disabled"
+// @Failure 409 {string} string "Agent ID in use"
+// @Router /agents [post]
+func (s *Server) handleAgents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.runner.Agents())
+	case http.MethodPost:
+		if !s.agentAuthorized(w, r) {
+			return
+		}
+		var req registerAgentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		agent, err := s.runner.RegisterAgent(req.ID, req.Name, req.Architectures)
+		if errors.Is(err, runner.ErrAgentIDInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(agent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// routeAgent dispatches /agents/{id}/poll, /agents/{id}/log and
+// /agents/{id}/result
+func (s *Server) routeAgent(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/agents/")
+	agentID, action, ok := strings.Cut(path, "/")
+	if !ok || agentID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.agentAuthorized(w, r) {
+		return
+	}
+	switch action {
+	case "poll":
+		s.handleAgentPoll(w, r, agentID)
+	case "log":
+		s.handleAgentLog(w, r, agentID)
+	case "result":
+		s.handleAgentResult(w, r, agentID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// agentError maps runner agent errors to HTTP statuses
+func agentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, runner.ErrUnknownAgent):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, runner.ErrNotAssigned):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// @Summary Wait for a target assignment
+// @Description Long-polls for a queued target matching the agent's architectures. Returns 204 when none arrived within the wait time.
+// @Tags agents
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param wait query string false "How long to wait, e.g. 30s (max 60s)"
+// @Success 200 {object} runner.Assignment
+// @Success 204 {string} string "No target available"
+// @Failure 404 {string} string "Unknown agent"
+// @Router /agents/{id}/poll [post]
+func (s *Server) handleAgentPoll(w http.ResponseWriter, r *http.Request, agentID string) {
+	wait := defaultPollWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxPollWait)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	assignment, err := s.runner.Claim(ctx, agentID)
+	if err != nil {
+		agentError(w, err)
+		return
+	}
+	if assignment == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(assignment)
+}
+
+// @Summary Stream target output from an agent
+// @Description Appends the request body to the target's log. The response tells the agent whether the target was cancelled.
+// @Tags agents
+// @Accept plain
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param job_id query string true "Job ID"
+// @Param arch query string true "Architecture"
+// @Success 200 {object} agentLogResponse
+// @Failure 404 {string} string "Unknown agent"
+// @Failure 409 {string} string "Target not assigned to the agent"
+// @Router /agents/{id}/log [post]
+func (s *Server) handleAgentLog(w http.ResponseWriter, r *http.Request, agentID string) {
+	chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLogChunk))
+	if err != nil {
+		http.Error(w, "log chunk too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	q := r.URL.Query()
+	cancel, err := s.runner.AgentLog(agentID, q.Get("job_id"), q.Get("arch"), chunk)
+	if err != nil {
+		agentError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(agentLogResponse{Cancel: cancel})
+}
+
+// @Summary Report the outcome of a target
+// @Description Records the exit code, failure reason and test results of a target the agent ran
+// @Tags agents
+// @Accept json
+// @Param id path string true "Agent ID"
+// @Param job_id query string true "Job ID"
+// @Param arch query string true "Architecture"
+// @Param body body runner.Result true "Target outcome"
+// @Success 204 {string} string "Recorded"
+// @Failure 404 {string} string "Unknown agent"
+// @Failure 409 {string} string "Target not assigned to the agent"
+// @Router /agents/{id}/result [post]
+func (s *Server) handleAgentResult(w http.ResponseWriter, r *http.Request, agentID string) {
+	var res runner.Result
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	if err := s.runner.AgentResult(agentID, q.Get("job_id"), q.Get("arch"), res); err != nil {
+		agentError(w, err)
+		return
+	}
+	logging.Logger.Info("agent_result", "agent_id", agentID, "job_id", q.Get("job_id"), "arch", q.Get("arch"))
+	w.WriteHeader(http.StatusNoContent)
+}
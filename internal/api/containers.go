@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/provisioner"
+)
+
+const (
+	// containerStateRemoved means the container of a local attempt no longer
+	// exists, normally because it was torn down after the target finished
+	containerStateRemoved = "removed"
+	// containerStateRemote means an agent ran the attempt on its own host
+	containerStateRemote = "remote"
+
+	inspectTimeout = 10 * time.Second
+)
+
+type containerView struct {
+	JobID    string `json:"job_id"`
+	Arch     string `json:"arch"`
+	Attempt  int    `json:"attempt"`
+	Executor string `json:"executor,omitempty"`
+	// Name is deterministic, so the container can be found by hand even on
+	// an agent's host
+	Name        string `json:"name"`
+	ContainerID string `json:"container_id,omitempty"`
+	State       string `json:"state"`
+}
+
+// @Summary Get the container of a target
+// @Description Reports the name, ID and state of the container running the target's latest attempt. The state is removed once the container was torn down and remote when an agent runs the target.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Param arch path string true "Architecture"
+// @Success 200 {object} containerView
+// @Failure 404 {string} string "Job or target not found, or target not started"
+// @Router /jobs/{id}/targets/{arch}/container [get]
+func (s *Server) handleTargetContainer(w http.ResponseWriter, r *http.Request, jobID, arch string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := s.store.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	target := findTarget(job, arch)
+	if target == nil {
+		http.Error(w, "target not found", http.StatusNotFound)
+		return
+	}
+	if target.Attempt == 0 {
+		http.Error(w, "target not started", http.StatusNotFound)
+		return
+	}
+
+	view := containerView{
+		JobID:    jobID,
+		Arch:     arch,
+		Attempt:  target.Attempt,
+		Executor: target.Executor,
+		Name:     provisioner.Name(jobID, arch, target.Attempt),
+		State:    containerStateRemoved,
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), inspectTimeout)
+	defer cancel()
+	env, err := s.runner.Environment(ctx, jobID, arch, target.Attempt)
+	if err != nil {
+		logging.Logger.Error("container_inspect_failed", "job_id", jobID, "arch", arch, "error", err)
+		http.Error(w, "inspect failed", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case env != nil:
+		view.Name = env.Name
+		view.ContainerID = env.ID
+		view.State = env.State
+	case !s.runner.OwnsExecutor(target.Executor):
+		view.State = containerStateRemote
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(view)
+}
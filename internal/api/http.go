@@ -8,15 +8,21 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"math/rand"
 	"net/http"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/jobspec"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/runner"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
@@ -27,6 +33,8 @@ type Server struct {
 	runner     *runner.Runner
 	httpServer *http.Server
 	jobCounter uint64
+	// fetchSpec reads spec files from the repositories jobs test
+	fetchSpec jobspec.Fetcher
 }
 type jobTargetView struct {
 	Arch      string            `json:"arch"`
@@ -34,7 +42,30 @@ type jobTargetView struct {
 	ExitCode  int               `json:"exit_code"`
 	StartedAt *time.Time        `json:"started_at,omitempty"`
 	EndedAt   *time.Time        `json:"ended_at,omitempty"`
-	Log       string            `json:"log,omitempty"`
+	// Log is the start of the log; only GET /jobs/{id} includes it
+	Log     string `json:"log,omitempty"`
+	LogSize int64  `json:"log_size"`
+	Reason  string `json:"reason,omitempty"`
+	Commit  string `json:"resolved_commit,omitempty"`
+	// QueuePosition is the 1-based position in the pending queue
+	QueuePosition int           `json:"queue_position,omitempty"`
+	Attempt       int           `json:"attempt,omitempty"`
+	Attempts      []attemptView `json:"attempts,omitempty"`
+	// Executor is the ID of the server workers or the agent running the target
+	Executor       string     `json:"executor,omitempty"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+// attemptView summarises an earlier attempt; its log is served by the log
+// endpoint with ?attempt=N
+type attemptView struct {
+	Number    int               `json:"number"`
+	Status    core.TargetStatus `json:"status"`
+	Reason    string            `json:"reason,omitempty"`
+	ExitCode  int               `json:"exit_code"`
+	StartedAt *time.Time        `json:"started_at,omitempty"`
+	EndedAt   *time.Time        `json:"ended_at,omitempty"`
+	LogSize   int64             `json:"log_size"`
 }
 
 type jobView struct {
@@ -49,16 +80,26 @@ type jobView struct {
 	UpdatedAt     time.Time       `json:"updated_at"`
 	StartedAt     *time.Time      `json:"started_at,omitempty"`
 	EndedAt       *time.Time      `json:"ended_at,omitempty"`
+	RerunOf       string          `json:"rerun_of,omitempty"`
+	// Reruns are the jobs that re-ran this one; only set on GET /jobs/{id}
+	Reruns []string `json:"reruns,omitempty"`
 }
 
-func NewServer(addr string, st store.Store) *Server {
+func NewServer(addr string, st store.Store, rn *runner.Runner) *Server {
 	s := &Server{
-		store:  st,
-		runner: runner.NewRunner(st)}
+		store:     st,
+		runner:    rn,
+		fetchSpec: jobspec.GitFetch,
+	}
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/jobs", s.handleJobs)
 	mux.HandleFunc("/jobs/", s.routeJob)
+	mux.HandleFunc("/flaky", s.handleFlaky)
+	mux.HandleFunc("/agents", s.handleAgents)
+	mux.HandleFunc("/agents/", s.routeAgent)
+	mux.HandleFunc("/capabilities", s.handleCapabilities)
+	mux.HandleFunc("/architectures", s.handleArchitectures)
 
 	// Health + metrics
 	mux.HandleFunc("/healthz", s.handleHealthz)
@@ -80,11 +121,25 @@ func NewServer(addr string, st store.Store) *Server {
 	logging.Logger.Info("server_starting", "addr", addr)
 	return s
 }
+
+// SetSpecFetcher sets how spec files are read; it defaults to
+// jobspec.GitFetch
+func (s *Server) SetSpecFetcher(f jobspec.Fetcher) {
+	s.fetchSpec = f
+}
+
 func (s *Server) Start() error {
 	log.Printf("listening on %s", s.httpServer.Addr)
 	return s.httpServer.ListenAndServe()
 }
 
+// specFetchTimeout bounds reading a spec file from a repository
+const specFetchTimeout = 30 * time.Second
+
+// errSpecFetch is what clients see when the repository of a spec file
+// cannot be fetched
+var errSpecFetch = errors.New("read spec file: cannot fetch the repository over https or ssh at the requested commit")
+
 type createJobRequest struct {
 	Repo          string            `json:"repo"`
 	Commit        string            `json:"commit"`
@@ -92,6 +147,18 @@ type createJobRequest struct {
 	Architectures []string          `json:"architectures"`
 	Timeout       string            `json:"timeout,omitempty"`
 	Env           map[string]string `json:"env,omitempty"`
+	// SecretEnv names the env entries that hold secrets; they are stored
+	// encrypted, which needs MTH_SECRET_KEY
+	SecretEnv []string          `json:"secret_env,omitempty"`
+	Retry     *core.RetryPolicy `json:"retry,omitempty"`
+	// Image replaces the configured per-architecture images, e.g. golang:1.22
+	Image string `json:"image,omitempty"`
+	// Setup are shell commands run in the checkout before the test command
+	Setup []string `json:"setup,omitempty"`
+	// SpecFile is a spec file in the repository that fills in the fields
+	// the request leaves out. It defaults to .mth.yaml, which is read when
+	// architectures or test_command are missing.
+	SpecFile string `json:"spec_file,omitempty"`
 }
 
 type createJobResponse struct {
@@ -132,47 +199,162 @@ func (s *Server) createJob(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if req.Repo != "" && (req.SpecFile != "" || len(req.Architectures) == 0 || req.TestCommand == "") {
+		if err := s.applySpecFile(r.Context(), &req); err != nil {
+			logging.Logger.Warn("job_spec_file_failed", "repo", req.Repo, "commit", req.Commit, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	if len(req.Architectures) == 0 || req.Repo == "" || req.TestCommand == "" {
 		http.Error(w, "missing required fields", http.StatusBadRequest)
 		return
 	}
-
-	now := time.Now()
-	jobID := s.newJobID()
-	targets := make([]*core.JobTarget, 0, len(req.Architectures))
-	for _, arch := range req.Architectures {
-		targets = append(targets, &core.JobTarget{
-			Arch:   arch,
-			Status: core.TargetStatusPending,
-		})
+	archs, err := core.NormalizeArchitectures(req.Architectures)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Architectures = archs
+	if err := s.checkArchitectures(req.Architectures); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	if err := s.runner.CheckArchitectures(req.Architectures); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Retry != nil {
+		if err := req.Retry.Validate(); err != nil {
+			http.Error(w, "invalid retry policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, name := range req.SecretEnv {
+		if _, ok := req.Env[name]; !ok {
+			http.Error(w, fmt.Sprintf("secret_env %q is not in env", name), http.StatusBadRequest)
+			return
+		}
+	}
+
 	job := &core.Job{
-		ID:            jobID,
 		Repo:          req.Repo,
 		Commit:        req.Commit,
 		TestCommand:   req.TestCommand,
 		Architectures: req.Architectures,
-		Status:        core.JobStatusPending,
-		Targets:       targets,
-		CreatedAt:     now,
-		UpdatedAt:     now,
 		Timeout:       req.Timeout,
 		Env:           req.Env,
+		SecretEnv:     req.SecretEnv,
+		Retry:         req.Retry,
+		Image:         req.Image,
+		Setup:         req.Setup,
+	}
+	err = s.submitJob(job)
+	if errors.Is(err, store.ErrNoSecretKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logging.Logger.Error("job_create_failed", "error", err)
+		http.Error(w, "failed to save job", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createJobResponse{ID: job.ID})
+}
+
+// applySpecFile fills the fields req leaves out from the spec file in the
+// repository at the requested commit; env entries are merged, with the
+// request's winning
+func (s *Server) applySpecFile(ctx context.Context, req *createJobRequest) error {
+	path := req.SpecFile
+	if path == "" {
+		path = jobspec.DefaultPath
+	}
+	ctx, cancel := context.WithTimeout(ctx, specFetchTimeout)
+	defer cancel()
+	data, err := s.fetchSpec(ctx, req.Repo, req.Commit, path)
+	if errors.Is(err, jobspec.ErrNotFound) {
+		return fmt.Errorf("read spec file: %w", err)
+	}
+	if err != nil {
+		// git's output can name hosts and paths of the server, so it only
+		// goes to the log
+		logging.Logger.Warn("job_spec_fetch_failed", "repo", req.Repo, "commit", req.Commit, "error", err)
+		return errSpecFetch
+	}
+	spec, err := jobspec.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	if len(req.Architectures) == 0 {
+		req.Architectures = spec.Architectures
+	}
+	if req.TestCommand == "" {
+		req.TestCommand = spec.TestCommand
+	}
+	if req.Timeout == "" {
+		req.Timeout = spec.Timeout
+	}
+	if req.Image == "" {
+		req.Image = spec.Image
+	}
+	if len(req.Setup) == 0 {
+		req.Setup = spec.Setup
+	}
+	if req.Retry == nil {
+		req.Retry = spec.Retry
+	}
+	if len(spec.Env) > 0 {
+		env := maps.Clone(spec.Env)
+		maps.Copy(env, req.Env)
+		req.Env = env
+	}
+	return nil
+}
+
+// checkArchitectures rejects architectures no image is configured for
+func (s *Server) checkArchitectures(archs []string) error {
+	supported := s.runner.SupportedArchitectures()
+	for _, arch := range archs {
+		if !slices.Contains(supported, arch) {
+			return fmt.Errorf("unsupported architecture %q, supported: %s", arch, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+// submitJob assigns job an ID, creates a pending target per architecture,
+// persists it and queues the targets; workers pick them up as slots free
+func (s *Server) submitJob(job *core.Job) error {
+	now := time.Now()
+	job.ID = s.newJobID()
+	job.Status = core.JobStatusPending
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	job.Targets = make([]*core.JobTarget, 0, len(job.Architectures))
+	for _, arch := range job.Architectures {
+		job.Targets = append(job.Targets, &core.JobTarget{
+			Arch:   arch,
+			Status: core.TargetStatusPending,
+		})
+	}
+
+	if _, err := s.store.SaveJob(job); err != nil {
+		return err
 	}
-	s.store.SaveJob(job)
 	logging.Logger.Info("job_created",
-		"job_id", jobID,
-		"repo", req.Repo,
-		"commit", req.Commit,
-		"architectures", req.Architectures,
+		"job_id", job.ID,
+		"repo", job.Repo,
+		"commit", job.Commit,
+		"architectures", job.Architectures,
+		"rerun_of", job.RerunOf,
 	)
 
-	// Kick off async execution
-	s.runner.RunJobAsync(job)
-
-	// For now, we are not running the job yet
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(createJobResponse{ID: jobID})
+	s.runner.Enqueue(job)
+	return nil
 }
 
 func (s *Server) newJobID() string {
@@ -207,15 +389,50 @@ func (s *Server) handleJobByID(w http.ResponseWriter, r *http.Request) {
 	logging.Logger.Info("job_fetched", "job_id", id, "status", job.Status)
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(toJobView(job))
+	_ = json.NewEncoder(w).Encode(s.toJobView(job))
 }
 
 func (s *Server) routeJob(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path[len("/jobs/"):] // everything after /jobs/
 
 	// log endpoint pattern: {id}/targets/{arch}/log
-	if strings.Contains(path, "/targets/") && strings.HasSuffix(path, "/log") {
-		s.handleTargetLog(w, r, path)
+	if jobID, arch, ok := splitTargetPath(path, "log"); ok {
+		s.handleTargetLog(w, r, jobID, arch)
+		return
+	}
+	// {id}/targets/{arch}/tests
+	if jobID, arch, ok := splitTargetPath(path, "tests"); ok {
+		s.handleTargetTests(w, r, jobID, arch)
+		return
+	}
+	// {id}/targets/{arch}/container
+	if jobID, arch, ok := splitTargetPath(path, "container"); ok {
+		s.handleTargetContainer(w, r, jobID, arch)
+		return
+	}
+	// {id}/targets/{arch}/cancel
+	if jobID, arch, ok := splitTargetPath(path, "cancel"); ok {
+		s.handleCancel(w, r, jobID, arch)
+		return
+	}
+	// {id}/cancel
+	if jobID, ok := strings.CutSuffix(path, "/cancel"); ok {
+		s.handleCancel(w, r, jobID, "")
+		return
+	}
+	// {id}/rerun
+	if jobID, ok := strings.CutSuffix(path, "/rerun"); ok {
+		s.handleRerun(w, r, jobID)
+		return
+	}
+	// {id}/junit.xml
+	if jobID, ok := strings.CutSuffix(path, "/junit.xml"); ok {
+		s.handleJobJUnit(w, r, jobID)
+		return
+	}
+	// {id}/diff
+	if jobID, ok := strings.CutSuffix(path, "/diff"); ok {
+		s.handleJobDiff(w, r, jobID)
 		return
 	}
 
@@ -223,6 +440,20 @@ func (s *Server) routeJob(w http.ResponseWriter, r *http.Request) {
 	s.handleJobByIDPath(w, r, path)
 }
 
+// splitTargetPath splits {id}/targets/{arch}/{action} paths. The arch is
+// everything between "targets/" and the action, so it may contain slashes.
+func splitTargetPath(path, action string) (jobID, arch string, ok bool) {
+	rest, ok := strings.CutSuffix(path, "/"+action)
+	if !ok {
+		return "", "", false
+	}
+	jobID, arch, ok = strings.Cut(rest, "/targets/")
+	if !ok || jobID == "" || arch == "" || strings.Contains(jobID, "/") {
+		return "", "", false
+	}
+	return jobID, arch, true
+}
+
 // @Summary Get job status
 // @Description Fetches job details with per-target results (truncated logs)
 // @Tags jobs
@@ -243,63 +474,175 @@ func (s *Server) handleJobByIDPath(w http.ResponseWriter, r *http.Request, id st
 	}
 	logging.Logger.Info("job_fetched", "job_id", id, "status", job.Status)
 
+	view := s.toJobView(job)
+	view.Reruns = s.reruns(id)
+	s.addLogPreviews(&view, job)
+
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(toJobView(job))
+	_ = json.NewEncoder(w).Encode(view)
 }
 
-func (s *Server) handleTargetLog(w http.ResponseWriter, r *http.Request, path string) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+// reruns returns the IDs of jobs that re-ran jobID, oldest first
+func (s *Server) reruns(jobID string) []string {
+	ids, err := s.store.Reruns(jobID)
+	if err != nil {
+		logging.Logger.Warn("job_reruns_failed", "job_id", jobID, "error", err)
+		return nil
 	}
+	return ids
+}
 
-	// path format: {id}/targets/{arch}/log
-	parts := strings.Split(path, "/")
-	if len(parts) != 4 || parts[1] != "targets" || parts[3] != "log" {
-		http.Error(w, "bad path", http.StatusBadRequest)
+// @Summary Cancel a job or a single target
+// @Description Stops running targets, tears down their containers and marks unfinished targets cancelled
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} jobView
+// @Failure 404 {string} string "Job or target not found"
+// @Failure 409 {string} string "Target already finished"
+// @Router /jobs/{id}/cancel [post]
+// @Router /jobs/{id}/targets/{arch}/cancel [post]
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request, jobID, arch string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	jobID := parts[0]
-	arch := parts[2]
 
 	job, err := s.store.GetJob(jobID)
 	if err != nil {
 		http.Error(w, "job not found", http.StatusNotFound)
 		return
 	}
-	var target *core.JobTarget
-	for _, t := range job.Targets {
-		if t.Arch == arch {
-			target = t
-			break
+	if arch != "" {
+		target := findTarget(job, arch)
+		if target == nil {
+			http.Error(w, "target not found", http.StatusNotFound)
+			return
 		}
+		if target.Status.IsTerminal() {
+			http.Error(w, "target already finished", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := s.runner.Cancel(jobID, arch); err != nil {
+		logging.Logger.Error("job_cancel_failed", "job_id", jobID, "arch", arch, "error", err)
+		http.Error(w, "cancel failed", http.StatusInternalServerError)
+		return
+	}
+	logging.Logger.Info("job_cancel", "job_id", jobID, "arch", arch)
+
+	job, err = s.store.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.toJobView(job))
+}
+
+// @Summary Rerun a job
+// @Description Creates a new job linked to the original through rerun_of. With only_failed=true only the targets that failed or errored are re-run. The rerun tests the commit the original targets resolved to, so results stay comparable.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Param only_failed query bool false "Only re-run failed and errored targets"
+// @Success 200 {object} createJobResponse
+// @Failure 404 {string} string "Job not found"
+// @Failure 409 {string} string "No failed targets to rerun"
+// @Router /jobs/{id}/rerun [post]
+func (s *Server) handleRerun(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	if target == nil {
-		http.Error(w, "target not found", http.StatusNotFound)
+	onlyFailed := r.URL.Query().Get("only_failed") == "true"
+
+	orig, err := s.store.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
 		return
 	}
 
-	logging.Logger.Info("target_log_fetched", "job_id", jobID, "arch", arch)
+	var archs []string
+	for _, t := range orig.Targets {
+		if onlyFailed && t.Status != core.TargetStatusFailed && t.Status != core.TargetStatusError {
+			continue
+		}
+		archs = append(archs, t.Arch)
+	}
+	if len(archs) == 0 {
+		http.Error(w, "no failed targets to rerun", http.StatusConflict)
+		return
+	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	if target.Log == "" {
-		_, _ = w.Write([]byte("(no log)\n"))
+	job := &core.Job{
+		Repo:          orig.Repo,
+		Commit:        rerunCommit(orig),
+		TestCommand:   orig.TestCommand,
+		Architectures: archs,
+		Timeout:       orig.Timeout,
+		Env:           orig.Env,
+		SecretEnv:     orig.SecretEnv,
+		Retry:         orig.Retry,
+		Image:         orig.Image,
+		Setup:         orig.Setup,
+		RerunOf:       orig.ID,
+	}
+	if err := s.submitJob(job); err != nil {
+		logging.Logger.Error("job_rerun_failed", "job_id", jobID, "error", err)
+		http.Error(w, "failed to save job", http.StatusInternalServerError)
 		return
 	}
-	_, _ = w.Write([]byte(target.Log))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(createJobResponse{ID: job.ID})
+}
+
+// rerunCommit pins a rerun to the SHA the original targets resolved to, so
+// that a moving branch does not change what is being tested
+func rerunCommit(job *core.Job) string {
+	resolved := ""
+	for _, t := range job.Targets {
+		if t.ResolvedCommit == "" {
+			continue
+		}
+		if resolved != "" && resolved != t.ResolvedCommit {
+			return job.Commit
+		}
+		resolved = t.ResolvedCommit
+	}
+	if resolved == "" {
+		return job.Commit
+	}
+	return resolved
+}
+
+func findTarget(job *core.Job, arch string) *core.JobTarget {
+	for _, t := range job.Targets {
+		if t.Arch == arch {
+			return t
+		}
+	}
+	return nil
 }
 
 func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
 	statusFilter := r.URL.Query().Get("status")
 
-	jobs, _ := s.store.ListJobs()
+	jobs, err := s.store.ListJobs()
+	if err != nil {
+		logging.Logger.Error("jobs_list_failed", "error", err)
+		http.Error(w, "failed to list jobs", http.StatusInternalServerError)
+		return
+	}
 
 	views := make([]jobView, 0, len(jobs))
 	for _, j := range jobs {
 		if statusFilter != "" && string(j.Status) != statusFilter {
 			continue
 		}
-		views = append(views, toJobView(j))
+		views = append(views, s.toJobView(j))
 	}
 
 	logging.Logger.Info("jobs_listed", "count", len(views), "status_filter", statusFilter)
@@ -319,6 +662,62 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+type architectureView struct {
+	Name     string   `json:"name"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Image    string   `json:"image"`
+	Platform string   `json:"platform"`
+}
+
+// @Summary List supported architectures
+// @Description Lists the architectures jobs may target by canonical name, with the aliases accepted for them and the image and platform their targets run with
+// @Tags system
+// @Produce json
+// @Success 200 {array} architectureView
+// @Router /architectures [get]
+func (s *Server) handleArchitectures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	views := make([]architectureView, 0)
+	for _, arch := range core.Architectures() {
+		image, ok := s.runner.ArchImage(arch.Name)
+		if !ok {
+			continue
+		}
+		views = append(views, architectureView{
+			Name:     arch.Name,
+			Aliases:  arch.Aliases,
+			Image:    image.Image,
+			Platform: image.Platform,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(views)
+}
+
+// @Summary Report which architectures the host can run
+// @Description Probes the Docker daemon and /proc/sys/fs/binfmt_misc again and reports, per supported architecture, whether targets run natively, under QEMU emulation, only on agents, or not at all
+// @Tags system
+// @Produce json
+// @Success 200 {object} capability.Report
+// @Failure 404 {string} string "Capability preflight disabled"
+// @Router /capabilities [get]
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := s.runner.ProbeCapabilities(r.Context())
+	if report == nil {
+		http.Error(w, "capability preflight disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
 func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -332,23 +731,35 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 
 const maxTargetLogPreview = 512
 
-func toJobView(job *core.Job) jobView {
+func (s *Server) toJobView(job *core.Job) jobView {
 	targets := make([]jobTargetView, 0, len(job.Targets))
 	for _, t := range job.Targets {
 		view := jobTargetView{
-			Arch:      t.Arch,
-			Status:    t.Status,
-			ExitCode:  t.ExitCode,
-			StartedAt: t.StartedAt,
-			EndedAt:   t.EndedAt,
+			Arch:           t.Arch,
+			Status:         t.Status,
+			ExitCode:       t.ExitCode,
+			StartedAt:      t.StartedAt,
+			EndedAt:        t.EndedAt,
+			Reason:         t.Reason,
+			LogSize:        t.LogSize,
+			Commit:         t.ResolvedCommit,
+			Executor:       t.Executor,
+			LeaseExpiresAt: t.LeaseExpiresAt,
 		}
-		// Optional: include a preview of logs, truncated
-		if t.Log != "" {
-			logStr := t.Log
-			if len(logStr) > maxTargetLogPreview {
-				logStr = logStr[:maxTargetLogPreview] + "...(truncated)"
-			}
-			view.Log = logStr
+		if t.Status == core.TargetStatusPending {
+			view.QueuePosition = s.runner.QueuePosition(job.ID, t.Arch)
+		}
+		view.Attempt = t.Attempt
+		for _, a := range t.Attempts {
+			view.Attempts = append(view.Attempts, attemptView{
+				Number:    a.Number,
+				Status:    a.Status,
+				Reason:    a.Reason,
+				ExitCode:  a.ExitCode,
+				StartedAt: a.StartedAt,
+				EndedAt:   a.EndedAt,
+				LogSize:   a.LogSize,
+			})
 		}
 		targets = append(targets, view)
 	}
@@ -364,6 +775,23 @@ func toJobView(job *core.Job) jobView {
 		UpdatedAt:     job.UpdatedAt,
 		StartedAt:     job.StartedAt,
 		EndedAt:       job.EndedAt,
+		RerunOf:       job.RerunOf,
+	}
+}
+
+// addLogPreviews fills in the start of each target's log. Logs are read
+// from the log store, so job lists leave them out.
+func (s *Server) addLogPreviews(view *jobView, job *core.Job) {
+	for i, t := range job.Targets {
+		preview, err := store.ReadLog(s.runner.LogStore(), t.LogRef, 0, min(t.LogSize, maxTargetLogPreview))
+		if err != nil {
+			logging.Logger.Warn("target_log_preview_failed", "job_id", job.ID, "arch", t.Arch, "error", err)
+			continue
+		}
+		if t.LogSize > maxTargetLogPreview {
+			preview += "...(truncated)"
+		}
+		view.Targets[i].Log = preview
 	}
 }
 
@@ -0,0 +1,375 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/agent"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/capability"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/jobspec"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/provisioner"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/runner"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logging.Init()
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server whose runner is never started, so targets
+// stay queued and tests can set their outcome directly in the store
+func newTestServer() (*Server, store.Store) {
+	st := store.NewMemoryStore()
+	cfg := &config.Config{DefaultTimeout: time.Minute}
+	rn := runner.NewRunner(st, cfg, provisioner.NewFake())
+	return NewServer(":0", st, rn), st
+}
+
+func do(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func createTestJob(t *testing.T, s *Server, body string) string {
+	rec := do(s, http.MethodPost, "/jobs", body)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp createJobResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp.ID
+}
+
+func TestRerunOnlyFailed(t *testing.T) {
+	s, st := newTestServer()
+	id := createTestJob(t, s, `{"repo":"https://example.com/r.git","commit":"main","test_command":"go test ./...","architectures":["amd64","arm64"]}`)
+
+	for arch, status := range map[string]core.TargetStatus{"amd64": core.TargetStatusPassed, "arm64": core.TargetStatusFailed} {
+		st.UpdateTarget(id, arch, func(j *core.Job, tg *core.JobTarget) {
+			tg.Status = status
+			tg.ResolvedCommit = "abc123"
+		})
+	}
+
+	rec := do(s, http.MethodPost, "/jobs/"+id+"/rerun?only_failed=true", "")
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp createJobResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	rerun, err := st.GetJob(resp.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, id, rerun.RerunOf)
+	assert.Equal(t, []string{"arm64"}, rerun.Architectures)
+	assert.Equal(t, "abc123", rerun.Commit, "rerun is pinned to the resolved SHA")
+
+	rec = do(s, http.MethodGet, "/jobs/"+id, "")
+	var view jobView
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &view))
+	assert.Equal(t, []string{resp.ID}, view.Reruns)
+}
+
+func TestRerunWithoutFailures(t *testing.T) {
+	s, st := newTestServer()
+	id := createTestJob(t, s, `{"repo":"r","test_command":"make test","architectures":["amd64"]}`)
+	st.UpdateTarget(id, "amd64", func(j *core.Job, tg *core.JobTarget) {
+		tg.Status = core.TargetStatusPassed
+	})
+
+	assert.Equal(t, http.StatusConflict, do(s, http.MethodPost, "/jobs/"+id+"/rerun?only_failed=true", "").Code)
+	assert.Equal(t, http.StatusOK, do(s, http.MethodPost, "/jobs/"+id+"/rerun", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(s, http.MethodPost, "/jobs/missing/rerun", "").Code)
+}
+
+func TestFlakyTests(t *testing.T) {
+	s, st := newTestServer()
+
+	rec := do(s, http.MethodGet, "/flaky", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	now := time.Now().UTC()
+	outcome := func(arch string, status core.TestStatus) core.TestOutcome {
+		return core.TestOutcome{
+			Repo: "https://example.com/repo.git", Package: "example.com/app", Test: "TestA",
+			Arch: arch, Commit: "abc123", Status: status, RecordedAt: now,
+		}
+	}
+	assert.NoError(t, st.RecordTestOutcomes([]core.TestOutcome{
+		outcome("amd64", core.TestStatusPass),
+		outcome("amd64", core.TestStatusFail),
+		outcome("arm64", core.TestStatusPass),
+		outcome("arm64", core.TestStatusFail),
+	}))
+
+	rec = do(s, http.MethodGet, "/flaky?repo=https://example.com/repo.git&arch=arm64", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var flaky []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &flaky))
+	assert.Len(t, flaky, 1)
+	assert.Equal(t, "arm64", flaky[0]["arch"])
+	assert.Equal(t, "TestA", flaky[0]["name"])
+}
+
+func TestAgentRunsTargets(t *testing.T) {
+	st := store.NewMemoryStore()
+	// no local workers: targets only run on the agent
+	cfg := &config.Config{DefaultTimeout: time.Minute, AgentToken: "secret"}
+	rn := runner.NewRunner(st, cfg, provisioner.NewFake())
+	s := NewServer(":0", st, rn)
+	ts := httptest.NewServer(s.httpServer.Handler)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, rn.Start(ctx))
+
+	_, err := agent.NewClient(ts.URL, "wrong").Register(ctx, "", "board", []string{"riscv64"})
+	assert.Error(t, err)
+
+	prov := provisioner.NewFake()
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "go test") {
+			io.WriteString(stdout, "ok from the board\n")
+		}
+		return 0, nil
+	}
+	a := agent.New(agent.NewClient(ts.URL, "secret"), prov, "board", []string{"riscv64"}, 1)
+	go a.Run(ctx)
+
+	id := createTestJob(t, s, `{"repo":"https://example.com/repo.git","test_command":"go test ./...","architectures":["riscv64"]}`)
+	assert.Eventually(t, func() bool {
+		job, _ := st.GetJob(id)
+		return job.Status == core.JobStatusPassed
+	}, 5*time.Second, 20*time.Millisecond)
+
+	job, _ := st.GetJob(id)
+	log, err := store.ReadLog(s.runner.LogStore(), job.Targets[0].LogRef, 0, job.Targets[0].LogSize)
+	assert.NoError(t, err)
+	assert.Contains(t, log, "ok from the board")
+	assert.Len(t, prov.TornDown, 1)
+
+	rec := do(s, http.MethodGet, "/agents", "")
+	var agents []runner.Agent
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &agents))
+	assert.Len(t, agents, 1)
+	assert.Equal(t, "board", agents[0].Name)
+}
+
+func TestAgentsNeedToken(t *testing.T) {
+	s, _ := newTestServer()
+	body := `{"name":"board","architectures":["arm64"]}`
+	assert.Equal(t, http.StatusForbidden, do(s, http.MethodPost, "/agents", body).Code, "no token configured")
+
+	st := store.NewMemoryStore()
+	rn := runner.NewRunner(st, &config.Config{AgentToken: "secret"}, provisioner.NewFake())
+	s = NewServer(":0", st, rn)
+	assert.Equal(t, http.StatusUnauthorized, do(s, http.MethodPost, "/agents", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, do(s, http.MethodPost, "/agents/x/poll", "").Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/agents", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+func TestTargetContainer(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	rn := runner.NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+	s := NewServer(":0", st, rn)
+	id := createTestJob(t, s, `{"repo":"r","test_command":"make test","architectures":["arm/v7","arm64"]}`)
+
+	path := "/jobs/" + id + "/targets/arm/v7/container"
+	assert.Equal(t, http.StatusNotFound, do(s, http.MethodGet, path, "").Code, "not started yet")
+
+	for _, arch := range []string{"arm/v7", "arm64"} {
+		st.UpdateTarget(id, arch, func(j *core.Job, tg *core.JobTarget) {
+			tg.Status = core.TargetStatusRunning
+			tg.Attempt = 2
+			tg.Executor = rn.ExecutorID()
+		})
+	}
+	prov.Adopt(&provisioner.Environment{
+		ID:   "c1",
+		Name: provisioner.Name(id, "arm/v7", 2),
+		Spec: provisioner.Spec{JobID: id, Arch: "arm/v7", Attempt: 2, Executor: rn.ExecutorID()},
+	})
+
+	rec := do(s, http.MethodGet, path, "")
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var view containerView
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &view))
+	assert.Equal(t, "c1", view.ContainerID)
+	assert.Equal(t, "running", view.State)
+	assert.Equal(t, "mth-"+id+"-arm-v7-2", view.Name)
+
+	rec = do(s, http.MethodGet, "/jobs/"+id+"/targets/arm64/container", "")
+	var removed containerView
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &removed))
+	assert.Empty(t, removed.ContainerID)
+	assert.Equal(t, containerStateRemoved, removed.State)
+}
+
+func TestCreateJobArchitecturesAndImage(t *testing.T) {
+	s, st := newTestServer()
+
+	// known to the registry, but no image is configured for it
+	rec := do(s, http.MethodPost, "/jobs", `{"repo":"r","test_command":"make test","architectures":["amd64","loong64"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `unsupported architecture "loong64"`)
+
+	id := createTestJob(t, s, `{"repo":"r","test_command":"make test","architectures":["arm64"],"image":"golang:1.22"}`)
+	job, err := st.GetJob(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "golang:1.22", job.Image)
+}
+
+func TestCreateJobSecretEnv(t *testing.T) {
+	s, st := newTestServer()
+
+	rec := do(s, http.MethodPost, "/jobs", `{"repo":"r","test_command":"make test","architectures":["amd64"],"secret_env":["TOKEN"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `secret_env "TOKEN" is not in env`)
+
+	id := createTestJob(t, s, `{"repo":"r","test_command":"make test","architectures":["amd64"],"env":{"TOKEN":"s3cret"},"secret_env":["TOKEN"]}`)
+	rec = do(s, http.MethodPost, "/jobs/"+id+"/rerun", "")
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp createJobResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	rerun, err := st.GetJob(resp.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"TOKEN": "s3cret"}, rerun.Env)
+	assert.Equal(t, []string{"TOKEN"}, rerun.SecretEnv)
+	assert.NotContains(t, do(s, http.MethodGet, "/jobs/"+id, "").Body.String(), "s3cret")
+}
+
+// unlistableStore fails to list jobs
+type unlistableStore struct {
+	store.Store
+}
+
+func (unlistableStore) ListJobs() ([]*core.Job, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestListJobsFailure(t *testing.T) {
+	st := unlistableStore{store.NewMemoryStore()}
+	rn := runner.NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, provisioner.NewFake())
+	s := NewServer(":0", st, rn)
+
+	rec := do(s, http.MethodGet, "/jobs", "")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "not an empty list")
+}
+
+func TestCreateJobRejectsUnsupportedArchitecture(t *testing.T) {
+	s, _ := newTestServer()
+	assert.Equal(t, http.StatusNotFound, do(s, http.MethodGet, "/capabilities", "").Code)
+
+	s.runner.SetProber(&capability.Prober{
+		BinfmtDir: t.TempDir(),
+		HostArch:  func(ctx context.Context) (string, error) { return "amd64", nil },
+	})
+	rec := do(s, http.MethodGet, "/capabilities", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var report capability.Report
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, "amd64", report.HostArch)
+	a, _ := report.Lookup("arm64")
+	assert.Equal(t, capability.ModeUnsupported, a.Mode)
+
+	rec = do(s, http.MethodPost, "/jobs", `{"repo":"r","test_command":"make test","architectures":["amd64","arm64"]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), "qemu-aarch64")
+	createTestJob(t, s, `{"repo":"r","test_command":"make test","architectures":["amd64"]}`)
+}
+
+func TestCreateJobNormalizesArchitectures(t *testing.T) {
+	s, st := newTestServer()
+
+	id := createTestJob(t, s, `{"repo":"r","test_command":"make test","architectures":["x86_64","aarch64","armv7"]}`)
+	job, err := st.GetJob(id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amd64", "arm64", "arm/v7"}, job.Architectures)
+	assert.Equal(t, "arm64", job.Targets[1].Arch)
+
+	rec := do(s, http.MethodPost, "/jobs", `{"repo":"r","test_command":"make test","architectures":["arm64","aarch64"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "duplicate architecture arm64")
+
+	rec = do(s, http.MethodPost, "/jobs", `{"repo":"r","test_command":"make test","architectures":["sparc"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `unknown architecture "sparc"`)
+
+	rec = do(s, http.MethodGet, "/architectures", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var archs []architectureView
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &archs))
+	assert.Contains(t, archs, architectureView{
+		Name:     "arm64",
+		Aliases:  []string{"aarch64", "arm64/v8", "aarch64/v8", "armv8"},
+		Image:    "multi-arch-runner:arm64",
+		Platform: "linux/arm64/v8",
+	})
+	for _, a := range archs {
+		assert.NotEqual(t, "loong64", a.Name, "only configured architectures are listed")
+	}
+}
+
+func TestCreateJobFromSpecFile(t *testing.T) {
+	s, st := newTestServer()
+	var fetched []string
+	s.fetchSpec = func(ctx context.Context, repo, ref, path string) ([]byte, error) {
+		fetched = append(fetched, repo+"@"+ref+":"+path)
+		if path != jobspec.DefaultPath {
+			return nil, jobspec.ErrNotFound
+		}
+		return []byte(`
+architectures: [x86_64, arm64]
+test_command: go test ./...
+env: {A: file, B: file}
+timeout: 10m
+setup: [go mod download]
+`), nil
+	}
+
+	// request fields win over the file, env is merged
+	id := createTestJob(t, s, `{"repo":"r","commit":"main","architectures":["arm64"],"env":{"B":"request"}}`)
+	job, err := st.GetJob(id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"r@main:.mth.yaml"}, fetched)
+	assert.Equal(t, []string{"arm64"}, job.Architectures)
+	assert.Equal(t, "go test ./...", job.TestCommand)
+	assert.Equal(t, map[string]string{"A": "file", "B": "request"}, job.Env)
+	assert.Equal(t, "10m", job.Timeout)
+	assert.Equal(t, []string{"go mod download"}, job.Setup)
+
+	// complete requests do not read the file unless asked to
+	createTestJob(t, s, `{"repo":"r","test_command":"make","architectures":["amd64"]}`)
+	assert.Len(t, fetched, 1)
+
+	rec := do(s, http.MethodPost, "/jobs", `{"repo":"r","test_command":"make","architectures":["amd64"],"spec_file":"ci/mth.yaml"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "spec file not found")
+
+	// git's output stays on the server
+	s.fetchSpec = func(ctx context.Context, repo, ref, path string) ([]byte, error) {
+		return nil, errors.New("git fetch: exit status 128: fatal: '/etc/secret' does not appear to be a git repository")
+	}
+	rec = do(s, http.MethodPost, "/jobs", `{"repo":"/etc/secret"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "/etc/secret")
+	assert.Contains(t, rec.Body.String(), "cannot fetch the repository")
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+)
+
+// logPollInterval is how often followers re-check the store when no
+// notification arrives, e.g. for output persisted by another process
+const logPollInterval = time.Second
+
+// @Summary Get or follow a target log
+// @Description Returns the target log from a byte offset. With follow=true the log is streamed until the target finishes, as Server-Sent Events when the client accepts text/event-stream and as chunked text otherwise. SSE clients can resume with Last-Event-ID, which carries the byte offset.
+// @Tags jobs
+// @Produce plain
+// @Param id path string true "Job ID"
+// @Param arch path string true "Architecture"
+// @Param follow query bool false "Stream output while the target runs"
+// @Param offset query int false "Byte offset to start from"
+// @Param attempt query int false "Return the log of an earlier attempt"
+// @Success 200 {string} string "Log output"
+// @Failure 404 {string} string "Job or target not found"
+// @Router /jobs/{id}/targets/{arch}/log [get]
+func (s *Server) handleTargetLog(w http.ResponseWriter, r *http.Request, jobID, arch string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := s.store.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	target := findTarget(job, arch)
+	if target == nil {
+		http.Error(w, "target not found", http.StatusNotFound)
+		return
+	}
+
+	var offset int64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		offset, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	logging.Logger.Info("target_log_fetched", "job_id", jobID, "arch", arch, "offset", offset)
+
+	if v := r.URL.Query().Get("attempt"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid attempt", http.StatusBadRequest)
+			return
+		}
+		var earlier *core.Attempt
+		for i, a := range target.Attempts {
+			if a.Number == n {
+				earlier = &target.Attempts[i]
+				break
+			}
+		}
+		// the latest attempt lives on the target itself
+		if earlier == nil && n != target.Attempt {
+			http.Error(w, "attempt not found", http.StatusNotFound)
+			return
+		}
+		if earlier != nil {
+			s.writeLog(w, earlier.LogRef, offset, earlier.LogSize)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("follow") == "true" {
+		s.followTargetLog(w, r, jobID, arch, offset)
+		return
+	}
+
+	s.writeLog(w, target.LogRef, offset, target.LogSize)
+}
+
+// writeLog streams the log ref from offset up to the size recorded for it
+func (s *Server) writeLog(w http.ResponseWriter, ref string, offset, size int64) {
+	if size == 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("(no log)\n"))
+		return
+	}
+	offset = min(offset, size)
+	rc, err := s.runner.LogStore().Open(ref, offset)
+	if err != nil {
+		logging.Logger.Error("target_log_read_failed", "log_ref", ref, "error", err)
+		http.Error(w, "failed to read log", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.Copy(w, io.LimitReader(rc, size-offset))
+}
+
+// followTargetLog streams a target log from offset until the target reaches
+// a terminal status or the client goes away
+func (s *Server) followTargetLog(w http.ResponseWriter, r *http.Request, jobID, arch string, offset int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	// subscribe before the first read so no notification is missed
+	notify, unsubscribe := s.runner.WatchLog(jobID, arch)
+	defer unsubscribe()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := s.store.GetJob(jobID)
+		if err != nil {
+			return
+		}
+		target := findTarget(job, arch)
+		if target == nil {
+			return
+		}
+
+		// the recorded size says whether there is anything new to read
+		offset = min(offset, target.LogSize)
+		var chunk string
+		if target.LogSize > offset {
+			out, err := store.ReadLog(s.runner.LogStore(), target.LogRef, offset, target.LogSize-offset)
+			if err != nil {
+				logging.Logger.Warn("target_log_read_failed", "log_ref", target.LogRef, "error", err)
+				return
+			}
+			chunk = completeRunes(out)
+		}
+		if chunk != "" {
+			offset += int64(len(chunk))
+			if sse {
+				writeSSE(w, "", offset, chunk)
+			} else {
+				_, _ = w.Write([]byte(chunk))
+			}
+			flusher.Flush()
+		}
+
+		if target.Status.IsTerminal() && offset >= target.LogSize {
+			if sse {
+				writeSSE(w, "end", offset, string(target.Status))
+				flusher.Flush()
+			}
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeSSE writes one event whose id is the byte offset after its data
+func writeSSE(w http.ResponseWriter, event string, offset int64, data string) {
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	fmt.Fprintf(w, "id: %d\n", offset)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// completeRunes trims a trailing partial UTF-8 sequence so a multi-byte
+// character is never split across two events
+func completeRunes(s string) string {
+	for i := 1; i <= utf8.UTFMax && i <= len(s); i++ {
+		if utf8.RuneStart(s[len(s)-i]) {
+			if !utf8.FullRuneInString(s[len(s)-i:]) {
+				return s[:len(s)-i]
+			}
+			break
+		}
+	}
+	return s
+}
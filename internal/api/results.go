@@ -0,0 +1,209 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/report"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+)
+
+type targetTestsView struct {
+	JobID   string            `json:"job_id"`
+	Arch    string            `json:"arch"`
+	Status  core.TargetStatus `json:"status"`
+	Passed  int               `json:"passed"`
+	Failed  int               `json:"failed"`
+	Skipped int               `json:"skipped"`
+	Tests   []core.TestResult `json:"tests"`
+}
+
+// @Summary Get per-test results of a target
+// @Description Returns the structured results parsed from go test -json output. Package-level results have an empty name.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Param arch path string true "Architecture"
+// @Param status query string false "Only return results with this status (pass, fail, skip)"
+// @Success 200 {object} targetTestsView
+// @Failure 404 {string} string "Job or target not found"
+// @Router /jobs/{id}/targets/{arch}/tests [get]
+func (s *Server) handleTargetTests(w http.ResponseWriter, r *http.Request, jobID, arch string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := s.store.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	target := findTarget(job, arch)
+	if target == nil {
+		http.Error(w, "target not found", http.StatusNotFound)
+		return
+	}
+
+	statusFilter := r.URL.Query().Get("status")
+	view := targetTestsView{
+		JobID:  jobID,
+		Arch:   arch,
+		Status: target.Status,
+		Tests:  make([]core.TestResult, 0, len(target.Tests)),
+	}
+	for _, t := range target.Tests {
+		// counts cover tests only, not package results
+		if t.Name != "" {
+			switch t.Status {
+			case core.TestStatusPass:
+				view.Passed++
+			case core.TestStatusFail:
+				view.Failed++
+			case core.TestStatusSkip:
+				view.Skipped++
+			}
+		}
+		if statusFilter != "" && string(t.Status) != statusFilter {
+			continue
+		}
+		view.Tests = append(view.Tests, t)
+	}
+
+	logging.Logger.Info("target_tests_fetched", "job_id", jobID, "arch", arch, "count", len(view.Tests))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(view)
+}
+
+// @Summary Compare test results across architectures
+// @Description Lines up per-test results of all targets and reports tests that diverge between architectures, tests missing or skipped on some architectures, and per-arch duration outliers
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Param outlier_factor query number false "Flag tests at least this many times slower than on the other architectures (default 3)"
+// @Param min_delta query number false "Ignore outliers less than this many seconds slower (default 1)"
+// @Success 200 {object} report.Diff
+// @Failure 404 {string} string "Job not found"
+// @Router /jobs/{id}/diff [get]
+func (s *Server) handleJobDiff(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := report.DefaultDiffOptions()
+	if v := r.URL.Query().Get("outlier_factor"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			http.Error(w, "invalid outlier_factor", http.StatusBadRequest)
+			return
+		}
+		opts.OutlierFactor = f
+	}
+	if v := r.URL.Query().Get("min_delta"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			http.Error(w, "invalid min_delta", http.StatusBadRequest)
+			return
+		}
+		opts.MinOutlierDelta = f
+	}
+
+	job, err := s.store.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	diff := report.DiffJob(job, opts)
+	logging.Logger.Info("job_diff",
+		"job_id", jobID,
+		"divergent", len(diff.Divergent),
+		"missing", len(diff.Missing),
+		"outliers", len(diff.DurationOutliers),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(diff)
+}
+
+// @Summary Export job results as JUnit XML
+// @Description Emits one testsuite per architecture target, with per-test cases when structured results exist and a single synthetic case otherwise
+// @Tags jobs
+// @Produce xml
+// @Param id path string true "Job ID"
+// @Success 200 {string} string "JUnit XML report"
+// @Failure 404 {string} string "Job not found"
+// @Router /jobs/{id}/junit.xml [get]
+func (s *Server) handleJobJUnit(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := s.store.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	logging.Logger.Info("job_junit_exported", "job_id", jobID)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	if err := report.WriteJUnit(w, job, s.logTail); err != nil {
+		logging.Logger.Error("job_junit_failed", "job_id", jobID, "error", err)
+	}
+}
+
+// @Summary List flaky tests of a repository
+// @Description Reports tests that both passed and failed on the same commit and architecture across reruns and retries
+// @Tags tests
+// @Produce json
+// @Param repo query string true "Repository URL as submitted in jobs"
+// @Param arch query string false "Only return tests flaky on this architecture"
+// @Success 200 {array} report.FlakyTest
+// @Failure 400 {string} string "Missing repo"
+// @Router /flaky [get]
+func (s *Server) handleFlaky(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	repo := r.URL.Query().Get("repo")
+	if repo == "" {
+		http.Error(w, "repo is required", http.StatusBadRequest)
+		return
+	}
+	history, err := s.store.TestOutcomes(repo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	arch := r.URL.Query().Get("arch")
+	flaky := make([]report.FlakyTest, 0)
+	for _, f := range report.FindFlaky(history) {
+		if arch != "" && f.Arch != arch {
+			continue
+		}
+		flaky = append(flaky, f)
+	}
+	logging.Logger.Info("flaky_tests_fetched", "repo", repo, "count", len(flaky))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(flaky)
+}
+
+// logTail reads the end of a target's log for reports
+func (s *Server) logTail(t *core.JobTarget, n int64) string {
+	offset := max(t.LogSize-n, 0)
+	tail, err := store.ReadLog(s.runner.LogStore(), t.LogRef, offset, t.LogSize-offset)
+	if err != nil {
+		logging.Logger.Warn("target_log_read_failed", "log_ref", t.LogRef, "error", err)
+	}
+	return tail
+}
@@ -0,0 +1,145 @@
+// Package capability probes which architectures the host can run targets
+// for, natively or through QEMU user emulation registered with binfmt_misc.
+package capability
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Mode tells how targets of an architecture are run
+type Mode string
+
+const (
+	ModeNative   Mode = "native"
+	ModeEmulated Mode = "emulated"
+	// ModeAgent means only remote agents run the architecture
+	ModeAgent       Mode = "agent"
+	ModeUnsupported Mode = "unsupported"
+)
+
+// DefaultBinfmtDir is where the kernel lists binfmt_misc handlers
+const DefaultBinfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// interpreters maps base architectures to the binfmt_misc handler name
+// tonistiigi/binfmt and qemu-user-static register for them
+var interpreters = map[string]string{
+	"amd64":    "qemu-x86_64",
+	"386":      "qemu-i386",
+	"arm64":    "qemu-aarch64",
+	"arm":      "qemu-arm",
+	"ppc64le":  "qemu-ppc64le",
+	"riscv64":  "qemu-riscv64",
+	"s390x":    "qemu-s390x",
+	"mips64le": "qemu-mips64el",
+	"loong64":  "qemu-loongarch64",
+}
+
+// compatible lists architectures a host runs natively besides its own
+var compatible = map[string][]string{
+	"amd64": {"386"},
+}
+
+// Arch is the support for one architecture
+type Arch struct {
+	Arch string `json:"arch"`
+	Mode Mode   `json:"mode"`
+	// Interpreter is the binfmt_misc handler emulating the architecture,
+	// or the one that is missing when it is unsupported
+	Interpreter string `json:"interpreter,omitempty"`
+}
+
+// Report is the outcome of a probe
+type Report struct {
+	// HostArch is the architecture the container runtime runs natively
+	HostArch      string    `json:"host_arch"`
+	Architectures []Arch    `json:"architectures"`
+	CheckedAt     time.Time `json:"checked_at"`
+	// Error explains why the container runtime could not be asked; HostArch
+	// is then the server's own architecture
+	Error string `json:"error,omitempty"`
+}
+
+// Lookup returns the support for arch
+func (r *Report) Lookup(arch string) (Arch, bool) {
+	for _, a := range r.Architectures {
+		if a.Arch == arch {
+			return a, true
+		}
+	}
+	return Arch{}, false
+}
+
+// Prober inspects the host
+type Prober struct {
+	// BinfmtDir is where registered binfmt_misc handlers are listed
+	BinfmtDir string
+	// HostArch asks the container runtime for its native architecture
+	HostArch func(ctx context.Context) (string, error)
+}
+
+// NewProber returns a prober for the local host. hostArch may be nil when
+// the provisioner cannot tell, in which case the server's architecture is
+// assumed.
+func NewProber(hostArch func(ctx context.Context) (string, error)) *Prober {
+	return &Prober{BinfmtDir: DefaultBinfmtDir, HostArch: hostArch}
+}
+
+// Probe reports for every architecture in archs whether the host can run it
+func (p *Prober) Probe(ctx context.Context, archs []string) *Report {
+	report := &Report{HostArch: runtime.GOARCH, CheckedAt: time.Now()}
+	if p.HostArch != nil {
+		host, err := p.HostArch(ctx)
+		if err != nil {
+			report.Error = err.Error()
+		} else if host != "" {
+			report.HostArch = host
+		}
+	}
+
+	native := append([]string{report.HostArch}, compatible[report.HostArch]...)
+	for _, arch := range archs {
+		base, _, _ := strings.Cut(arch, "/")
+		a := Arch{Arch: arch, Mode: ModeUnsupported, Interpreter: interpreters[base]}
+		switch {
+		case slices.Contains(native, base):
+			a.Mode = ModeNative
+			a.Interpreter = ""
+		case a.Interpreter != "" && p.enabled(a.Interpreter):
+			a.Mode = ModeEmulated
+		}
+		report.Architectures = append(report.Architectures, a)
+	}
+	return report
+}
+
+// enabled reports whether the binfmt_misc handler name is registered and
+// enabled, and binfmt_misc itself is too
+func (p *Prober) enabled(name string) bool {
+	for _, file := range []string{"status", name} {
+		data, err := os.ReadFile(filepath.Join(p.BinfmtDir, file))
+		if err != nil {
+			return false
+		}
+		first, _, _ := strings.Cut(string(data), "\n")
+		if strings.TrimSpace(first) != "enabled" {
+			return false
+		}
+	}
+	return true
+}
+
+// Hint tells the operator how to make an unsupported architecture runnable
+func (a Arch) Hint() string {
+	if a.Interpreter == "" {
+		return fmt.Sprintf("architecture %s cannot be run on this host", a.Arch)
+	}
+	return fmt.Sprintf("architecture %s cannot be run on this host: binfmt_misc handler %s is not registered "+
+		"(docker run --privileged --rm tonistiigi/binfmt --install all)", a.Arch, a.Interpreter)
+}
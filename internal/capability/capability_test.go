@@ -0,0 +1,70 @@
+package capability
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeBinfmt(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestProbe(t *testing.T) {
+	p := &Prober{
+		BinfmtDir: writeBinfmt(t, map[string]string{
+			"status":       "enabled\n",
+			"qemu-aarch64": "enabled\ninterpreter /usr/bin/qemu-aarch64\nflags: F\n",
+			"qemu-s390x":   "disabled\ninterpreter /usr/bin/qemu-s390x\n",
+		}),
+		HostArch: func(ctx context.Context) (string, error) { return "amd64", nil },
+	}
+
+	report := p.Probe(context.Background(), []string{"amd64", "386", "arm64", "s390x", "riscv64", "sparc"})
+	assert.Equal(t, "amd64", report.HostArch)
+	assert.Empty(t, report.Error)
+	assert.Equal(t, []Arch{
+		{Arch: "amd64", Mode: ModeNative},
+		{Arch: "386", Mode: ModeNative},
+		{Arch: "arm64", Mode: ModeEmulated, Interpreter: "qemu-aarch64"},
+		{Arch: "s390x", Mode: ModeUnsupported, Interpreter: "qemu-s390x"},
+		{Arch: "riscv64", Mode: ModeUnsupported, Interpreter: "qemu-riscv64"},
+		{Arch: "sparc", Mode: ModeUnsupported},
+	}, report.Architectures)
+
+	a, ok := report.Lookup("s390x")
+	assert.True(t, ok)
+	assert.Contains(t, a.Hint(), "qemu-s390x is not registered")
+}
+
+func TestProbeBinfmtDisabled(t *testing.T) {
+	p := &Prober{
+		BinfmtDir: writeBinfmt(t, map[string]string{
+			"status":       "disabled\n",
+			"qemu-aarch64": "enabled\n",
+		}),
+		HostArch: func(ctx context.Context) (string, error) { return "amd64", nil },
+	}
+	a, _ := p.Probe(context.Background(), []string{"arm64"}).Lookup("arm64")
+	assert.Equal(t, ModeUnsupported, a.Mode)
+}
+
+func TestProbeHostArchFallback(t *testing.T) {
+	p := &Prober{
+		BinfmtDir: t.TempDir(),
+		HostArch:  func(ctx context.Context) (string, error) { return "", errors.New("daemon down") },
+	}
+	report := p.Probe(context.Background(), []string{runtime.GOARCH})
+	assert.Equal(t, runtime.GOARCH, report.HostArch)
+	assert.Equal(t, "daemon down", report.Error)
+	assert.Equal(t, ModeNative, report.Architectures[0].Mode)
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// AgentConfig configures the remote agent binary
+type AgentConfig struct {
+	// ServerURL is the base URL of the harness server
+	ServerURL string
+	// Name identifies the agent in GET /agents; defaults to the hostname
+	Name string
+	// Architectures are the architectures the host runs natively
+	Architectures []string
+	// Slots is the number of targets the agent runs at the same time
+	Slots int
+	// Token is sent to the server, which checks it against its AgentToken
+	Token       string
+	Provisioner string
+	// Container configures the containers the agent runs targets in
+	Container ContainerConfig
+}
+
+func LoadAgent() *AgentConfig {
+	server := os.Getenv("MTH_SERVER_URL")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	name := os.Getenv("MTH_AGENT_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+
+	archs := parseArchList(os.Getenv("MTH_AGENT_ARCHS"))
+	if len(archs) == 0 {
+		archs = []string{canonicalArch(runtime.GOARCH)}
+	}
+
+	slots, err := strconv.Atoi(os.Getenv("MTH_AGENT_SLOTS"))
+	if err != nil || slots < 1 {
+		slots = 1
+	}
+
+	prov := os.Getenv("MTH_PROVISIONER")
+	if prov == "" {
+		prov = "docker"
+	}
+
+	return &AgentConfig{
+		ServerURL:     server,
+		Name:          name,
+		Architectures: archs,
+		Slots:         slots,
+		Token:         os.Getenv("MTH_AGENT_TOKEN"),
+		Provisioner:   prov,
+		Container:     loadContainer(),
+	}
+}
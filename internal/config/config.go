@@ -1,12 +1,140 @@
 package config
 
 import (
+	"maps"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// Policies for targets whose executor stopped renewing its lease
+const (
+	// LostTargetRequeue puts lost targets back in the queue for a new attempt
+	LostTargetRequeue = "requeue"
+	// LostTargetError fails lost targets with reason executor_lost
+	LostTargetError = "error"
 )
 
+// ArchImage is the image and platform the targets of an architecture run
+// with
+type ArchImage struct {
+	// Image is used unless the job names its own
+	Image string
+	// Platform is passed to docker --platform, e.g. linux/arm64/v8, so that
+	// one multi-arch manifest image can serve every architecture
+	Platform string
+}
+
+// DefaultArchitectures are the architectures supported out of the box,
+// by their canonical core names. The amd64 variants share the amd64 image.
+var DefaultArchitectures = map[string]ArchImage{
+	"amd64":    {Image: "multi-arch-runner:amd64", Platform: "linux/amd64"},
+	"amd64/v2": {Image: "multi-arch-runner:amd64", Platform: "linux/amd64/v2"},
+	"amd64/v3": {Image: "multi-arch-runner:amd64", Platform: "linux/amd64/v3"},
+	"arm64":    {Image: "multi-arch-runner:arm64", Platform: "linux/arm64/v8"},
+	"arm/v6":   {Image: "multi-arch-runner:arm-v6", Platform: "linux/arm/v6"},
+	"arm/v7":   {Image: "multi-arch-runner:arm-v7", Platform: "linux/arm/v7"},
+	"386":      {Image: "multi-arch-runner:386", Platform: "linux/386"},
+	"ppc64le":  {Image: "multi-arch-runner:ppc64le", Platform: "linux/ppc64le"},
+	"riscv64":  {Image: "multi-arch-runner:riscv64", Platform: "linux/riscv64"},
+	"s390x":    {Image: "multi-arch-runner:s390x", Platform: "linux/s390x"},
+}
+
 type Config struct {
 	DefaultTimeout time.Duration
+	// Provisioner selects the backend targets run on, e.g. "docker"
+	Provisioner string
+	// Workers is the number of targets executed at the same time
+	Workers int
+	// ArchConcurrency caps running targets per architecture; architectures
+	// without an entry are only bound by Workers
+	ArchConcurrency map[string]int
+	// LocalArchitectures limits the targets local workers pick up, leaving
+	// the others to remote agents; empty means every architecture
+	LocalArchitectures []string
+	// AgentToken must be presented by agents; without it, agents are
+	// refused
+	AgentToken string
+	// LeaseDuration is how long a running target survives without a
+	// heartbeat from its executor
+	LeaseDuration time.Duration
+	// LostTargetPolicy is LostTargetRequeue or LostTargetError
+	LostTargetPolicy string
+	// ExecutorID is recorded for targets this server's workers run; empty
+	// derives it from the host name and the ID in ExecutorIDFile
+	ExecutorID string
+	// ExecutorIDFile keeps the random part of a derived executor ID across
+	// restarts; empty makes up a new one on every start
+	ExecutorIDFile string
+	// Architectures maps the supported architectures to their image and
+	// platform; nil means DefaultArchitectures
+	Architectures map[string]ArchImage
+	// SQLitePath is the database file of the sqlite store
+	SQLitePath string
+	// PostgresDSN is the connection string of the postgres store
+	PostgresDSN string
+	// SecretKey encrypts secret env values at rest, 32 base64-encoded bytes
+	SecretKey string
+	// LogStore keeps target logs: "file", "s3" or "memory"; empty picks
+	// one to match the job store
+	LogStore string
+	// LogDir is the directory of the file log store
+	LogDir string
+	// LogS3 is the bucket of the s3 log store
+	LogS3 S3Bucket
+	// SpecFileSSH lets spec files be fetched from ssh repositories, with the
+	// server's own ssh credentials
+	SpecFileSSH bool
+	// Container configures the containers local workers run targets in
+	Container ContainerConfig
+}
+
+// S3Bucket is a bucket of an S3-compatible object store
+type S3Bucket struct {
+	// Endpoint is the URL of the store, e.g. http://localhost:9000
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// ContainerConfig is applied to every container a provisioner creates
+type ContainerConfig struct {
+	// Workdir and User set where and as whom commands run; empty keeps the
+	// image's
+	Workdir string
+	User    string
+	// Mounts are bind mounts in docker's "source:target[:ro]" form
+	Mounts []string
+	// CPUs, Memory and PidsLimit limit the container; zero values mean no
+	// limit
+	CPUs      string
+	Memory    string
+	PidsLimit int
+}
+
+// Arch returns the image and platform of arch and whether it is supported
+func (c *Config) Arch(arch string) (ArchImage, bool) {
+	archs := c.Architectures
+	if archs == nil {
+		archs = DefaultArchitectures
+	}
+	a, ok := archs[arch]
+	return a, ok
+}
+
+// SupportedArchitectures returns the names of the supported architectures,
+// sorted
+func (c *Config) SupportedArchitectures() []string {
+	archs := c.Architectures
+	if archs == nil {
+		archs = DefaultArchitectures
+	}
+	return slices.Sorted(maps.Keys(archs))
 }
 
 func Load() *Config {
@@ -20,7 +148,172 @@ func Load() *Config {
 		timeout = 5 * time.Minute
 	}
 
+	prov := os.Getenv("MTH_PROVISIONER")
+	if prov == "" {
+		prov = "docker"
+	}
+
+	workers, err := strconv.Atoi(os.Getenv("MTH_WORKERS"))
+	if err != nil || workers < 0 {
+		workers = 4
+	}
+
+	lease, err := time.ParseDuration(os.Getenv("MTH_LEASE_DURATION"))
+	if err != nil || lease <= 0 {
+		lease = time.Minute
+	}
+
+	sqlitePath := os.Getenv("MTH_SQLITE_PATH")
+	if sqlitePath == "" {
+		sqlitePath = "data.db"
+	}
+
+	executorIDFile := os.Getenv("MTH_EXECUTOR_ID_FILE")
+	if executorIDFile == "" {
+		executorIDFile = "executor-id"
+	}
+
+	logDir := os.Getenv("MTH_LOG_DIR")
+	if logDir == "" {
+		logDir = "logs"
+	}
+
+	specFileSSH, _ := strconv.ParseBool(os.Getenv("MTH_SPEC_FILE_SSH"))
+
+	lostPolicy := os.Getenv("MTH_LOST_TARGET_POLICY")
+	if lostPolicy != LostTargetRequeue {
+		lostPolicy = LostTargetError
+	}
+
 	return &Config{
-		DefaultTimeout: timeout,
+		DefaultTimeout:     timeout,
+		Provisioner:        prov,
+		Workers:            workers,
+		ArchConcurrency:    parseArchLimits(os.Getenv("MTH_ARCH_CONCURRENCY")),
+		LocalArchitectures: parseArchList(os.Getenv("MTH_LOCAL_ARCHS")),
+		AgentToken:         os.Getenv("MTH_AGENT_TOKEN"),
+		LeaseDuration:      lease,
+		LostTargetPolicy:   lostPolicy,
+		ExecutorID:         os.Getenv("MTH_EXECUTOR_ID"),
+		ExecutorIDFile:     executorIDFile,
+		Architectures: parseArchImages(
+			os.Getenv("MTH_ARCH_IMAGES"), os.Getenv("MTH_ARCH_PLATFORMS")),
+		SQLitePath:  sqlitePath,
+		PostgresDSN: os.Getenv("MTH_POSTGRES_DSN"),
+		SecretKey:   os.Getenv("MTH_SECRET_KEY"),
+		LogStore:    os.Getenv("MTH_LOG_STORE"),
+		LogDir:      logDir,
+		LogS3: S3Bucket{
+			Endpoint:  os.Getenv("MTH_LOG_S3_ENDPOINT"),
+			Bucket:    os.Getenv("MTH_LOG_S3_BUCKET"),
+			AccessKey: os.Getenv("MTH_LOG_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("MTH_LOG_S3_SECRET_KEY"),
+		},
+		SpecFileSSH: specFileSSH,
+		Container:   loadContainer(),
+	}
+}
+
+// loadContainer reads the MTH_CONTAINER_* variables, shared by the server
+// and the agent
+func loadContainer() ContainerConfig {
+	pids, err := strconv.Atoi(os.Getenv("MTH_CONTAINER_PIDS_LIMIT"))
+	if err != nil || pids < 0 {
+		pids = 0
+	}
+	return ContainerConfig{
+		Workdir:   os.Getenv("MTH_CONTAINER_WORKDIR"),
+		User:      os.Getenv("MTH_CONTAINER_USER"),
+		Mounts:    parseList(os.Getenv("MTH_CONTAINER_MOUNTS")),
+		CPUs:      os.Getenv("MTH_CONTAINER_CPUS"),
+		Memory:    os.Getenv("MTH_CONTAINER_MEMORY"),
+		PidsLimit: pids,
+	}
+}
+
+// parseArchImages overlays "arch=image" and "arch=platform" lists on
+// DefaultArchitectures. Architectures may be given by alias; unknown ones
+// are skipped. An architecture that is not a default needs an image; its
+// platform defaults to the one in the core registry.
+func parseArchImages(images, platforms string) map[string]ArchImage {
+	archs := maps.Clone(DefaultArchitectures)
+	for name, image := range parseAssignments(images) {
+		arch, ok := core.LookupArch(name)
+		if !ok {
+			continue
+		}
+		a, ok := archs[arch.Name]
+		if !ok {
+			a.Platform = arch.Platform
+		}
+		a.Image = image
+		archs[arch.Name] = a
+	}
+	for name, platform := range parseAssignments(platforms) {
+		arch := canonicalArch(name)
+		if a, ok := archs[arch]; ok {
+			a.Platform = platform
+			archs[arch] = a
+		}
+	}
+	return archs
+}
+
+// canonicalArch returns the canonical name of arch, or arch itself when
+// the core registry does not know it
+func canonicalArch(arch string) string {
+	if name, err := core.NormalizeArch(arch); err == nil {
+		return name
+	}
+	return arch
+}
+
+// parseAssignments parses "key=value,key=value", skipping malformed entries
+func parseAssignments(s string) map[string]string {
+	m := make(map[string]string)
+	for _, entry := range parseList(s) {
+		k, v, ok := strings.Cut(entry, "=")
+		if k, v = strings.TrimSpace(k), strings.TrimSpace(v); ok && k != "" && v != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// parseList splits a comma-separated list, dropping empty entries
+func parseList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// parseArchList parses a comma-separated list of architectures into their
+// canonical names
+func parseArchList(s string) []string {
+	archs := parseList(s)
+	for i, arch := range archs {
+		archs[i] = canonicalArch(arch)
+	}
+	return archs
+}
+
+// parseArchLimits parses "amd64=4,riscv64=1", skipping malformed entries
+func parseArchLimits(s string) map[string]int {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		arch, n, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || limit < 0 {
+			continue
+		}
+		limits[canonicalArch(strings.TrimSpace(arch))] = limit
 	}
+	return limits
 }
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Architecture is a canonical target architecture. Name uses Go's GOARCH
+// spelling, followed by the variant for architectures that have several,
+// e.g. arm/v7 or amd64/v3.
+type Architecture struct {
+	Name string `json:"name"`
+	// Platform is the OCI platform images are selected by
+	Platform string `json:"platform"`
+	// Aliases are other spellings accepted for the architecture, e.g. the
+	// uname -m output
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// architectures is the registry of known architectures
+var architectures = []Architecture{
+	{Name: "amd64", Platform: "linux/amd64", Aliases: []string{"x86_64", "x86-64", "x64", "amd64/v1"}},
+	{Name: "amd64/v2", Platform: "linux/amd64/v2", Aliases: []string{"x86_64/v2", "x86-64-v2"}},
+	{Name: "amd64/v3", Platform: "linux/amd64/v3", Aliases: []string{"x86_64/v3", "x86-64-v3"}},
+	{Name: "amd64/v4", Platform: "linux/amd64/v4", Aliases: []string{"x86_64/v4", "x86-64-v4"}},
+	{Name: "arm64", Platform: "linux/arm64/v8", Aliases: []string{"aarch64", "arm64/v8", "aarch64/v8", "armv8"}},
+	{Name: "arm/v6", Platform: "linux/arm/v6", Aliases: []string{"armv6", "armv6l", "armel"}},
+	{Name: "arm/v7", Platform: "linux/arm/v7", Aliases: []string{"arm", "armv7", "armv7l", "armhf"}},
+	{Name: "386", Platform: "linux/386", Aliases: []string{"i386", "i686", "x86"}},
+	{Name: "ppc64le", Platform: "linux/ppc64le", Aliases: []string{"ppc64el", "powerpc64le"}},
+	{Name: "riscv64", Platform: "linux/riscv64"},
+	{Name: "s390x", Platform: "linux/s390x"},
+	{Name: "mips64le", Platform: "linux/mips64le", Aliases: []string{"mips64el"}},
+	{Name: "loong64", Platform: "linux/loong64", Aliases: []string{"loongarch64"}},
+}
+
+// archIndex maps canonical names and aliases to their architecture
+var archIndex = func() map[string]*Architecture {
+	index := make(map[string]*Architecture)
+	for i := range architectures {
+		a := &architectures[i]
+		index[a.Name] = a
+		for _, alias := range a.Aliases {
+			index[alias] = a
+		}
+	}
+	return index
+}()
+
+// Architectures returns the registry of known architectures
+func Architectures() []Architecture {
+	return append([]Architecture(nil), architectures...)
+}
+
+// LookupArch returns the architecture arch names, by its canonical name or
+// an alias, ignoring case and a leading linux/
+func LookupArch(arch string) (Architecture, bool) {
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(arch)), "linux/")
+	a, ok := archIndex[name]
+	if !ok {
+		return Architecture{}, false
+	}
+	return *a, true
+}
+
+// NormalizeArch returns the canonical name of arch
+func NormalizeArch(arch string) (string, error) {
+	a, ok := LookupArch(arch)
+	if !ok {
+		return "", fmt.Errorf("unknown architecture %q", arch)
+	}
+	return a.Name, nil
+}
+
+// NormalizeArchitectures returns the canonical names of archs, rejecting
+// unknown architectures and ones listed twice under any spelling
+func NormalizeArchitectures(archs []string) ([]string, error) {
+	names := make([]string, 0, len(archs))
+	given := make(map[string]string, len(archs))
+	for _, arch := range archs {
+		name, err := NormalizeArch(arch)
+		if err != nil {
+			return nil, err
+		}
+		if prev, dup := given[name]; dup {
+			return nil, fmt.Errorf("duplicate architecture %s: %q and %q", name, prev, arch)
+		}
+		given[name] = arch
+		names = append(names, name)
+	}
+	return names, nil
+}
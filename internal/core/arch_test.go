@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeArch(t *testing.T) {
+	for in, want := range map[string]string{
+		"amd64":       "amd64",
+		"x86_64":      "amd64",
+		"AARCH64":     "arm64",
+		"arm64/v8":    "arm64",
+		"linux/arm64": "arm64",
+		"armhf":       "arm/v7",
+		"arm/v6":      "arm/v6",
+		"amd64/v3":    "amd64/v3",
+		"i686":        "386",
+		" ppc64el ":   "ppc64le",
+	} {
+		got, err := NormalizeArch(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	_, err := NormalizeArch("sparc")
+	assert.EqualError(t, err, `unknown architecture "sparc"`)
+}
+
+func TestNormalizeArchitectures(t *testing.T) {
+	archs, err := NormalizeArchitectures([]string{"x86_64", "aarch64", "arm/v7"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amd64", "arm64", "arm/v7"}, archs)
+
+	_, err = NormalizeArchitectures([]string{"arm64", "aarch64"})
+	assert.EqualError(t, err, `duplicate architecture arm64: "arm64" and "aarch64"`)
+
+	_, err = NormalizeArchitectures([]string{"amd64", "mips"})
+	assert.Error(t, err)
+}
+
+func TestArchitectureAliasesAreUnique(t *testing.T) {
+	seen := make(map[string]string)
+	for _, a := range Architectures() {
+		for _, name := range append([]string{a.Name}, a.Aliases...) {
+			prev, dup := seen[name]
+			assert.False(t, dup, "%s is used by %s and %s", name, prev, a.Name)
+			seen[name] = a.Name
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package core
+
+// Reasons explain why a target did not pass
+const (
+	ReasonTimeout            = "timeout"
+	ReasonCancelled          = "cancelled"
+	ReasonDockerImageMissing = "docker_image_missing"
+	ReasonDockerDaemonError  = "docker_daemon_error"
+	ReasonDockerError        = "docker_error"
+	ReasonGitAuthError       = "git_auth_error"
+	ReasonGitCloneFailed     = "git_clone_failed"
+	ReasonGitCheckoutFailed  = "git_checkout_failed"
+	ReasonTestsFailed        = "tests_failed"
+	// ReasonExecutorLost marks targets whose worker or agent stopped
+	// renewing its lease
+	ReasonExecutorLost = "executor_lost"
+	// ReasonServerRestarted marks targets a local worker was running when
+	// the server went down
+	ReasonServerRestarted = "server_restarted"
+	// ReasonArchUnsupported marks targets whose binaries the host could not
+	// execute, typically because no QEMU emulator is registered
+	ReasonArchUnsupported = "arch_unsupported"
+	// ReasonSetupFailed marks targets whose setup steps failed before the
+	// tests ran
+	ReasonSetupFailed = "setup_failed"
+	// ReasonSecretUnavailable marks targets whose secret env values the
+	// server could not decrypt, e.g. after the secret key changed
+	ReasonSecretUnavailable = "secret_unavailable"
+)
+
+var knownReasons = map[string]bool{
+	ReasonTimeout:            true,
+	ReasonCancelled:          true,
+	ReasonDockerImageMissing: true,
+	ReasonDockerDaemonError:  true,
+	ReasonDockerError:        true,
+	ReasonGitAuthError:       true,
+	ReasonGitCloneFailed:     true,
+	ReasonGitCheckoutFailed:  true,
+	ReasonTestsFailed:        true,
+	ReasonExecutorLost:       true,
+	ReasonServerRestarted:    true,
+	ReasonArchUnsupported:    true,
+	ReasonSetupFailed:        true,
+	ReasonSecretUnavailable:  true,
+}
+
+// IsKnownReason reports whether reason is one the runner can produce
+func IsKnownReason(reason string) bool {
+	return knownReasons[reason]
+}
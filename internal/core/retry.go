@@ -0,0 +1,68 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxRetryAttempts bounds RetryPolicy.MaxAttempts
+const maxRetryAttempts = 10
+
+// DefaultRetryOn are the reasons retried when a policy names none. They
+// cover infrastructure hiccups, not genuine test failures.
+var DefaultRetryOn = []string{ReasonDockerDaemonError, ReasonDockerError, ReasonGitCloneFailed}
+
+// RetryPolicy controls how failed targets of a job are retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+	// RetryOn lists the target reasons that are retried
+	RetryOn []string `json:"retry_on,omitempty" yaml:"retry_on"`
+	// Backoff is the delay before the first retry, e.g. "10s". It doubles
+	// with every further attempt.
+	Backoff string `json:"backoff,omitempty" yaml:"backoff"`
+}
+
+// Validate checks the policy and fills in defaults
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 || p.MaxAttempts > maxRetryAttempts {
+		return fmt.Errorf("max_attempts must be between 1 and %d", maxRetryAttempts)
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = append([]string(nil), DefaultRetryOn...)
+	}
+	for _, reason := range p.RetryOn {
+		if !IsKnownReason(reason) || reason == ReasonCancelled {
+			return fmt.Errorf("reason %q cannot be retried", reason)
+		}
+	}
+	if p.Backoff != "" {
+		if d, err := time.ParseDuration(p.Backoff); err != nil || d < 0 {
+			return fmt.Errorf("invalid backoff %q", p.Backoff)
+		}
+	}
+	return nil
+}
+
+// NextDelay reports whether an attempt that failed with reason should be
+// retried and how long to wait before doing so
+func (p *RetryPolicy) NextDelay(attempt int, reason string) (time.Duration, bool) {
+	if p == nil || attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	retryable := false
+	for _, r := range p.RetryOn {
+		if r == reason {
+			retryable = true
+			break
+		}
+	}
+	if !retryable {
+		return 0, false
+	}
+	backoff, _ := time.ParseDuration(p.Backoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+	}
+	return backoff, true
+}
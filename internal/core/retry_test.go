@@ -0,0 +1,42 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyValidate(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3}
+	assert.NoError(t, p.Validate())
+	assert.Equal(t, DefaultRetryOn, p.RetryOn)
+
+	assert.Error(t, (&RetryPolicy{MaxAttempts: 0}).Validate())
+	assert.Error(t, (&RetryPolicy{MaxAttempts: 11}).Validate())
+	assert.Error(t, (&RetryPolicy{MaxAttempts: 2, RetryOn: []string{"bogus"}}).Validate())
+	assert.Error(t, (&RetryPolicy{MaxAttempts: 2, RetryOn: []string{ReasonCancelled}}).Validate())
+	assert.Error(t, (&RetryPolicy{MaxAttempts: 2, Backoff: "soon"}).Validate())
+}
+
+func TestRetryPolicyNextDelay(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, RetryOn: []string{ReasonGitCloneFailed}, Backoff: "10s"}
+
+	d, ok := p.NextDelay(1, ReasonGitCloneFailed)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, d)
+
+	d, ok = p.NextDelay(2, ReasonGitCloneFailed)
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Second, d)
+
+	_, ok = p.NextDelay(3, ReasonGitCloneFailed)
+	assert.False(t, ok, "attempts exhausted")
+
+	_, ok = p.NextDelay(1, ReasonTestsFailed)
+	assert.False(t, ok, "reason not retryable")
+
+	var none *RetryPolicy
+	_, ok = none.NextDelay(1, ReasonGitCloneFailed)
+	assert.False(t, ok)
+}
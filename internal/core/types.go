@@ -1,29 +1,43 @@
 package core
 
 import (
+	"maps"
+	"slices"
 	"time"
 )
 
 type JobStatus string
 
 const (
-	JobStatusPending JobStatus = "pending"
-	JobStatusRunning JobStatus = "running"
-	JobStatusPassed  JobStatus = "passed"
-	JobStatusFailed  JobStatus = "failed"
-	JobStatusError   JobStatus = "error"
+	JobStatusPending   JobStatus = "pending"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusPassed    JobStatus = "passed"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusError     JobStatus = "error"
+	JobStatusCancelled JobStatus = "cancelled"
 )
 
 type TargetStatus string
 
 const (
-	TargetStatusPending TargetStatus = "pending"
-	TargetStatusRunning TargetStatus = "running"
-	TargetStatusPassed  TargetStatus = "passed"
-	TargetStatusFailed  TargetStatus = "failed"
-	TargetStatusError   TargetStatus = "error"
+	TargetStatusPending   TargetStatus = "pending"
+	TargetStatusRunning   TargetStatus = "running"
+	TargetStatusPassed    TargetStatus = "passed"
+	TargetStatusFailed    TargetStatus = "failed"
+	TargetStatusError     TargetStatus = "error"
+	TargetStatusCancelled TargetStatus = "cancelled"
 )
 
+// IsTerminal reports whether a target in status s will not change any more
+func (s TargetStatus) IsTerminal() bool {
+	switch s {
+	case TargetStatusPassed, TargetStatusFailed, TargetStatusError, TargetStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
 type Job struct {
 	ID            string            `json:"id"`
 	Repo          string            `json:"repo"`
@@ -38,18 +52,179 @@ type Job struct {
 	EndedAt       *time.Time        `json:"ended_at,omitempty"`
 	Timeout       string            `json:"timeout,omitempty"`
 	Env           map[string]string `json:"env,omitempty"`
+	// SecretEnv names the Env entries that hold secrets, e.g. tokens;
+	// stores keep their values encrypted
+	SecretEnv []string     `json:"secret_env,omitempty"`
+	Retry     *RetryPolicy `json:"retry,omitempty"`
+	// Image overrides the image configured for each architecture, e.g. a
+	// multi-arch golang:1.22
+	Image string `json:"image,omitempty"`
+	// Setup are shell commands run in the checkout before the test command
+	Setup []string `json:"setup,omitempty"`
+	// RerunOf is the ID of the job this job re-runs
+	RerunOf string `json:"rerun_of,omitempty"`
 }
 
 type JobTarget struct {
 	Arch      string            `json:"arch"`
 	Status    TargetStatus      `json:"status"`
 	Reason    string            `json:"reason,omitempty"` //"docker_error", "git_error", "tests_failed"
-	Log       string            `json:"log,omitempty"`
 	ExitCode  int               `json:"exit_code"`
 	StartedAt *time.Time        `json:"started_at,omitempty"`
 	EndedAt   *time.Time        `json:"ended_at,omitempty"`
 	Timeout   string            `json:"timeout,omitempty"` // "5m", "30s"
 	Env       map[string]string `json:"env,omitempty"`     // pass to docker -e
+	// ResolvedCommit is the SHA the requested Job.Commit resolved to
+	ResolvedCommit string `json:"resolved_commit,omitempty"`
+	// Tests holds structured results when the test command is a go test run
+	Tests []TestResult `json:"tests,omitempty"`
+	// LogRef names the log of the latest attempt in the log store, LogSize
+	// is how many bytes of it were written
+	LogRef  string `json:"log_ref,omitempty"`
+	LogSize int64  `json:"log_size,omitempty"`
+	// Attempt is the number of the latest attempt; the fields above describe it
+	Attempt int `json:"attempt,omitempty"`
+	// Attempts are earlier attempts superseded by a retry
+	Attempts []Attempt `json:"attempts,omitempty"`
+	// Executor runs the target: the ID of the server process whose workers
+	// run it, starting with "server:", or of the agent holding it
+	Executor string `json:"executor,omitempty"`
+	// LeaseExpiresAt is the heartbeat deadline of a running target; the
+	// target is considered lost when its executor misses it
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+// Attempt records the outcome of one execution of a target
+type Attempt struct {
+	Number         int          `json:"number"`
+	Status         TargetStatus `json:"status"`
+	Reason         string       `json:"reason,omitempty"`
+	ExitCode       int          `json:"exit_code"`
+	StartedAt      *time.Time   `json:"started_at,omitempty"`
+	EndedAt        *time.Time   `json:"ended_at,omitempty"`
+	ResolvedCommit string       `json:"resolved_commit,omitempty"`
+	LogRef         string       `json:"log_ref,omitempty"`
+	LogSize        int64        `json:"log_size,omitempty"`
+	Tests          []TestResult `json:"tests,omitempty"`
+}
+
+type TestStatus string
+
+const (
+	TestStatusPass TestStatus = "pass"
+	TestStatusFail TestStatus = "fail"
+	TestStatusSkip TestStatus = "skip"
+)
+
+// TestResult is the outcome of one test, or of a whole package when Name is
+// empty
+type TestResult struct {
+	Package string     `json:"package"`
+	Name    string     `json:"name,omitempty"`
+	Status  TestStatus `json:"status"`
+	Elapsed float64    `json:"elapsed"` // seconds
+	Output  string     `json:"output,omitempty"`
+	// Flaky is set when the test has both passed and failed on the same
+	// commit and architecture
+	Flaky bool `json:"flaky,omitempty"`
+}
+
+// TestOutcome is one entry in the per-test history of a repository
+type TestOutcome struct {
+	Repo       string     `json:"repo"`
+	Package    string     `json:"package"`
+	Test       string     `json:"test"`
+	Arch       string     `json:"arch"`
+	Commit     string     `json:"commit"`
+	JobID      string     `json:"job_id"`
+	Attempt    int        `json:"attempt"`
+	Status     TestStatus `json:"status"`
+	RecordedAt time.Time  `json:"recorded_at"`
+}
+
+// TestKey identifies a test of a package
+type TestKey struct {
+	Package string
+	Test    string
+}
+
+// Clone returns a deep copy of the job, so that the copy can be changed
+// without affecting the original
+func (job *Job) Clone() *Job {
+	c := *job
+	c.Architectures = slices.Clone(job.Architectures)
+	c.StartedAt = cloneTime(job.StartedAt)
+	c.EndedAt = cloneTime(job.EndedAt)
+	c.Env = maps.Clone(job.Env)
+	c.SecretEnv = slices.Clone(job.SecretEnv)
+	if job.Retry != nil {
+		retry := *job.Retry
+		retry.RetryOn = slices.Clone(job.Retry.RetryOn)
+		c.Retry = &retry
+	}
+	c.Setup = slices.Clone(job.Setup)
+	if job.Targets != nil {
+		c.Targets = make([]*JobTarget, len(job.Targets))
+		for i, t := range job.Targets {
+			c.Targets[i] = t.clone()
+		}
+	}
+	return &c
+}
+
+func (t *JobTarget) clone() *JobTarget {
+	c := *t
+	c.StartedAt = cloneTime(t.StartedAt)
+	c.EndedAt = cloneTime(t.EndedAt)
+	c.Env = maps.Clone(t.Env)
+	c.Tests = slices.Clone(t.Tests)
+	c.LeaseExpiresAt = cloneTime(t.LeaseExpiresAt)
+	if t.Attempts != nil {
+		c.Attempts = make([]Attempt, len(t.Attempts))
+		for i, a := range t.Attempts {
+			a.StartedAt = cloneTime(a.StartedAt)
+			a.EndedAt = cloneTime(a.EndedAt)
+			a.Tests = slices.Clone(a.Tests)
+			c.Attempts[i] = a
+		}
+	}
+	return &c
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// ArchiveAttempt moves the outcome of the latest attempt into Attempts and
+// resets the target to pending so that it can run again
+func (t *JobTarget) ArchiveAttempt() {
+	t.Attempts = append(t.Attempts, Attempt{
+		Number:         t.Attempt,
+		Status:         t.Status,
+		Reason:         t.Reason,
+		ExitCode:       t.ExitCode,
+		StartedAt:      t.StartedAt,
+		EndedAt:        t.EndedAt,
+		ResolvedCommit: t.ResolvedCommit,
+		LogRef:         t.LogRef,
+		LogSize:        t.LogSize,
+		Tests:          t.Tests,
+	})
+	t.Status = TargetStatusPending
+	t.Reason = ""
+	t.ExitCode = 0
+	t.StartedAt = nil
+	t.EndedAt = nil
+	t.ResolvedCommit = ""
+	t.LogRef = ""
+	t.LogSize = 0
+	t.Tests = nil
+	t.Executor = ""
+	t.LeaseExpiresAt = nil
 }
 
 // RecalculateJobStatus recomputes the overall job.Status from the target statuses
@@ -63,6 +238,7 @@ func (job *Job) RecalculateJobStatus() {
 	allPassed := true
 	anyRunning := false
 	anyFailedOrError := false
+	anyCancelled := false
 
 	for _, t := range job.Targets {
 		switch t.Status {
@@ -72,6 +248,9 @@ func (job *Job) RecalculateJobStatus() {
 		case TargetStatusFailed, TargetStatusError:
 			anyFailedOrError = true
 			allPassed = false
+		case TargetStatusCancelled:
+			anyCancelled = true
+			allPassed = false
 		case TargetStatusPassed:
 			// do nothing
 		}
@@ -82,6 +261,8 @@ func (job *Job) RecalculateJobStatus() {
 		job.Status = JobStatusRunning
 	case anyFailedOrError:
 		job.Status = JobStatusFailed
+	case anyCancelled:
+		job.Status = JobStatusCancelled
 	case allPassed:
 		job.Status = JobStatusPassed
 	default:
@@ -102,6 +283,12 @@ func deriveJobTimes(job *Job) {
 				start = t.StartedAt
 			}
 		}
+		// a retried target started with its first attempt
+		for _, a := range t.Attempts {
+			if a.StartedAt != nil && (start == nil || a.StartedAt.Before(*start)) {
+				start = a.StartedAt
+			}
+		}
 
 		if t.EndedAt != nil {
 			if end == nil || t.EndedAt.After(*end) {
@@ -0,0 +1,122 @@
+// Package gotest turns `go test -json` output into structured test results.
+package gotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// maxOutput caps the output kept per test or package
+const maxOutput = 16 * 1024
+
+// Event is one line emitted by test2json
+type Event struct {
+	Time    time.Time `json:"Time"`
+	Action  string    `json:"Action"`
+	Package string    `json:"Package"`
+	Test    string    `json:"Test"`
+	Elapsed float64   `json:"Elapsed"`
+	Output  string    `json:"Output"`
+}
+
+var goTestCmd = regexp.MustCompile(`(^|[\s;&|(])go\s+test\b`)
+
+// IsGoTest reports whether a test command runs go test
+func IsGoTest(cmd string) bool {
+	return goTestCmd.MatchString(cmd)
+}
+
+type resultKey struct {
+	pkg  string
+	test string
+}
+
+// Parser consumes `go test -json` output as an io.Writer. Lines that are not
+// test2json events, such as build output, are ignored.
+type Parser struct {
+	partial []byte
+	results map[resultKey]*core.TestResult
+	order   []resultKey
+}
+
+func NewParser() *Parser {
+	return &Parser{results: make(map[resultKey]*core.TestResult)}
+}
+
+func (p *Parser) Write(b []byte) (int, error) {
+	p.partial = append(p.partial, b...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		p.parseLine(p.partial[:i])
+		p.partial = p.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *Parser) parseLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != '{' {
+		return
+	}
+	var ev Event
+	if err := json.Unmarshal(line, &ev); err != nil || ev.Action == "" || ev.Package == "" {
+		return
+	}
+	p.Handle(ev)
+}
+
+// Handle applies a single event
+func (p *Parser) Handle(ev Event) {
+	switch ev.Action {
+	case "run", "output", "pass", "fail", "skip":
+	default: // start, pause, cont, bench, build-output...
+		return
+	}
+
+	key := resultKey{ev.Package, ev.Test}
+	res, ok := p.results[key]
+	if !ok {
+		res = &core.TestResult{Package: ev.Package, Name: ev.Test}
+		p.results[key] = res
+		p.order = append(p.order, key)
+	}
+
+	switch ev.Action {
+	case "output":
+		if len(res.Output) < maxOutput {
+			res.Output += ev.Output
+			if len(res.Output) > maxOutput {
+				res.Output = res.Output[:maxOutput]
+			}
+		}
+	case "pass", "fail", "skip":
+		res.Status = core.TestStatus(ev.Action)
+		res.Elapsed = ev.Elapsed
+	}
+}
+
+// Results returns the results in the order tests were first seen. Tests that
+// started but never finished, e.g. because the binary panicked or timed out,
+// are reported as failed.
+func (p *Parser) Results() []core.TestResult {
+	if len(p.partial) > 0 {
+		p.parseLine(p.partial)
+		p.partial = nil
+	}
+	out := make([]core.TestResult, 0, len(p.order))
+	for _, key := range p.order {
+		res := *p.results[key]
+		if res.Status == "" {
+			res.Status = core.TestStatusFail
+		}
+		out = append(out, res)
+	}
+	return out
+}
@@ -0,0 +1,53 @@
+package gotest
+
+import (
+	"testing"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/stretchr/testify/assert"
+)
+
+const sampleOutput = `go: downloading example.com/dep v1.0.0
+{"Action":"start","Package":"example.com/app"}
+{"Action":"run","Package":"example.com/app","Test":"TestOK"}
+{"Action":"output","Package":"example.com/app","Test":"TestOK","Output":"=== RUN   TestOK\n"}
+{"Action":"pass","Package":"example.com/app","Test":"TestOK","Elapsed":0.01}
+{"Action":"run","Package":"example.com/app","Test":"TestBroken"}
+{"Action":"output","Package":"example.com/app","Test":"TestBroken","Output":"    app_test.go:12: unaligned access\n"}
+{"Action":"fail","Package":"example.com/app","Test":"TestBroken","Elapsed":1.5}
+{"Action":"run","Package":"example.com/app","Test":"TestHangs"}
+{"Action":"fail","Package":"example.com/app","Elapsed":2}
+{"Action":"skip","Package":"example.com/app/notests","Elapsed":0}
+`
+
+func TestParser(t *testing.T) {
+	p := NewParser()
+	// feed in odd-sized chunks to exercise line reassembly
+	data := []byte(sampleOutput)
+	for len(data) > 0 {
+		n := 7
+		if n > len(data) {
+			n = len(data)
+		}
+		p.Write(data[:n])
+		data = data[n:]
+	}
+
+	got := p.Results()
+	assert.Equal(t, []core.TestResult{
+		{Package: "example.com/app", Name: "TestOK", Status: core.TestStatusPass, Elapsed: 0.01, Output: "=== RUN   TestOK\n"},
+		{Package: "example.com/app", Name: "TestBroken", Status: core.TestStatusFail, Elapsed: 1.5, Output: "    app_test.go:12: unaligned access\n"},
+		{Package: "example.com/app", Name: "TestHangs", Status: core.TestStatusFail},
+		{Package: "example.com/app", Status: core.TestStatusFail, Elapsed: 2},
+		{Package: "example.com/app/notests", Status: core.TestStatusSkip},
+	}, got)
+}
+
+func TestIsGoTest(t *testing.T) {
+	assert.True(t, IsGoTest("go test ./..."))
+	assert.True(t, IsGoTest("make deps && go test -json ./..."))
+	assert.True(t, IsGoTest("(cd sub; go  test -json ./...)"))
+	assert.False(t, IsGoTest("cargo test"))
+	assert.False(t, IsGoTest("./run-tests.sh"))
+	assert.False(t, IsGoTest("mongo testdb"))
+}
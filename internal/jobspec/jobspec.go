@@ -0,0 +1,109 @@
+// Package jobspec reads the job definition a repository can keep next to
+// its code in a .mth.yaml file.
+package jobspec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// DefaultPath is where the spec file is looked for in the repository
+const DefaultPath = ".mth.yaml"
+
+// ErrNotFound is returned when the repository has no spec file at the
+// requested ref
+var ErrNotFound = errors.New("spec file not found")
+
+// Spec is the content of a spec file. Its fields mirror the job request;
+// fields the request sets take precedence.
+type Spec struct {
+	Architectures []string          `yaml:"architectures"`
+	TestCommand   string            `yaml:"test_command"`
+	Env           map[string]string `yaml:"env"`
+	Timeout       string            `yaml:"timeout"`
+	Image         string            `yaml:"image"`
+	// Setup are shell commands run in the checkout before the tests
+	Setup []string          `yaml:"setup"`
+	Retry *core.RetryPolicy `yaml:"retry"`
+}
+
+// Parse decodes a spec file, rejecting unknown keys so that typos do not go
+// unnoticed
+func Parse(data []byte) (*Spec, error) {
+	var spec Spec
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("parse spec file: %w", err)
+	}
+	return &spec, nil
+}
+
+// Fetcher retrieves a file of a repository at ref
+type Fetcher func(ctx context.Context, repo, ref, path string) ([]byte, error)
+
+// GitFetch is a Fetcher that fetches ref into an empty repository with git
+// and reads the file from the fetched commit, without a checkout. An empty
+// ref or HEAD means the default branch. Repositories come from API requests,
+// so only https repositories are fetched; local paths, file:// URLs and
+// helpers such as ext:: are refused.
+func GitFetch(ctx context.Context, repo, ref, path string) ([]byte, error) {
+	return gitFetch(ctx, "https", repo, ref, path)
+}
+
+// GitFetchWithSSH is GitFetch that also fetches ssh repositories, with the
+// ssh credentials of the user the server runs as
+func GitFetchWithSSH(ctx context.Context, repo, ref, path string) ([]byte, error) {
+	return gitFetch(ctx, "https:ssh", repo, ref, path)
+}
+
+// gitFetch fetches a file over the git transports listed in protocols
+func gitFetch(ctx context.Context, protocols, repo, ref, path string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "mth-spec-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, err := git(ctx, dir, protocols, "init", "--quiet"); err != nil {
+		return nil, err
+	}
+	if _, err := git(ctx, dir, protocols, "fetch", "--quiet", "--depth", "1", "--", repo, ref); err != nil {
+		return nil, err
+	}
+	out, err := git(ctx, dir, protocols, "show", "FETCH_HEAD:"+path)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "exists on disk, but not in") {
+			return nil, fmt.Errorf("%w: %s at %s", ErrNotFound, path, ref)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// git runs a git command in dir without prompting for credentials, over the
+// transports listed in protocols only
+func git(ctx context.Context, dir, protocols string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+protocols)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package jobspec
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	spec, err := Parse([]byte(`
+architectures: [amd64, aarch64]
+test_command: go test -json ./...
+env:
+  CGO_ENABLED: "0"
+timeout: 10m
+image: golang:1.22
+setup:
+  - go mod download
+retry:
+  max_attempts: 2
+  retry_on: [docker_error]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amd64", "aarch64"}, spec.Architectures)
+	assert.Equal(t, "go test -json ./...", spec.TestCommand)
+	assert.Equal(t, map[string]string{"CGO_ENABLED": "0"}, spec.Env)
+	assert.Equal(t, "10m", spec.Timeout)
+	assert.Equal(t, "golang:1.22", spec.Image)
+	assert.Equal(t, []string{"go mod download"}, spec.Setup)
+	assert.Equal(t, 2, spec.Retry.MaxAttempts)
+	assert.Equal(t, []string{"docker_error"}, spec.Retry.RetryOn)
+}
+
+func TestParseRejectsUnknownKeys(t *testing.T) {
+	_, err := Parse([]byte("architecture: [amd64]\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "field architecture not found")
+}
+
+func TestGitFetch(t *testing.T) {
+	repo := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@example.com",
+			"GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@example.com")
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	run("init", "--quiet", "-b", "main")
+	assert.NoError(t, os.WriteFile(filepath.Join(repo, DefaultPath), []byte("test_command: make test\n"), 0o644))
+	run("add", DefaultPath)
+	run("commit", "--quiet", "-m", "spec")
+
+	data, err := gitFetch(context.Background(), "file", repo, "main", DefaultPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_command: make test\n", string(data))
+
+	_, err = gitFetch(context.Background(), "file", repo, "", "ci/other.yaml")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestGitFetchRefusesLocalRepositories(t *testing.T) {
+	repo := t.TempDir()
+	cmd := exec.Command("git", "init", "--quiet", repo)
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	for _, r := range []string{repo, "file://" + repo, "ext::sh -c true", "ssh://git@example.invalid/repo.git"} {
+		_, err := GitFetch(context.Background(), r, "", DefaultPath)
+		if assert.Error(t, err, r) {
+			assert.Contains(t, err.Error(), "not allowed", r)
+		}
+	}
+}
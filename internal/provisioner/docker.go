@@ -0,0 +1,206 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// interface conformance
+var _ Provisioner = (*Docker)(nil)
+
+// Docker provisions targets as containers through the local docker CLI.
+type Docker struct {
+	Binary string
+	// Workdir and User set where and as whom commands run in every
+	// container
+	Workdir string
+	User    string
+	// Mounts are bind-mounted into every container, e.g. a module cache
+	Mounts []Mount
+	// Resources limit every container
+	Resources
+}
+
+func NewDocker() *Docker {
+	return &Docker{Binary: "docker"}
+}
+
+// Provision starts a detached container that idles until Teardown, so that
+// several commands can be executed in the same environment.
+func (d *Docker) Provision(ctx context.Context, spec Spec) (*Environment, error) {
+	opts := d.runOptions(spec)
+	args := opts.Args()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.Binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, classifyDockerError(err, stderr.String())
+	}
+
+	id := strings.TrimSpace(stdout.String())
+	if id == "" {
+		return nil, fmt.Errorf("docker run returned no container id")
+	}
+	return &Environment{ID: id, Spec: spec, Name: opts.Name}, nil
+}
+
+// runOptions describes the idle container Provision starts for spec
+func (d *Docker) runOptions(spec Spec) RunOptions {
+	return RunOptions{
+		Name:     Name(spec.JobID, spec.Arch, spec.Attempt),
+		Detach:   true,
+		Platform: spec.Platform,
+		Labels: map[string]string{
+			LabelJobID:    spec.JobID,
+			LabelArch:     spec.Arch,
+			LabelAttempt:  strconv.Itoa(spec.Attempt),
+			LabelExecutor: spec.Executor,
+			LabelRepo:     spec.Repo,
+			LabelCommit:   spec.Commit,
+		},
+		Env:       spec.Env,
+		Workdir:   d.Workdir,
+		User:      d.User,
+		Mounts:    d.Mounts,
+		Resources: d.Resources,
+		Image:     spec.Image,
+		Command:   []string{"tail", "-f", "/dev/null"},
+	}
+}
+
+func (d *Docker) Exec(ctx context.Context, env *Environment, cmdStr string, stdout, stderr io.Writer) (int, error) {
+	// keep the tail of stderr around to tell daemon failures from test failures
+	errTail := &tailBuffer{max: 4096}
+	cmd := exec.CommandContext(ctx, d.Binary, "exec", env.ID, "sh", "-c", cmdStr)
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, errTail)
+
+	err := cmd.Run()
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1, fmt.Errorf("docker exec: %w", err)
+	}
+	if isDaemonError(errTail.String()) {
+		return exitErr.ExitCode(), fmt.Errorf("docker exec: %w", ErrDaemonUnavailable)
+	}
+	return exitErr.ExitCode(), nil
+}
+
+func (d *Docker) Logs(ctx context.Context, env *Environment, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, d.Binary, "logs", env.ID)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker logs: %w", err)
+	}
+	return nil
+}
+
+func (d *Docker) Teardown(ctx context.Context, env *Environment) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.Binary, "rm", "-f", env.ID)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "No such container") {
+			return nil
+		}
+		return classifyDockerError(err, stderr.String())
+	}
+	return nil
+}
+
+// List finds the harness containers by their labels, running or not
+func (d *Docker) List(ctx context.Context) ([]*Environment, error) {
+	format := fmt.Sprintf(`{{.ID}}\t{{.Names}}\t{{.State}}\t{{.Label %q}}\t{{.Label %q}}\t{{.Label %q}}\t{{.Label %q}}`,
+		LabelJobID, LabelArch, LabelAttempt, LabelExecutor)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.Binary, "ps", "-a", "--no-trunc",
+		"--filter", "label="+LabelJobID, "--format", format)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, classifyDockerError(err, stderr.String())
+	}
+	return parseContainerList(stdout.String()), nil
+}
+
+// Architecture returns the architecture the docker daemon runs natively
+func (d *Docker) Architecture(ctx context.Context) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.Binary, "version", "--format", "{{.Server.Arch}}")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", classifyDockerError(err, stderr.String())
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// parseContainerList parses the tab-separated output of List's docker ps
+func parseContainerList(out string) []*Environment {
+	var envs []*Environment
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) != 7 || fields[0] == "" {
+			continue
+		}
+		attempt, _ := strconv.Atoi(fields[5])
+		envs = append(envs, &Environment{
+			ID:    fields[0],
+			Name:  fields[1],
+			State: fields[2],
+			Spec:  Spec{JobID: fields[3], Arch: fields[4], Attempt: attempt, Executor: fields[6]},
+		})
+	}
+	return envs
+}
+
+// classifyDockerError maps docker CLI failures onto the provisioner errors
+func classifyDockerError(err error, stderr string) error {
+	msg := strings.ToLower(stderr)
+	switch {
+	case isDaemonError(stderr):
+		return fmt.Errorf("docker: %w: %s", ErrDaemonUnavailable, strings.TrimSpace(stderr))
+	case strings.Contains(msg, "unable to find image") ||
+		strings.Contains(msg, "pull access denied") ||
+		strings.Contains(msg, "manifest unknown"):
+		return fmt.Errorf("docker: %w: %s", ErrImageMissing, strings.TrimSpace(stderr))
+	default:
+		return fmt.Errorf("docker: %w: %s", err, strings.TrimSpace(stderr))
+	}
+}
+
+func isDaemonError(stderr string) bool {
+	msg := strings.ToLower(stderr)
+	return strings.Contains(msg, "cannot connect to the docker daemon") ||
+		strings.Contains(msg, "error during connect")
+}
+
+// tailBuffer keeps only the last max bytes written to it
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
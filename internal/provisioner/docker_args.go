@@ -0,0 +1,107 @@
+package provisioner
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Mount bind-mounts a host path into the environment
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// ParseMount parses a mount in docker's "source:target[:ro]" form
+func ParseMount(s string) (Mount, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Mount{}, fmt.Errorf("invalid mount %q, want source:target[:ro]", s)
+	}
+	m := Mount{Source: parts[0], Target: parts[1]}
+	if len(parts) == 3 {
+		if parts[2] != "ro" {
+			return Mount{}, fmt.Errorf("invalid mount %q, want source:target[:ro]", s)
+		}
+		m.ReadOnly = true
+	}
+	return m, nil
+}
+
+// Resources limits what an environment may use; zero values mean no limit
+type Resources struct {
+	// CPUs is a fractional number of CPUs, e.g. "1.5"
+	CPUs string
+	// Memory is a docker memory size, e.g. "512m"
+	Memory    string
+	PidsLimit int
+}
+
+// RunOptions is a typed docker run invocation. Args renders it with every
+// flag in front of the image, so that nothing meant for docker ends up as an
+// argument of the container's command.
+type RunOptions struct {
+	Name     string
+	Detach   bool
+	Remove   bool
+	Platform string
+	Labels   map[string]string
+	Env      map[string]string
+	Workdir  string
+	User     string
+	Mounts   []Mount
+	Resources
+	Image   string
+	Command []string
+}
+
+// Args returns the docker CLI arguments, starting with "run". Labels and
+// env are sorted by key so the argv is deterministic.
+func (o RunOptions) Args() []string {
+	args := []string{"run"}
+	if o.Detach {
+		args = append(args, "-d")
+	}
+	if o.Remove {
+		args = append(args, "--rm")
+	}
+	if o.Name != "" {
+		args = append(args, "--name", o.Name)
+	}
+	if o.Platform != "" {
+		args = append(args, "--platform", o.Platform)
+	}
+	for _, k := range slices.Sorted(maps.Keys(o.Labels)) {
+		args = append(args, "--label", k+"="+o.Labels[k])
+	}
+	for _, k := range slices.Sorted(maps.Keys(o.Env)) {
+		args = append(args, "-e", k+"="+o.Env[k])
+	}
+	if o.Workdir != "" {
+		args = append(args, "-w", o.Workdir)
+	}
+	if o.User != "" {
+		args = append(args, "-u", o.User)
+	}
+	for _, m := range o.Mounts {
+		v := m.Source + ":" + m.Target
+		if m.ReadOnly {
+			v += ":ro"
+		}
+		args = append(args, "-v", v)
+	}
+	if o.CPUs != "" {
+		args = append(args, "--cpus", o.CPUs)
+	}
+	if o.Memory != "" {
+		args = append(args, "--memory", o.Memory)
+	}
+	if o.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(o.PidsLimit))
+	}
+	args = append(args, o.Image)
+	return append(args, o.Command...)
+}
@@ -0,0 +1,112 @@
+package provisioner
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunOptionsArgs(t *testing.T) {
+	opts := RunOptions{
+		Name:     "mth-job-1-arm64-1",
+		Detach:   true,
+		Platform: "linux/arm64",
+		Labels:   map[string]string{"b": "2", "a": "1"},
+		Env:      map[string]string{"Z": "last", "A": "x=y"},
+		Workdir:  "/src",
+		User:     "1000:1000",
+		Mounts: []Mount{
+			{Source: "/cache", Target: "/root/.cache"},
+			{Source: "/data", Target: "/data", ReadOnly: true},
+		},
+		Resources: Resources{CPUs: "1.5", Memory: "512m", PidsLimit: 256},
+		Image:     "img:arm64",
+		Command:   []string{"sh", "-c", "go test ./..."},
+	}
+	assert.Equal(t, []string{
+		"run", "-d",
+		"--name", "mth-job-1-arm64-1",
+		"--platform", "linux/arm64",
+		"--label", "a=1", "--label", "b=2",
+		"-e", "A=x=y", "-e", "Z=last",
+		"-w", "/src",
+		"-u", "1000:1000",
+		"-v", "/cache:/root/.cache", "-v", "/data:/data:ro",
+		"--cpus", "1.5", "--memory", "512m", "--pids-limit", "256",
+		"img:arm64", "sh", "-c", "go test ./...",
+	}, opts.Args())
+}
+
+func TestRunOptionsArgsMinimal(t *testing.T) {
+	opts := RunOptions{Remove: true, Image: "alpine"}
+	assert.Equal(t, []string{"run", "--rm", "alpine"}, opts.Args())
+}
+
+func TestRunOptionsEnvBeforeImage(t *testing.T) {
+	args := NewDocker().runOptions(Spec{
+		JobID:   "job-1",
+		Arch:    "arm/v7",
+		Attempt: 2,
+		Image:   "img",
+		Env:     map[string]string{"GOFLAGS": "-count=1"},
+	}).Args()
+
+	image := slices.Index(args, "img")
+	assert.Greater(t, image, slices.Index(args, "GOFLAGS=-count=1"), "env must be set on the container, not passed to its command")
+	assert.Equal(t, []string{"tail", "-f", "/dev/null"}, args[image+1:])
+	assert.Contains(t, args, "mth-job-1-arm-v7-2")
+	assert.Contains(t, args, LabelAttempt+"=2")
+}
+
+func TestNewAppliesContainerConfig(t *testing.T) {
+	prov, err := New("docker", config.ContainerConfig{
+		Workdir:   "/src",
+		User:      "1000",
+		Mounts:    []string{"/cache:/root/.cache", "/data:/data:ro"},
+		Memory:    "512m",
+		PidsLimit: 256,
+	})
+	assert.NoError(t, err)
+	args := prov.(*Docker).runOptions(Spec{JobID: "job-1", Arch: "amd64", Attempt: 1, Image: "img"}).Args()
+
+	image := slices.Index(args, "img")
+	assert.Equal(t, []string{
+		"-w", "/src", "-u", "1000",
+		"-v", "/cache:/root/.cache", "-v", "/data:/data:ro",
+		"--memory", "512m", "--pids-limit", "256",
+	}, args[image-12:image])
+
+	_, err = New("docker", config.ContainerConfig{Mounts: []string{"/cache"}})
+	assert.Error(t, err)
+}
+
+func TestParseMount(t *testing.T) {
+	m, err := ParseMount("/cache:/root/.cache")
+	assert.NoError(t, err)
+	assert.Equal(t, Mount{Source: "/cache", Target: "/root/.cache"}, m)
+
+	m, err = ParseMount("/data:/data:ro")
+	assert.NoError(t, err)
+	assert.Equal(t, Mount{Source: "/data", Target: "/data", ReadOnly: true}, m)
+
+	for _, s := range []string{"", "/cache", ":/cache", "/cache:", "/a:/b:rw", "/a:/b:ro:x"} {
+		_, err := ParseMount(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseContainerList(t *testing.T) {
+	out := "abc\tmth-j-amd64-1\trunning\tj\tamd64\t1\tlocal\n" +
+		"malformed line\n" +
+		"def\tmth-j-arm64-3\texited\tj\tarm64\t3\tagent-1\n"
+	envs := parseContainerList(out)
+	assert.Len(t, envs, 2)
+	assert.Equal(t, &Environment{
+		ID:    "def",
+		Name:  "mth-j-arm64-3",
+		State: "exited",
+		Spec:  Spec{JobID: "j", Arch: "arm64", Attempt: 3, Executor: "agent-1"},
+	}, envs[1])
+}
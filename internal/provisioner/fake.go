@@ -0,0 +1,103 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// interface conformance
+var _ Provisioner = (*Fake)(nil)
+
+// Fake is an in-memory provisioner for tests. It records every call and lets
+// the test script the outcome of each command.
+type Fake struct {
+	mu sync.Mutex
+
+	// ProvisionErr is returned by every Provision call when set.
+	ProvisionErr error
+	// ExecFunc decides the outcome of each Exec call. When nil every
+	// command succeeds without output.
+	ExecFunc func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error)
+	// EnvLogs is what Logs writes for every environment.
+	EnvLogs string
+
+	Provisioned []Spec
+	Commands    []string
+	TornDown    []string
+
+	next int
+	live []*Environment
+}
+
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+func (f *Fake) Provision(ctx context.Context, spec Spec) (*Environment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ProvisionErr != nil {
+		return nil, f.ProvisionErr
+	}
+	f.next++
+	f.Provisioned = append(f.Provisioned, spec)
+	env := &Environment{
+		ID:   fmt.Sprintf("fake-%d", f.next),
+		Spec: spec,
+		Name: Name(spec.JobID, spec.Arch, spec.Attempt),
+	}
+	f.live = append(f.live, env)
+	return env, nil
+}
+
+// Adopt registers an environment as if a previous run had provisioned it
+func (f *Fake) Adopt(env *Environment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.live = append(f.live, env)
+}
+
+func (f *Fake) Exec(ctx context.Context, env *Environment, cmd string, stdout, stderr io.Writer) (int, error) {
+	f.mu.Lock()
+	f.Commands = append(f.Commands, cmd)
+	fn := f.ExecFunc
+	f.mu.Unlock()
+
+	if fn == nil {
+		return 0, nil
+	}
+	return fn(ctx, cmd, stdout, stderr)
+}
+
+func (f *Fake) Logs(ctx context.Context, env *Environment, w io.Writer) error {
+	_, err := io.WriteString(w, f.EnvLogs)
+	return err
+}
+
+func (f *Fake) Teardown(ctx context.Context, env *Environment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.TornDown = append(f.TornDown, env.ID)
+	for i, e := range f.live {
+		if e.ID == env.ID {
+			f.live = append(f.live[:i], f.live[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// List returns the environments that were not torn down yet, all running
+func (f *Fake) List(ctx context.Context) ([]*Environment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	envs := make([]*Environment, 0, len(f.live))
+	for _, env := range f.live {
+		e := *env
+		e.State = "running"
+		envs = append(envs, &e)
+	}
+	return envs, nil
+}
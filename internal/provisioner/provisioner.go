@@ -0,0 +1,108 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+)
+
+// Errors returned by provisioners so the runner can classify failures
+// without knowing which backend produced them.
+var (
+	ErrImageMissing      = errors.New("image missing")
+	ErrDaemonUnavailable = errors.New("daemon unavailable")
+)
+
+// Labels identifying the environments the harness created
+const (
+	LabelJobID    = "mth.job_id"
+	LabelArch     = "mth.arch"
+	LabelAttempt  = "mth.attempt"
+	LabelExecutor = "mth.executor"
+	LabelRepo     = "mth.repo"
+	LabelCommit   = "mth.commit"
+)
+
+// Spec describes the environment a single job target needs.
+type Spec struct {
+	JobID string
+	Arch  string
+	Image string
+	Env   map[string]string
+	// Executor is the ID of the server workers or the agent running the
+	// target
+	Executor string
+	// Attempt, Repo and Commit label the environment for traceability
+	Attempt int
+	Repo    string
+	Commit  string
+	// Platform is the OS/arch the image runs as, e.g. linux/arm64; empty
+	// leaves the choice to the backend
+	Platform string
+}
+
+// Environment is a provisioned, running environment for one target.
+type Environment struct {
+	ID   string
+	Spec Spec
+	// Name is the deterministic name given by Name
+	Name string
+	// State is the backend's view of the environment, e.g. running or
+	// exited; it is only set by List
+	State string
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Name returns the environment name of a target's attempt, e.g.
+// mth-<job>-arm-v7-2. It is deterministic so that an environment can be
+// found by hand from the job alone.
+func Name(jobID, arch string, attempt int) string {
+	return unsafeNameChars.ReplaceAllString(fmt.Sprintf("mth-%s-%s-%d", jobID, arch, attempt), "-")
+}
+
+// Provisioner creates ephemeral environments, runs commands inside them and
+// tears them down again.
+type Provisioner interface {
+	// Provision creates and starts an environment for spec.
+	Provision(ctx context.Context, spec Spec) (*Environment, error)
+	// Exec runs cmd with sh -c inside env and streams its output. A non-zero
+	// exit code is not an error; err is only set when the command could not
+	// be run at all.
+	Exec(ctx context.Context, env *Environment, cmd string, stdout, stderr io.Writer) (exitCode int, err error)
+	// Logs writes the output the environment produced outside of Exec.
+	Logs(ctx context.Context, env *Environment, w io.Writer) error
+	// Teardown destroys env. It is safe to call on an environment that is
+	// already gone.
+	Teardown(ctx context.Context, env *Environment) error
+	// List returns the environments the harness created that still exist,
+	// with JobID, Arch and Executor of their Spec restored. It lets a
+	// restarted server find environments left behind by the previous run.
+	List(ctx context.Context) ([]*Environment, error)
+}
+
+// New returns the provisioner registered under name, creating environments
+// as container describes.
+func New(name string, container config.ContainerConfig) (Provisioner, error) {
+	switch name {
+	case "", "docker":
+		d := NewDocker()
+		d.Workdir = container.Workdir
+		d.User = container.User
+		for _, m := range container.Mounts {
+			mount, err := ParseMount(m)
+			if err != nil {
+				return nil, err
+			}
+			d.Mounts = append(d.Mounts, mount)
+		}
+		d.Resources = Resources{CPUs: container.CPUs, Memory: container.Memory, PidsLimit: container.PidsLimit}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unknown provisioner: %s", name)
+	}
+}
@@ -0,0 +1,177 @@
+// Package report derives reports from the results stored for a job.
+package report
+
+import (
+	"sort"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// DiffOptions tunes duration outlier detection
+type DiffOptions struct {
+	// OutlierFactor flags an arch whose elapsed time is at least this many
+	// times the median of the other architectures
+	OutlierFactor float64
+	// MinOutlierDelta ignores outliers less than this many seconds slower,
+	// so that fast tests don't trip the factor
+	MinOutlierDelta float64
+}
+
+func DefaultDiffOptions() DiffOptions {
+	return DiffOptions{OutlierFactor: 3, MinOutlierDelta: 1}
+}
+
+// Diff lines up the test results of every target of a job
+type Diff struct {
+	JobID         string   `json:"job_id"`
+	Architectures []string `json:"architectures"`
+	// NoResults lists architectures without structured test results, which
+	// are left out of the comparison
+	NoResults        []string          `json:"no_results,omitempty"`
+	Divergent        []DivergentTest   `json:"divergent"`
+	Missing          []MissingTest     `json:"missing"`
+	DurationOutliers []DurationOutlier `json:"duration_outliers"`
+}
+
+// DivergentTest passes on some architectures and fails on others
+type DivergentTest struct {
+	Package string   `json:"package"`
+	Name    string   `json:"name,omitempty"`
+	Passed  []string `json:"passed"`
+	Failed  []string `json:"failed"`
+}
+
+// MissingTest did not run on every architecture, e.g. because of build tags
+type MissingTest struct {
+	Package   string   `json:"package"`
+	Name      string   `json:"name,omitempty"`
+	RanOn     []string `json:"ran_on"`
+	SkippedOn []string `json:"skipped_on,omitempty"`
+	MissingOn []string `json:"missing_on,omitempty"`
+}
+
+// DurationOutlier is a test that ran much slower on one architecture
+type DurationOutlier struct {
+	Package  string  `json:"package"`
+	Name     string  `json:"name,omitempty"`
+	Arch     string  `json:"arch"`
+	Elapsed  float64 `json:"elapsed"`
+	Baseline float64 `json:"baseline"` // median elapsed of the other architectures
+	Factor   float64 `json:"factor"`
+}
+
+type testKey struct {
+	pkg  string
+	name string
+}
+
+// DiffJob compares the per-test results of all targets of job
+func DiffJob(job *core.Job, opts DiffOptions) *Diff {
+	d := &Diff{
+		JobID:            job.ID,
+		Divergent:        []DivergentTest{},
+		Missing:          []MissingTest{},
+		DurationOutliers: []DurationOutlier{},
+	}
+
+	byArch := make(map[string]map[testKey]core.TestResult)
+	keys := make(map[testKey]struct{})
+	for _, t := range job.Targets {
+		if len(t.Tests) == 0 {
+			d.NoResults = append(d.NoResults, t.Arch)
+			continue
+		}
+		d.Architectures = append(d.Architectures, t.Arch)
+		results := make(map[testKey]core.TestResult, len(t.Tests))
+		for _, res := range t.Tests {
+			k := testKey{res.Package, res.Name}
+			results[k] = res
+			keys[k] = struct{}{}
+		}
+		byArch[t.Arch] = results
+	}
+
+	sorted := make([]testKey, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].pkg != sorted[j].pkg {
+			return sorted[i].pkg < sorted[j].pkg
+		}
+		return sorted[i].name < sorted[j].name
+	})
+
+	for _, k := range sorted {
+		var passed, failed, skipped, missing, ran []string
+		for _, arch := range d.Architectures {
+			res, ok := byArch[arch][k]
+			switch {
+			case !ok:
+				missing = append(missing, arch)
+			case res.Status == core.TestStatusSkip:
+				skipped = append(skipped, arch)
+			case res.Status == core.TestStatusPass:
+				passed = append(passed, arch)
+				ran = append(ran, arch)
+			default:
+				failed = append(failed, arch)
+				ran = append(ran, arch)
+			}
+		}
+
+		if len(passed) > 0 && len(failed) > 0 {
+			d.Divergent = append(d.Divergent, DivergentTest{
+				Package: k.pkg, Name: k.name, Passed: passed, Failed: failed,
+			})
+		}
+		if len(ran) > 0 && (len(skipped) > 0 || len(missing) > 0) {
+			d.Missing = append(d.Missing, MissingTest{
+				Package: k.pkg, Name: k.name, RanOn: ran, SkippedOn: skipped, MissingOn: missing,
+			})
+		}
+		d.DurationOutliers = append(d.DurationOutliers, outliers(k, ran, byArch, opts)...)
+	}
+
+	return d
+}
+
+// outliers compares each architecture's elapsed time against the median of
+// the other architectures that ran the test
+func outliers(k testKey, ran []string, byArch map[string]map[testKey]core.TestResult, opts DiffOptions) []DurationOutlier {
+	if len(ran) < 2 {
+		return nil
+	}
+	var out []DurationOutlier
+	for _, arch := range ran {
+		elapsed := byArch[arch][k].Elapsed
+		others := make([]float64, 0, len(ran)-1)
+		for _, other := range ran {
+			if other != arch {
+				others = append(others, byArch[other][k].Elapsed)
+			}
+		}
+		baseline := median(others)
+		if elapsed-baseline < opts.MinOutlierDelta || elapsed < baseline*opts.OutlierFactor {
+			continue
+		}
+		factor := 0.0
+		if baseline > 0 {
+			factor = elapsed / baseline
+		}
+		out = append(out, DurationOutlier{
+			Package: k.pkg, Name: k.name, Arch: arch,
+			Elapsed: elapsed, Baseline: baseline, Factor: factor,
+		})
+	}
+	return out
+}
+
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
@@ -0,0 +1,56 @@
+package report
+
+import (
+	"testing"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func result(name string, status core.TestStatus, elapsed float64) core.TestResult {
+	return core.TestResult{Package: "example.com/app", Name: name, Status: status, Elapsed: elapsed}
+}
+
+func TestDiffJob(t *testing.T) {
+	job := &core.Job{
+		ID: "job1",
+		Targets: []*core.JobTarget{
+			{Arch: "amd64", Tests: []core.TestResult{
+				result("TestAtomic", core.TestStatusPass, 0.1),
+				result("TestSIMD", core.TestStatusPass, 0.2),
+				result("TestSlow", core.TestStatusPass, 2),
+				result("TestStable", core.TestStatusPass, 0.1),
+			}},
+			{Arch: "arm64", Tests: []core.TestResult{
+				result("TestAtomic", core.TestStatusFail, 0.1),
+				result("TestSIMD", core.TestStatusSkip, 0),
+				result("TestSlow", core.TestStatusPass, 30),
+				result("TestStable", core.TestStatusPass, 0.5),
+			}},
+			{Arch: "riscv64", Tests: []core.TestResult{
+				result("TestAtomic", core.TestStatusFail, 0.1),
+				result("TestSlow", core.TestStatusPass, 2.5),
+				result("TestStable", core.TestStatusPass, 0.1),
+			}},
+			{Arch: "s390x"},
+		},
+	}
+
+	d := DiffJob(job, DefaultDiffOptions())
+
+	assert.Equal(t, []string{"amd64", "arm64", "riscv64"}, d.Architectures)
+	assert.Equal(t, []string{"s390x"}, d.NoResults)
+	assert.Equal(t, []DivergentTest{{
+		Package: "example.com/app", Name: "TestAtomic",
+		Passed: []string{"amd64"}, Failed: []string{"arm64", "riscv64"},
+	}}, d.Divergent)
+	assert.Equal(t, []MissingTest{{
+		Package: "example.com/app", Name: "TestSIMD",
+		RanOn: []string{"amd64"}, SkippedOn: []string{"arm64"}, MissingOn: []string{"riscv64"},
+	}}, d.Missing)
+	// TestStable is 5x slower on arm64 but below the absolute threshold
+	assert.Equal(t, []DurationOutlier{{
+		Package: "example.com/app", Name: "TestSlow", Arch: "arm64",
+		Elapsed: 30, Baseline: 2.25, Factor: 30 / 2.25,
+	}}, d.DurationOutliers)
+}
@@ -0,0 +1,117 @@
+package report
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// FlakyTest is a test that both passed and failed on the same commit and
+// architecture, across reruns or retry attempts
+type FlakyTest struct {
+	Repo     string `json:"repo"`
+	Package  string `json:"package"`
+	Name     string `json:"name"`
+	Arch     string `json:"arch"`
+	Passes   int    `json:"passes"`
+	Failures int    `json:"failures"`
+	// Commits are the commits the test flipped on
+	Commits  []string  `json:"commits"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// FlakyKey identifies a test on one architecture
+type FlakyKey struct {
+	Package string
+	Name    string
+	Arch    string
+}
+
+type flakyCounts struct {
+	passes, failures int
+	commits          map[string]*[2]int // pass and fail counts per commit
+	commitOrder      []string
+	lastSeen         time.Time
+}
+
+// FindFlaky scans a repository's test history for tests that flip between
+// pass and fail on the same commit and architecture. Results are ordered by
+// most recently seen.
+func FindFlaky(outcomes []core.TestOutcome) []FlakyTest {
+	counts := make(map[FlakyKey]*flakyCounts)
+	repo := ""
+	for _, o := range outcomes {
+		if o.Status != core.TestStatusPass && o.Status != core.TestStatusFail {
+			continue
+		}
+		repo = o.Repo
+		k := FlakyKey{o.Package, o.Test, o.Arch}
+		c := counts[k]
+		if c == nil {
+			c = &flakyCounts{commits: make(map[string]*[2]int)}
+			counts[k] = c
+		}
+		perCommit := c.commits[o.Commit]
+		if perCommit == nil {
+			perCommit = &[2]int{}
+			c.commits[o.Commit] = perCommit
+			c.commitOrder = append(c.commitOrder, o.Commit)
+		}
+		if o.Status == core.TestStatusPass {
+			c.passes++
+			perCommit[0]++
+		} else {
+			c.failures++
+			perCommit[1]++
+		}
+		if o.RecordedAt.After(c.lastSeen) {
+			c.lastSeen = o.RecordedAt
+		}
+	}
+
+	flaky := make([]FlakyTest, 0)
+	for k, c := range counts {
+		var commits []string
+		for _, commit := range c.commitOrder {
+			if pf := c.commits[commit]; pf[0] > 0 && pf[1] > 0 {
+				commits = append(commits, commit)
+			}
+		}
+		if len(commits) == 0 {
+			continue
+		}
+		flaky = append(flaky, FlakyTest{
+			Repo:     repo,
+			Package:  k.Package,
+			Name:     k.Name,
+			Arch:     k.Arch,
+			Passes:   c.passes,
+			Failures: c.failures,
+			Commits:  commits,
+			LastSeen: c.lastSeen,
+		})
+	}
+	sort.Slice(flaky, func(i, j int) bool {
+		if !flaky[i].LastSeen.Equal(flaky[j].LastSeen) {
+			return flaky[i].LastSeen.After(flaky[j].LastSeen)
+		}
+		if flaky[i].Package != flaky[j].Package {
+			return flaky[i].Package < flaky[j].Package
+		}
+		if flaky[i].Name != flaky[j].Name {
+			return flaky[i].Name < flaky[j].Name
+		}
+		return flaky[i].Arch < flaky[j].Arch
+	})
+	return flaky
+}
+
+// FlakySet indexes the result of FindFlaky for lookups
+func FlakySet(flaky []FlakyTest) map[FlakyKey]bool {
+	set := make(map[FlakyKey]bool, len(flaky))
+	for _, f := range flaky {
+		set[FlakyKey{f.Package, f.Name, f.Arch}] = true
+	}
+	return set
+}
@@ -0,0 +1,50 @@
+package report
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindFlaky(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	outcome := func(test, arch, commit string, status core.TestStatus, minute int) core.TestOutcome {
+		return core.TestOutcome{
+			Repo: "repo", Package: "example.com/app", Test: test, Arch: arch,
+			Commit: commit, Status: status, RecordedAt: base.Add(time.Duration(minute) * time.Minute),
+		}
+	}
+	history := []core.TestOutcome{
+		// flips on the same commit: flaky
+		outcome("TestRace", "arm64", "c1", core.TestStatusFail, 1),
+		outcome("TestRace", "arm64", "c1", core.TestStatusPass, 2),
+		// fails consistently on arm64 only: architecture-broken, not flaky
+		outcome("TestAlign", "arm64", "c1", core.TestStatusFail, 1),
+		outcome("TestAlign", "arm64", "c1", core.TestStatusFail, 2),
+		outcome("TestAlign", "amd64", "c1", core.TestStatusPass, 1),
+		// fixed by a later commit: not flaky
+		outcome("TestFixed", "amd64", "c1", core.TestStatusFail, 1),
+		outcome("TestFixed", "amd64", "c2", core.TestStatusPass, 3),
+		// skips don't count
+		outcome("TestSkip", "amd64", "c1", core.TestStatusSkip, 1),
+		outcome("TestSkip", "amd64", "c1", core.TestStatusPass, 2),
+		// flaky on a later commit too, seen most recently
+		outcome("TestTimer", "amd64", "c2", core.TestStatusPass, 4),
+		outcome("TestTimer", "amd64", "c2", core.TestStatusFail, 5),
+	}
+
+	got := FindFlaky(history)
+	assert.Len(t, got, 2)
+	assert.Equal(t, FlakyTest{
+		Repo: "repo", Package: "example.com/app", Name: "TestTimer", Arch: "amd64",
+		Passes: 1, Failures: 1, Commits: []string{"c2"}, LastSeen: base.Add(5 * time.Minute),
+	}, got[0])
+	assert.Equal(t, "TestRace", got[1].Name)
+	assert.Equal(t, "arm64", got[1].Arch)
+
+	set := FlakySet(got)
+	assert.True(t, set[FlakyKey{"example.com/app", "TestRace", "arm64"}])
+	assert.False(t, set[FlakyKey{"example.com/app", "TestRace", "amd64"}])
+}
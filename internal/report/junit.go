@@ -0,0 +1,221 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// maxJUnitLog caps the log text embedded into synthetic failures, keeping
+// the end of the log where the failure usually is
+const maxJUnitLog = 64 * 1024
+
+// LogTail returns up to the last n bytes of the log of a target's latest
+// attempt
+type LogTail func(t *core.JobTarget, n int64) string
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr,omitempty"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit writes job as JUnit XML with one test suite per target. Targets
+// with structured results get one test case per test; others get a single
+// synthetic case derived from the exit code, reason and the end of the log,
+// which tail reads.
+func WriteJUnit(w io.Writer, job *core.Job, tail LogTail) error {
+	doc := junitTestSuites{Name: job.ID}
+	var total float64
+	for _, t := range job.Targets {
+		suite, elapsed := junitSuite(job, t, tail)
+		doc.Tests += suite.Tests
+		doc.Failures += suite.Failures
+		doc.Errors += suite.Errors
+		doc.Skipped += suite.Skipped
+		total += elapsed
+		doc.Suites = append(doc.Suites, suite)
+	}
+	doc.Time = formatSeconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("encode junit: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func junitSuite(job *core.Job, t *core.JobTarget, tail LogTail) (junitTestSuite, float64) {
+	var elapsed float64
+	suite := junitTestSuite{
+		Name: t.Arch,
+		Properties: []junitProperty{
+			{Name: "job_id", Value: job.ID},
+			{Name: "arch", Value: t.Arch},
+			{Name: "repo", Value: job.Repo},
+			{Name: "commit", Value: job.Commit},
+			{Name: "resolved_commit", Value: t.ResolvedCommit},
+			{Name: "status", Value: string(t.Status)},
+			{Name: "reason", Value: t.Reason},
+			{Name: "exit_code", Value: strconv.Itoa(t.ExitCode)},
+		},
+	}
+	if t.StartedAt != nil {
+		suite.Timestamp = t.StartedAt.UTC().Format("2006-01-02T15:04:05")
+		if t.EndedAt != nil {
+			elapsed = t.EndedAt.Sub(*t.StartedAt).Seconds()
+		}
+	}
+	suite.Time = formatSeconds(elapsed)
+
+	if len(t.Tests) > 0 {
+		suite.Cases = testCases(t)
+	} else {
+		suite.Cases = []junitTestCase{syntheticCase(job, t, elapsed, tail)}
+	}
+
+	for _, c := range suite.Cases {
+		suite.Tests++
+		switch {
+		case c.Failure != nil:
+			suite.Failures++
+		case c.Error != nil:
+			suite.Errors++
+		case c.Skipped != nil:
+			suite.Skipped++
+		}
+	}
+	return suite, elapsed
+}
+
+// testCases converts structured results. Package results are only reported
+// when a package failed without any failing test, e.g. on build errors.
+func testCases(t *core.JobTarget) []junitTestCase {
+	failedTests := make(map[string]bool)
+	for _, res := range t.Tests {
+		if res.Name != "" && res.Status == core.TestStatusFail {
+			failedTests[res.Package] = true
+		}
+	}
+
+	var cases []junitTestCase
+	for _, res := range t.Tests {
+		name := res.Name
+		if name == "" {
+			if res.Status != core.TestStatusFail || failedTests[res.Package] {
+				continue
+			}
+			name = res.Package
+		}
+		c := junitTestCase{
+			Name:      name,
+			ClassName: res.Package,
+			Time:      formatSeconds(res.Elapsed),
+		}
+		switch res.Status {
+		case core.TestStatusFail:
+			c.Failure = &junitFailure{Message: "failed", Type: "fail", Text: res.Output}
+		case core.TestStatusSkip:
+			c.Skipped = &junitSkipped{Message: lastLine(res.Output)}
+		default:
+			c.SystemOut = res.Output
+		}
+		cases = append(cases, c)
+	}
+	return cases
+}
+
+// syntheticCase stands in for a target without structured results
+func syntheticCase(job *core.Job, t *core.JobTarget, elapsed float64, tail LogTail) junitTestCase {
+	c := junitTestCase{
+		Name:      job.TestCommand,
+		ClassName: t.Arch,
+		Time:      formatSeconds(elapsed),
+	}
+	log := tail(t, maxJUnitLog)
+	if t.LogSize > maxJUnitLog {
+		log = "...(truncated)\n" + log
+	}
+
+	switch t.Status {
+	case core.TargetStatusPassed:
+		c.SystemOut = log
+	case core.TargetStatusFailed:
+		msg := fmt.Sprintf("exit code %d", t.ExitCode)
+		if t.Reason != "" {
+			msg = fmt.Sprintf("%s (%s)", t.Reason, msg)
+		}
+		c.Failure = &junitFailure{Message: msg, Type: t.Reason, Text: log}
+	case core.TargetStatusError:
+		c.Error = &junitFailure{Message: t.Reason, Type: t.Reason, Text: log}
+	default:
+		c.Skipped = &junitSkipped{Message: string(t.Status)}
+	}
+	return c
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
+
+func lastLine(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '\n' {
+		s = s[:len(s)-1]
+	}
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == '\n' {
+			return s[i+1:]
+		}
+	}
+	return s
+}
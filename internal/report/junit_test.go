@@ -0,0 +1,68 @@
+package report
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	job := &core.Job{
+		ID:          "job1",
+		Repo:        "https://example.com/repo.git",
+		TestCommand: "go test -json ./...",
+		Targets: []*core.JobTarget{
+			{Arch: "amd64", Status: core.TargetStatusFailed, StartedAt: &start, EndedAt: &end, Tests: []core.TestResult{
+				result("TestOK", core.TestStatusPass, 0.5),
+				{Package: "example.com/app", Name: "TestBroken", Status: core.TestStatusFail, Elapsed: 1, Output: "boom\n"},
+				{Package: "example.com/app", Name: "TestSkip", Status: core.TestStatusSkip, Output: "=== RUN TestSkip\n    needs cgo\n"},
+				{Package: "example.com/app", Status: core.TestStatusFail},
+				{Package: "example.com/broken", Status: core.TestStatusFail, Output: "build failed"},
+			}},
+			{Arch: "arm64", Status: core.TargetStatusFailed, ExitCode: 128, Reason: "git_clone_failed", LogRef: "job1/arm64/1", LogSize: 27},
+			{Arch: "riscv64", Status: core.TargetStatusPending},
+		},
+	}
+
+	var buf bytes.Buffer
+	tail := func(t *core.JobTarget, n int64) string {
+		if t.LogRef == "job1/arm64/1" {
+			return "fatal: repository not found"
+		}
+		return ""
+	}
+	assert.NoError(t, WriteJUnit(&buf, job, tail))
+
+	var doc junitTestSuites
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, 6, doc.Tests)
+	assert.Equal(t, 3, doc.Failures)
+	assert.Equal(t, 2, doc.Skipped)
+	assert.Len(t, doc.Suites, 3)
+
+	amd64 := doc.Suites[0]
+	assert.Equal(t, "amd64", amd64.Name)
+	assert.Equal(t, "90.000", amd64.Time)
+	assert.Equal(t, "2024-05-01T12:00:00", amd64.Timestamp)
+	names := []string{}
+	for _, c := range amd64.Cases {
+		names = append(names, c.Name)
+	}
+	// the failing package with failing tests is not reported twice
+	assert.Equal(t, []string{"TestOK", "TestBroken", "TestSkip", "example.com/broken"}, names)
+	assert.Equal(t, "boom\n", amd64.Cases[1].Failure.Text)
+	assert.Equal(t, "    needs cgo", amd64.Cases[2].Skipped.Message)
+
+	arm64 := doc.Suites[1].Cases[0]
+	assert.Equal(t, "go test -json ./...", arm64.Name)
+	assert.Equal(t, "git_clone_failed (exit code 128)", arm64.Failure.Message)
+	assert.Equal(t, "fatal: repository not found", arm64.Failure.Text)
+
+	assert.Equal(t, "pending", doc.Suites[2].Cases[0].Skipped.Message)
+}
@@ -0,0 +1,290 @@
+package runner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+)
+
+var (
+	// ErrUnknownAgent is returned for agent IDs that were never registered
+	ErrUnknownAgent = errors.New("unknown agent")
+	// ErrNotAssigned is returned when an agent reports on a target it does
+	// not hold
+	ErrNotAssigned = errors.New("target not assigned to agent")
+	// ErrAgentsDisabled is returned to agents when no agent token is
+	// configured; assignments carry secret env values, so agents must
+	// authenticate
+	ErrAgentsDisabled = errors.New("agents are disabled, MTH_AGENT_TOKEN is not set")
+	// ErrInvalidAgentToken is returned to agents presenting a wrong token
+	ErrInvalidAgentToken = errors.New("invalid agent token")
+	// ErrReservedAgentID is returned for agent IDs that name server workers
+	ErrReservedAgentID = errors.New("agent id is reserved for servers")
+	// ErrAgentIDInUse is returned when an agent registers with the ID of
+	// another agent that is still active
+	ErrAgentIDInUse = errors.New("agent id is in use")
+)
+
+// Agent is a remote executor that pulls targets for the architectures its
+// host runs natively. The ID is generated at registration and identifies
+// the agent in every later request.
+type Agent struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Architectures []string  `json:"architectures"`
+	RegisteredAt  time.Time `json:"registered_at"`
+	LastSeen      time.Time `json:"last_seen"`
+	// Running is the number of targets the agent currently executes
+	Running int `json:"running"`
+
+	// restored agents were recreated from the targets they held when the
+	// server restarted; they must register again before claiming targets
+	restored bool
+}
+
+// Assignment is a target handed to an agent
+type Assignment struct {
+	// Job carries what the agent needs to execute the target; its targets
+	// are left out
+	Job     *core.Job `json:"job"`
+	Arch    string    `json:"arch"`
+	Attempt int       `json:"attempt"`
+	Timeout string    `json:"timeout"`
+	// Executor is the ID of the agent, or of the server's workers
+	Executor string `json:"executor"`
+	// Image and Platform are resolved by the server from the job and the
+	// architecture mapping
+	Image    string `json:"image"`
+	Platform string `json:"platform,omitempty"`
+}
+
+type remoteTarget struct {
+	agentID string
+	ctx     context.Context
+	// logRef and logSize are the log the agent's output is appended to
+	logRef  string
+	logSize int64
+}
+
+// AgentAuthorized checks that token lets an agent talk to the server.
+// Every agent is refused when no agent token is configured.
+func (r *Runner) AgentAuthorized(token string) error {
+	if r.config.AgentToken == "" {
+		return ErrAgentsDisabled
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(r.config.AgentToken)) != 1 {
+		return ErrInvalidAgentToken
+	}
+	return nil
+}
+
+// RegisterAgent records an agent that runs targets for archs. An agent
+// registering again, e.g. after a server restart, passes its previous ID to
+// keep the targets it is still running; otherwise id is empty and a new one
+// is generated. A previous ID is only accepted when the server does not know
+// the agent, knows it only from the targets it held, or has not heard from
+// it for a lease duration.
+func (r *Runner) RegisterAgent(id, name string, archs []string) (*Agent, error) {
+	if len(archs) == 0 {
+		return nil, errors.New("at least one architecture is required")
+	}
+	archs, err := core.NormalizeArchitectures(archs)
+	if err != nil {
+		return nil, err
+	}
+
+	if isServerExecutor(id) {
+		return nil, ErrReservedAgentID
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev, ok := r.agents[id]; ok && !prev.restored && time.Since(prev.LastSeen) < r.leaseDuration() {
+		return nil, ErrAgentIDInUse
+	}
+	if id == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		id = hex.EncodeToString(b)
+	}
+	now := time.Now()
+	agent := &Agent{
+		ID:            id,
+		Name:          name,
+		Architectures: archs,
+		RegisteredAt:  now,
+		LastSeen:      now,
+	}
+	r.agents[agent.ID] = agent
+
+	logging.Logger.Info("agent_registered", "agent_id", agent.ID, "name", name, "architectures", archs)
+	a := *agent
+	return &a, nil
+}
+
+// Agents lists the registered agents, oldest first
+func (r *Runner) Agents() []Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agents := make([]Agent, 0, len(r.agents))
+	for _, a := range r.agents {
+		agents = append(agents, *a)
+	}
+	for _, rt := range r.remote {
+		for i := range agents {
+			if agents[i].ID == rt.agentID {
+				agents[i].Running++
+			}
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].RegisteredAt.Before(agents[j].RegisteredAt)
+	})
+	return agents
+}
+
+// touchAgent marks an agent as seen and returns a copy of it
+func (r *Runner) touchAgent(agentID string) (Agent, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.agents[agentID]
+	if !ok {
+		return Agent{}, false
+	}
+	a.LastSeen = time.Now()
+	return *a, true
+}
+
+// Claim blocks until a target for one of the agent's architectures is
+// queued and assigns it to the agent. It returns nil without an error when
+// ctx is done first.
+func (r *Runner) Claim(ctx context.Context, agentID string) (*Assignment, error) {
+	agent, ok := r.touchAgent(agentID)
+	if !ok || agent.restored {
+		return nil, ErrUnknownAgent
+	}
+	accept := func(arch string) bool { return slices.Contains(agent.Architectures, arch) }
+
+	for {
+		item, ok := r.queue.pop(ctx, accept)
+		if !ok {
+			return nil, nil
+		}
+		job, err := r.store.GetJob(item.jobID)
+		if err != nil {
+			logging.Logger.Error("target_dequeue_failed", "job_id", item.jobID, "arch", item.arch, "error", err)
+			r.queue.done(item)
+			continue
+		}
+		tctx, attempt, ok := r.begin(item.jobID, item.arch, agentID)
+		if !ok {
+			logging.Logger.Info("target_skipped", "job_id", item.jobID, "arch", item.arch)
+			r.queue.done(item)
+			continue
+		}
+
+		key := targetKey{item.jobID, item.arch}
+		r.mu.Lock()
+		r.remote[key] = remoteTarget{agentID: agentID, ctx: tctx, logRef: store.LogRef(item.jobID, item.arch, attempt)}
+		r.mu.Unlock()
+		r.store.RecalculateJobStatus(item.jobID)
+
+		assigned := *job
+		assigned.Targets = nil
+		logging.Logger.Info("target_start",
+			"job_id", item.jobID,
+			"arch", item.arch,
+			"phase", "assigned",
+			"agent_id", agentID,
+			"attempt", attempt,
+		)
+		image := r.image(&assigned, item.arch)
+		return &Assignment{
+			Job:      &assigned,
+			Arch:     item.arch,
+			Attempt:  attempt,
+			Timeout:  r.timeout(&assigned).String(),
+			Executor: agentID,
+			Image:    image.Image,
+			Platform: image.Platform,
+		}, nil
+	}
+}
+
+// assigned returns the target an agent holds
+func (r *Runner) assigned(agentID, jobID, arch string) (remoteTarget, error) {
+	if _, ok := r.touchAgent(agentID); !ok {
+		return remoteTarget{}, ErrUnknownAgent
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rt, ok := r.remote[targetKey{jobID, arch}]
+	if !ok || rt.agentID != agentID {
+		return remoteTarget{}, ErrNotAssigned
+	}
+	return rt, nil
+}
+
+// AgentLog appends output an agent streamed for its target. The returned
+// flag asks the agent to stop the target because it was cancelled.
+func (r *Runner) AgentLog(agentID, jobID, arch string, chunk []byte) (bool, error) {
+	rt, err := r.assigned(agentID, jobID, arch)
+	if err != nil {
+		return false, err
+	}
+	// every upload doubles as a heartbeat
+	if err := r.store.RenewLease(jobID, arch, time.Now().Add(r.leaseDuration())); err != nil {
+		return false, err
+	}
+	if len(chunk) > 0 {
+		key := targetKey{jobID, arch}
+		if err := appendLog(r.logStore, r.store, key, rt.logRef, rt.logSize, chunk); err != nil {
+			return false, err
+		}
+		// an agent uploads the output of a target one chunk at a time
+		r.mu.Lock()
+		if rt, ok := r.remote[key]; ok {
+			rt.logSize += int64(len(chunk))
+			r.remote[key] = rt
+		}
+		r.mu.Unlock()
+		r.logs.notify(key)
+	}
+	return context.Cause(rt.ctx) == ErrCancelled, nil
+}
+
+// AgentResult records the outcome an agent reported for its target and
+// frees the target's slot
+func (r *Runner) AgentResult(agentID, jobID, arch string, res Result) error {
+	if _, ok := r.touchAgent(agentID); !ok {
+		return ErrUnknownAgent
+	}
+	key := targetKey{jobID, arch}
+	r.mu.Lock()
+	rt, ok := r.remote[key]
+	if !ok || rt.agentID != agentID {
+		r.mu.Unlock()
+		return ErrNotAssigned
+	}
+	delete(r.remote, key)
+	r.mu.Unlock()
+
+	finishLog(r.logStore, key, rt.logRef)
+
+	r.finishTarget(jobID, arch, res)
+	r.end(jobID, arch)
+	r.queue.done(queueItem{jobID, arch})
+	return nil
+}
@@ -0,0 +1,150 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/capability"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+)
+
+// ErrArchUnsupported is returned for architectures neither the host nor a
+// registered agent can run
+var ErrArchUnsupported = errors.New("architecture unsupported")
+
+// execFormatError is what the kernel reports for binaries of an
+// architecture it cannot execute
+const execFormatError = "exec format error"
+
+// SetProber enables the capability preflight. It takes effect with the
+// next probe, which Start runs.
+func (r *Runner) SetProber(p *capability.Prober) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prober = p
+}
+
+// ProbeCapabilities probes the host again and returns which of the
+// supported architectures can run and how. Architectures local workers
+// cannot run are reported as run by agents when an agent registered them.
+// It returns nil when no prober is set.
+func (r *Runner) ProbeCapabilities(ctx context.Context) *capability.Report {
+	r.mu.Lock()
+	prober := r.prober
+	r.mu.Unlock()
+	if prober == nil {
+		return nil
+	}
+
+	report := prober.Probe(ctx, r.SupportedArchitectures())
+	r.mu.Lock()
+	r.capabilities = report
+	r.mu.Unlock()
+
+	report = r.withAgents(report)
+	modes := make(map[capability.Mode][]string)
+	for _, a := range report.Architectures {
+		modes[a.Mode] = append(modes[a.Mode], a.Arch)
+	}
+	logging.Logger.Info("capabilities_probed",
+		"host_arch", report.HostArch,
+		"native", modes[capability.ModeNative],
+		"emulated", modes[capability.ModeEmulated],
+		"agent", modes[capability.ModeAgent],
+		"unsupported", modes[capability.ModeUnsupported],
+		"error", report.Error,
+	)
+	return report
+}
+
+// CheckArchitectures returns an error wrapping ErrArchUnsupported for the
+// first of archs that neither the host nor an agent can run. Every
+// architecture passes until a probe ran.
+func (r *Runner) CheckArchitectures(archs []string) error {
+	r.mu.Lock()
+	report := r.capabilities
+	r.mu.Unlock()
+	if report == nil {
+		return nil
+	}
+	report = r.withAgents(report)
+	for _, arch := range archs {
+		a, ok := report.Lookup(arch)
+		if !ok {
+			a = capability.Arch{Arch: arch, Mode: capability.ModeUnsupported}
+		}
+		if a.Mode == capability.ModeUnsupported {
+			return fmt.Errorf("%w: %s", ErrArchUnsupported, a.Hint())
+		}
+	}
+	return nil
+}
+
+// withAgents returns a copy of report that accounts for the architectures
+// left to agents and those registered agents run
+func (r *Runner) withAgents(report *capability.Report) *capability.Report {
+	out := *report
+	out.Architectures = slices.Clone(report.Architectures)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	local := r.config.LocalArchitectures
+	for i := range out.Architectures {
+		a := &out.Architectures[i]
+		if len(local) > 0 && !slices.Contains(local, a.Arch) {
+			a.Mode = capability.ModeUnsupported
+			a.Interpreter = ""
+		}
+		if a.Mode != capability.ModeUnsupported {
+			continue
+		}
+		for _, agent := range r.agents {
+			if slices.Contains(agent.Architectures, a.Arch) {
+				a.Mode = capability.ModeAgent
+				a.Interpreter = ""
+				break
+			}
+		}
+	}
+	return &out
+}
+
+// matchWriter records whether pattern appeared in what was written to it,
+// including across writes. It is safe for concurrent use.
+type matchWriter struct {
+	pattern []byte
+
+	mu   sync.Mutex
+	tail []byte
+	seen bool
+}
+
+func (m *matchWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen {
+		return len(p), nil
+	}
+	buf := append(m.tail, p...)
+	if bytes.Contains(buf, m.pattern) {
+		m.seen = true
+		m.tail = nil
+		return len(p), nil
+	}
+	// keep just enough to find the pattern split over two writes
+	if keep := len(m.pattern) - 1; len(buf) > keep {
+		buf = buf[len(buf)-keep:]
+	}
+	m.tail = append(m.tail[:0], buf...)
+	return len(p), nil
+}
+
+func (m *matchWriter) matched() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.seen
+}
@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+)
+
+// leaseDuration is how long a running target survives without a heartbeat
+func (r *Runner) leaseDuration() time.Duration {
+	if r.config.LeaseDuration > 0 {
+		return r.config.LeaseDuration
+	}
+	return time.Minute
+}
+
+// heartbeat renews the lease of a target run by a local worker until the
+// returned function is called
+func (r *Runner) heartbeat(jobID, arch string) func() {
+	lease := r.leaseDuration()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := r.store.RenewLease(jobID, arch, time.Now().Add(lease)); err != nil {
+					logging.Logger.Warn("target_lease_renew_failed", "job_id", jobID, "arch", arch, "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// reaper periodically looks for running targets whose lease expired until
+// ctx is done
+func (r *Runner) reaper(ctx context.Context) {
+	ticker := time.NewTicker(r.leaseDuration() / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.reapLost(now)
+		}
+	}
+}
+
+// reapLost handles every running target whose lease expired before now
+// according to the configured lost target policy
+func (r *Runner) reapLost(now time.Time) {
+	lost, err := r.store.ExpiredLeases(now)
+	if err != nil {
+		logging.Logger.Error("reaper_list_failed", "error", err)
+		return
+	}
+	for _, t := range lost {
+		r.loseTarget(t.JobID, t.Arch, now)
+	}
+}
+
+// loseTarget takes a target away from the executor that stopped renewing
+// its lease. The target fails with reason executor_lost, or is archived as
+// such and re-queued when the policy is to requeue.
+func (r *Runner) loseTarget(jobID, arch string, now time.Time) {
+	key := targetKey{jobID, arch}
+
+	// revoke the agent's assignment first so that it can no longer renew
+	// the lease or report a result; a local worker that is still registered
+	// is alive and keeps its target
+	r.mu.Lock()
+	rt, remote := r.remote[key]
+	if _, active := r.active[key]; active && !remote {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.remote, key)
+	r.mu.Unlock()
+
+	requeue := r.config.LostTargetPolicy == config.LostTargetRequeue
+	var executor string
+	lost := false
+	r.store.UpdateTarget(jobID, arch, func(j *core.Job, t *core.JobTarget) {
+		// a heartbeat may have arrived since the target was listed
+		if t.Status != core.TargetStatusRunning || t.LeaseExpiresAt == nil || !t.LeaseExpiresAt.Before(now) {
+			return
+		}
+		lost = true
+		executor = t.Executor
+		failAttempt(t, core.ReasonExecutorLost, now, requeue)
+	})
+	if !lost {
+		if remote {
+			r.mu.Lock()
+			r.remote[key] = rt
+			r.mu.Unlock()
+		}
+		return
+	}
+	if remote {
+		r.end(jobID, arch)
+		r.queue.done(queueItem{jobID, arch})
+	}
+
+	r.store.RecalculateJobStatus(jobID)
+	r.logs.notify(key)
+	logging.Logger.Warn("target_lost",
+		"job_id", jobID,
+		"arch", arch,
+		"executor", executor,
+		"policy", r.config.LostTargetPolicy,
+	)
+	if requeue {
+		r.queue.push(queueItem{jobID, arch})
+	}
+}
+
+// failAttempt ends the running attempt of t with reason because nobody will
+// report its outcome. When requeue is set the attempt is archived and t is
+// left pending for another attempt.
+func failAttempt(t *core.JobTarget, reason string, now time.Time, requeue bool) {
+	t.Status = core.TargetStatusError
+	t.Reason = reason
+	t.ExitCode = -1
+	t.EndedAt = &now
+	t.LeaseExpiresAt = nil
+	if requeue {
+		t.ArchiveAttempt()
+	}
+}
@@ -0,0 +1,171 @@
+package runner
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+)
+
+const (
+	// logFlushSize and logFlushInterval bound how much output is buffered
+	// before it is persisted and visible to followers
+	logFlushSize     = 4096
+	logFlushInterval = time.Second
+)
+
+// logHub notifies followers of a target's log when new output is persisted
+type logHub struct {
+	mu   sync.Mutex
+	subs map[targetKey]map[chan struct{}]struct{}
+}
+
+func newLogHub() *logHub {
+	return &logHub{subs: make(map[targetKey]map[chan struct{}]struct{})}
+}
+
+func (h *logHub) subscribe(key targetKey) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[chan struct{}]struct{})
+	}
+	h.subs[key][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[key], ch)
+		if len(h.subs[key]) == 0 {
+			delete(h.subs, key)
+		}
+	}
+}
+
+func (h *logHub) notify(key targetKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[key] {
+		select {
+		case ch <- struct{}{}:
+		default: // a wake-up is already pending
+		}
+	}
+}
+
+// appendLog writes chunk to the log ref of a target, whose size so far is
+// offset, and records the new size in the job store
+func appendLog(logs store.LogStore, st store.Store, key targetKey, ref string, offset int64, chunk []byte) error {
+	if err := logs.Append(ref, offset, chunk); err != nil {
+		return err
+	}
+	return st.AddTargetLogSize(key.jobID, key.arch, ref, int64(len(chunk)))
+}
+
+// finishLog tells the log store that the log ref of a target is complete
+func finishLog(logs store.LogStore, key targetKey, ref string) {
+	if err := logs.Finish(ref); err != nil {
+		logging.Logger.Warn("target_log_finish_failed",
+			"job_id", key.jobID,
+			"arch", key.arch,
+			"log_ref", ref,
+			"error", err,
+		)
+	}
+}
+
+// logSink buffers target output and appends it to the log store in
+// chunks. It is safe for concurrent use, so stdout and stderr can share one
+// sink.
+type logSink struct {
+	r   *Runner
+	key targetKey
+	ref string
+
+	mu   sync.Mutex
+	buf  []byte
+	size int64
+	stop chan struct{}
+	done chan struct{}
+
+	// failed is set while appends fail; the buffer is then only retried by
+	// the periodic flush
+	failed bool
+}
+
+// newLogSink appends to the log ref of a target, which already holds size
+// bytes
+func newLogSink(r *Runner, key targetKey, ref string, size int64) *logSink {
+	s := &logSink{
+		r:    r,
+		key:  key,
+		ref:  ref,
+		size: size,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.flushLoop()
+	return s
+}
+
+func (s *logSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, p...)
+	if len(s.buf) >= logFlushSize && !s.failed {
+		s.flushLocked()
+	}
+	return len(p), nil
+}
+
+// Close flushes the remaining output, stops the periodic flush and
+// finishes the log
+func (s *logSink) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+	finishLog(s.r.logStore, s.key, s.ref)
+	return nil
+}
+
+func (s *logSink) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.flushLocked()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// flushLocked appends the buffered output. Output that fails to append
+// stays buffered and is appended again at the same offset next time.
+func (s *logSink) flushLocked() {
+	if len(s.buf) == 0 {
+		return
+	}
+	if err := appendLog(s.r.logStore, s.r.store, s.key, s.ref, s.size, s.buf); err != nil {
+		logging.Logger.Warn("target_log_append_failed",
+			"job_id", s.key.jobID,
+			"arch", s.key.arch,
+			"buffered", len(s.buf),
+			"error", err,
+		)
+		s.failed = true
+		return
+	}
+	s.failed = false
+	s.size += int64(len(s.buf))
+	s.buf = s.buf[:0]
+	s.r.logs.notify(s.key)
+}
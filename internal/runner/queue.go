@@ -0,0 +1,117 @@
+package runner
+
+import (
+	"context"
+	"sync"
+)
+
+type queueItem struct {
+	jobID string
+	arch  string
+}
+
+// queue is the FIFO of targets waiting for a worker. Items are handed out
+// in order, skipping those whose architecture is at its concurrency limit.
+type queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   []queueItem
+	running map[string]int
+	limits  map[string]int
+}
+
+func newQueue(limits map[string]int) *queue {
+	q := &queue{
+		running: make(map[string]int),
+		limits:  limits,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push appends item unless it is already queued
+func (q *queue) push(item queueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, it := range q.items {
+		if it == item {
+			return
+		}
+	}
+	q.items = append(q.items, item)
+	q.cond.Broadcast()
+}
+
+// pop blocks until an item can run and claims a slot for its architecture.
+// When accept is not nil only items whose architecture it accepts are
+// handed out. It returns false once ctx is done.
+func (q *queue) pop(ctx context.Context, accept func(arch string) bool) (queueItem, bool) {
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.cond.Broadcast()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if ctx.Err() != nil {
+			return queueItem{}, false
+		}
+		for i, it := range q.items {
+			if accept != nil && !accept(it.arch) {
+				continue
+			}
+			if limit, ok := q.limits[it.arch]; ok && q.running[it.arch] >= limit {
+				continue
+			}
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.running[it.arch]++
+			return it, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// hold claims a slot for a target that is already running without having
+// been popped, such as one resumed after a restart
+func (q *queue) hold(arch string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[arch]++
+}
+
+// done releases the slot claimed by pop or hold
+func (q *queue) done(item queueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[item.arch]--
+	q.cond.Broadcast()
+}
+
+// remove drops a queued item and reports whether it was queued
+func (q *queue) remove(item queueItem) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, it := range q.items {
+		if it == item {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// position returns the 1-based position of item in the queue, or 0 when it
+// is not queued
+func (q *queue) position(item queueItem) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, it := range q.items {
+		if it == item {
+			return i + 1
+		}
+	}
+	return 0
+}
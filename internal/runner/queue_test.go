@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueRespectsArchLimits(t *testing.T) {
+	q := newQueue(map[string]int{"riscv64": 1})
+	q.push(queueItem{"job1", "riscv64"})
+	q.push(queueItem{"job2", "riscv64"})
+	q.push(queueItem{"job2", "amd64"})
+	q.push(queueItem{"job1", "riscv64"}) // duplicate, ignored
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	first, ok := q.pop(ctx, nil)
+	assert.True(t, ok)
+	assert.Equal(t, queueItem{"job1", "riscv64"}, first)
+
+	// riscv64 is at its limit, so the amd64 target overtakes job2/riscv64
+	second, ok := q.pop(ctx, nil)
+	assert.True(t, ok)
+	assert.Equal(t, queueItem{"job2", "amd64"}, second)
+	assert.Equal(t, 1, q.position(queueItem{"job2", "riscv64"}))
+
+	q.done(first)
+	third, ok := q.pop(ctx, nil)
+	assert.True(t, ok)
+	assert.Equal(t, queueItem{"job2", "riscv64"}, third)
+	assert.Equal(t, 0, q.position(third))
+}
+
+func TestQueuePopStopsWithContext(t *testing.T) {
+	q := newQueue(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pop(ctx, nil)
+		done <- ok
+	}()
+	cancel()
+	assert.False(t, <-done)
+}
+
+func TestQueueRemove(t *testing.T) {
+	q := newQueue(nil)
+	q.push(queueItem{"job1", "amd64"})
+	q.push(queueItem{"job1", "arm64"})
+
+	assert.True(t, q.remove(queueItem{"job1", "amd64"}))
+	assert.False(t, q.remove(queueItem{"job1", "amd64"}))
+	assert.Equal(t, 1, q.position(queueItem{"job1", "arm64"}))
+}
+
+func TestQueuePopFiltersArchitectures(t *testing.T) {
+	q := newQueue(nil)
+	q.push(queueItem{"job1", "amd64"})
+	q.push(queueItem{"job1", "riscv64"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	item, ok := q.pop(ctx, func(arch string) bool { return arch == "riscv64" })
+	assert.True(t, ok)
+	assert.Equal(t, queueItem{"job1", "riscv64"}, item)
+	assert.Equal(t, 1, q.position(queueItem{"job1", "amd64"}))
+}
@@ -0,0 +1,121 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+)
+
+// reconcile brings what a previous server process left behind back in line
+// before the workers start, and returns the number of targets queued:
+//   - pending targets are queued again; servers sharing the store may
+//     all queue them, and the claim in begin lets only one run each;
+//   - targets its own workers were running died with the process and fail
+//     with reason server_restarted, or run again under the requeue policy;
+//   - targets of other server processes sharing the store are left to them,
+//     or to the reaper if they are gone;
+//   - targets agents were running are resumed, so that the agents can keep
+//     reporting on them; the reaper fails them if their agent is gone too;
+//   - environments its own workers left behind are torn down.
+func (r *Runner) reconcile(ctx context.Context, jobs []*core.Job) int {
+	queued := 0
+	for _, job := range jobs {
+		restarted := false
+		for _, t := range job.Targets {
+			switch {
+			case t.Status == core.TargetStatusPending:
+				r.queue.push(queueItem{job.ID, t.Arch})
+				queued++
+			case t.Status == core.TargetStatusRunning && r.OwnsExecutor(t.Executor):
+				if r.restartTarget(job.ID, t.Arch) {
+					queued++
+				}
+				restarted = true
+			case t.Status == core.TargetStatusRunning && isServerExecutor(t.Executor):
+				// another server process runs it
+			case t.Status == core.TargetStatusRunning:
+				r.resumeRemote(job.ID, t)
+			}
+		}
+		if restarted {
+			r.store.RecalculateJobStatus(job.ID)
+		}
+	}
+	r.removeOrphans(ctx)
+	return queued
+}
+
+// restartTarget ends the attempt a local worker was running when the server
+// went down and reports whether it was queued again
+func (r *Runner) restartTarget(jobID, arch string) bool {
+	requeue := r.config.LostTargetPolicy == config.LostTargetRequeue
+	now := time.Now()
+	r.store.UpdateTarget(jobID, arch, func(j *core.Job, t *core.JobTarget) {
+		failAttempt(t, core.ReasonServerRestarted, now, requeue)
+	})
+	logging.Logger.Warn("target_reconciled",
+		"job_id", jobID,
+		"arch", arch,
+		"reason", core.ReasonServerRestarted,
+		"policy", r.config.LostTargetPolicy,
+	)
+	if requeue {
+		r.queue.push(queueItem{jobID, arch})
+	}
+	return requeue
+}
+
+// resumeRemote restores the assignment of a target an agent was running.
+// Until the agent registers again it is known only by its ID.
+func (r *Runner) resumeRemote(jobID string, t *core.JobTarget) {
+	arch, agentID := t.Arch, t.Executor
+	key := targetKey{jobID, arch}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	now := time.Now()
+
+	r.mu.Lock()
+	r.active[key] = cancel
+	r.remote[key] = remoteTarget{agentID: agentID, ctx: ctx, logRef: t.LogRef, logSize: t.LogSize}
+	if _, ok := r.agents[agentID]; !ok {
+		r.agents[agentID] = &Agent{ID: agentID, RegisteredAt: now, LastSeen: now, restored: true}
+	}
+	r.mu.Unlock()
+	r.queue.hold(arch)
+
+	// the agent gets a full lease to reconnect
+	if err := r.store.RenewLease(jobID, arch, now.Add(r.leaseDuration())); err != nil {
+		logging.Logger.Warn("target_lease_renew_failed", "job_id", jobID, "arch", arch, "error", err)
+	}
+	logging.Logger.Info("target_resumed", "job_id", jobID, "arch", arch, "agent_id", agentID)
+}
+
+// removeOrphans tears down the environments the previous run of this
+// process left behind; no worker runs yet, so none of them is in use.
+// Environments of agents and of other server processes sharing the host
+// are left to them.
+func (r *Runner) removeOrphans(ctx context.Context) {
+	lctx, cancel := context.WithTimeout(ctx, teardownTimeout)
+	defer cancel()
+	envs, err := r.provisioner.List(lctx)
+	if err != nil {
+		logging.Logger.Warn("orphan_list_failed", "error", err)
+		return
+	}
+	for _, env := range envs {
+		if !r.OwnsExecutor(env.Spec.Executor) {
+			continue
+		}
+		if err := r.provisioner.Teardown(lctx, env); err != nil {
+			logging.Logger.Warn("orphan_teardown_failed", "env_id", env.ID, "error", err)
+			continue
+		}
+		logging.Logger.Info("orphan_removed",
+			"env_id", env.ID,
+			"job_id", env.Spec.JobID,
+			"arch", env.Spec.Arch,
+		)
+	}
+}
@@ -3,43 +3,339 @@ package runner
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io"
+	"os"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/capability"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/gotest"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/provisioner"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/report"
 	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
 )
 
+// teardownTimeout bounds environment cleanup, which runs after the target
+// context may already have expired
+const teardownTimeout = 30 * time.Second
+
+// ErrCancelled is the cancellation cause of targets stopped through Cancel.
+// Agents cancel their target context with it when the server asks them to.
+var ErrCancelled = errors.New("target cancelled")
+
+// serverExecutorPrefix starts the executor IDs of server processes, which
+// sets them apart from agent IDs
+const serverExecutorPrefix = "server:"
+
+// legacyLocalExecutor is the executor every server recorded for its
+// workers' targets before executor IDs told server processes apart
+const legacyLocalExecutor = "local"
+
+type targetKey struct {
+	jobID string
+	arch  string
+}
+
 type Runner struct {
-	store  store.Store
-	config *config.Config
+	store       store.Store
+	config      *config.Config
+	provisioner provisioner.Provisioner
+
+	queue *queue
+	logs  *logHub
+	// logStore keeps the output of every attempt
+	logStore store.LogStore
+	// executorID is recorded for the targets this process's workers run
+	executorID string
+
+	// mu guards active and serialises target start-up against Cancel
+	mu     sync.Mutex
+	active map[targetKey]context.CancelCauseFunc
+	// agents and the targets they are running, also guarded by mu
+	agents map[string]*Agent
+	remote map[targetKey]remoteTarget
+	// prober and the report of its last probe, also guarded by mu
+	prober       *capability.Prober
+	capabilities *capability.Report
 }
 
-func NewRunner(st store.Store) *Runner {
+func NewRunner(st store.Store, cfg *config.Config, prov provisioner.Provisioner) *Runner {
+	executorID := cfg.ExecutorID
+	if executorID == "" {
+		executorID = defaultExecutorID(cfg.ExecutorIDFile)
+	}
 	return &Runner{
-		store:  st,
-		config: config.Load(),
+		executorID:  executorID,
+		store:       st,
+		config:      cfg,
+		provisioner: prov,
+		queue:       newQueue(cfg.ArchConcurrency),
+		logs:        newLogHub(),
+		logStore:    store.NewMemoryLogStore(),
+		active:      make(map[targetKey]context.CancelCauseFunc),
+		agents:      make(map[string]*Agent),
+		remote:      make(map[targetKey]remoteTarget),
+	}
+}
+
+// defaultExecutorID names the server's workers after the host name and a
+// random ID kept in path. A restarted process reads the ID back and
+// recognises the targets it was running, while other processes, with files
+// of their own, keep theirs. Without a path, or when the file cannot be
+// written, the ID lasts for this process only.
+func defaultExecutorID(path string) string {
+	host, _ := os.Hostname()
+	return serverExecutorPrefix + host + "/" + keptID(path)
+}
+
+// keptID returns the ID stored in path, storing a new random one first if
+// there is none
+func keptID(path string) string {
+	if path != "" {
+		if b, err := os.ReadFile(path); err == nil && len(bytes.TrimSpace(b)) > 0 {
+			return string(bytes.TrimSpace(b))
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	if path != "" {
+		if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+			logging.Logger.Warn("executor_id_not_kept", "path", path, "error", err)
+		}
+	}
+	return id
+}
+
+// ExecutorID is the executor recorded for targets this server's workers run
+func (r *Runner) ExecutorID() string {
+	return r.executorID
+}
+
+// OwnsExecutor reports whether executor is this server's workers. Targets
+// started before executors were recorded or told apart count as its own.
+func (r *Runner) OwnsExecutor(executor string) bool {
+	return executor == "" || executor == legacyLocalExecutor || executor == r.executorID
+}
+
+// isServerExecutor reports whether executor is the workers of a server
+// process rather than an agent
+func isServerExecutor(executor string) bool {
+	return strings.HasPrefix(executor, serverExecutorPrefix) || executor == legacyLocalExecutor
+}
+
+// Start reconciles the targets persisted in the store with what survived
+// the previous run, re-queueing pending targets oldest job first, and starts
+// the configured number of workers. Workers stop when ctx is done.
+func (r *Runner) Start(ctx context.Context) error {
+	jobs, err := r.store.ListJobs()
+	if err != nil {
+		return fmt.Errorf("list jobs: %w", err)
 	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	restored := r.reconcile(ctx, jobs)
+	r.ProbeCapabilities(ctx)
+
+	for i := 0; i < r.config.Workers; i++ {
+		go r.worker(ctx)
+	}
+	go r.reaper(ctx)
+	logging.Logger.Info("runner_started",
+		"workers", r.config.Workers,
+		"arch_limits", r.config.ArchConcurrency,
+		"restored_targets", restored,
+	)
+	return nil
 }
 
-// RunJobAsync starts running goroutines for each target architecture
-func (r *Runner) RunJobAsync(job *core.Job) {
+// Enqueue queues every target of job. Targets stay pending until a worker
+// and a slot for their architecture are free.
+func (r *Runner) Enqueue(job *core.Job) {
 	for _, target := range job.Targets {
-		go r.runTarget(job.ID, job, target.Arch)
+		r.queue.push(queueItem{job.ID, target.Arch})
 	}
 }
 
-func (r *Runner) runTarget(jobID string, job *core.Job, arch string) {
+// QueuePosition returns the 1-based position of a target in the pending
+// queue, or 0 when it is not waiting
+func (r *Runner) QueuePosition(jobID, arch string) int {
+	return r.queue.position(queueItem{jobID, arch})
+}
+
+// SetLogStore sets where target output is kept; it defaults to memory.
+// It must be called before Start.
+func (r *Runner) SetLogStore(logs store.LogStore) {
+	r.logStore = logs
+}
+
+// LogStore returns where target output is kept
+func (r *Runner) LogStore() store.LogStore {
+	return r.logStore
+}
+
+// WatchLog subscribes to a target's log. The channel receives a value
+// whenever new output was persisted or the target finished; call the
+// returned function to unsubscribe.
+func (r *Runner) WatchLog(jobID, arch string) (<-chan struct{}, func()) {
+	return r.logs.subscribe(targetKey{jobID, arch})
+}
+
+// Environment finds the local environment of a target's attempt. It
+// returns nil without an error when the environment does not exist, e.g.
+// because it was torn down or an agent runs the target.
+func (r *Runner) Environment(ctx context.Context, jobID, arch string, attempt int) (*provisioner.Environment, error) {
+	envs, err := r.provisioner.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range envs {
+		if env.Spec.JobID == jobID && env.Spec.Arch == arch && env.Spec.Attempt == attempt {
+			return env, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *Runner) worker(ctx context.Context) {
+	var accept func(string) bool
+	if local := r.config.LocalArchitectures; len(local) > 0 {
+		accept = func(arch string) bool { return slices.Contains(local, arch) }
+	}
+	for {
+		item, ok := r.queue.pop(ctx, accept)
+		if !ok {
+			return
+		}
+		job, err := r.store.GetJob(item.jobID)
+		if err != nil {
+			logging.Logger.Error("target_dequeue_failed", "job_id", item.jobID, "arch", item.arch, "error", err)
+		} else {
+			r.runTarget(item.jobID, job, item.arch)
+		}
+		r.queue.done(item)
+	}
+}
+
+// Result is the classified outcome of executing a target. Agents report it
+// back to the server as JSON.
+type Result struct {
+	ExitCode       int               `json:"exit_code"`
+	Reason         string            `json:"reason,omitempty"`
+	ResolvedCommit string            `json:"resolved_commit,omitempty"`
+	Tests          []core.TestResult `json:"tests,omitempty"`
+}
+
+// Cancel stops the targets of a job, or only the target for arch when it is
+// not empty. Running targets have their context cancelled, which tears down
+// their environment; targets that have not started yet are marked cancelled
+// directly. Targets that already finished are left alone.
+func (r *Runner) Cancel(jobID, arch string) error {
+	job, err := r.store.GetJob(jobID)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found := false
+	for _, t := range job.Targets {
+		if arch != "" && t.Arch != arch {
+			continue
+		}
+		found = true
+		if cancel, ok := r.active[targetKey{jobID, t.Arch}]; ok {
+			cancel(ErrCancelled)
+			logging.Logger.Info("target_cancel_requested", "job_id", jobID, "arch", t.Arch)
+			continue
+		}
+		r.queue.remove(queueItem{jobID, t.Arch})
+		now := time.Now()
+		err := r.store.UpdateTarget(jobID, t.Arch, func(j *core.Job, t *core.JobTarget) {
+			if t.Status.IsTerminal() {
+				return
+			}
+			t.Status = core.TargetStatusCancelled
+			t.Reason = core.ReasonCancelled
+			t.EndedAt = &now
+		})
+		if err != nil {
+			return err
+		}
+		logging.Logger.Info("target_cancelled", "job_id", jobID, "arch", t.Arch, "phase", "pending")
+	}
+	if !found {
+		return fmt.Errorf("target %s not found for job %s", arch, jobID)
+	}
+	return r.store.RecalculateJobStatus(jobID)
+}
+
+// begin claims a pending target for executor, gives it its lease and
+// registers it as active. The claim is made inside UpdateTarget, so that of
+// several servers sharing the store only one starts the target; targets
+// that are no longer pending, e.g. because they were cancelled or another
+// server claimed them, are not started. The returned context is cancelled
+// by Cancel; attempt is the number of the attempt that starts.
+func (r *Runner) begin(jobID, arch, executor string) (ctx context.Context, attempt int, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	now := time.Now()
-	// Mark target as running
-	r.store.UpdateTarget(jobID, arch, func(j *core.Job, t *core.JobTarget) {
+	claimed := false
+	err := r.store.UpdateTarget(jobID, arch, func(j *core.Job, t *core.JobTarget) {
+		if t.Status != core.TargetStatusPending {
+			return
+		}
+		claimed = true
 		t.Status = core.TargetStatusRunning
 		t.StartedAt = &now
+		t.Attempt++
+		t.LogRef = store.LogRef(jobID, arch, t.Attempt)
+		t.LogSize = 0
+		t.Executor = executor
+		lease := now.Add(r.leaseDuration())
+		t.LeaseExpiresAt = &lease
+		attempt = t.Attempt
 	})
+	if err != nil || !claimed {
+		return nil, 0, false
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r.active[targetKey{jobID, arch}] = cancel
+	return ctx, attempt, true
+}
+
+// end unregisters an active target
+func (r *Runner) end(jobID, arch string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.active[targetKey{jobID, arch}]; ok {
+		cancel(nil)
+		delete(r.active, targetKey{jobID, arch})
+	}
+}
+
+func (r *Runner) runTarget(jobID string, job *core.Job, arch string) {
+	baseCtx, attempt, ok := r.begin(jobID, arch, r.executorID)
+	if !ok {
+		logging.Logger.Info("target_skipped", "job_id", jobID, "arch", arch)
+		return
+	}
+	defer r.end(jobID, arch)
+	stopHeartbeat := r.heartbeat(jobID, arch)
 	r.store.RecalculateJobStatus(jobID)
 	logging.Logger.Info("target_start",
 		"job_id", jobID,
@@ -47,100 +343,365 @@ func (r *Runner) runTarget(jobID string, job *core.Job, arch string) {
 		"phase", "provision",
 	)
 
-	// Build docker image name/tag for this arch
-	image := fmt.Sprintf("multi-arch-test-runner:%s", arch)
+	ctx, cancel := context.WithTimeout(baseCtx, r.timeout(job))
+	defer cancel()
 
-	// cmd: docker run --rm -t IMAGE sh -c "git clone REPO app && cd app && <test_command>"
-	testCmd := fmt.Sprintf("git clone %s app && cd app && %s", job.Repo, job.TestCommand)
+	// stdout and stderr are interleaved into one log as they are produced
+	sink := newLogSink(r, targetKey{jobID, arch}, store.LogRef(jobID, arch, attempt), 0)
+	image := r.image(job, arch)
+	res := Execute(ctx, r.provisioner, &Assignment{
+		Job:      job,
+		Arch:     arch,
+		Attempt:  attempt,
+		Executor: r.executorID,
+		Image:    image.Image,
+		Platform: image.Platform,
+	}, sink, sink)
+	sink.Close()
+	stopHeartbeat()
 
+	r.finishTarget(jobID, arch, res)
+}
+
+// timeout returns how long a target of job may run
+func (r *Runner) timeout(job *core.Job) time.Duration {
 	// configurable timeout
 	timeoutStr := job.Timeout
 	if timeoutStr == "" {
 		timeoutStr = fmt.Sprintf("%v", r.config.DefaultTimeout)
 	}
 	timeout, _ := time.ParseDuration(timeoutStr)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	// Docker args with env vars
-	dockerArgs := []string{"run", "--rm", "-t", image, "sh", "-c", testCmd}
+	return timeout
+}
 
-	for k, v := range job.Env {
-		dockerArgs = append(dockerArgs, "-e", fmt.Sprintf("%s=%s", k, v))
+// image returns the image and platform a target of job runs with: the
+// job's own image if it names one, otherwise the one mapped to arch
+func (r *Runner) image(job *core.Job, arch string) config.ArchImage {
+	image, _ := r.config.Arch(arch)
+	if job.Image != "" {
+		image.Image = job.Image
 	}
+	return image
+}
 
-	var stdout, stderr bytes.Buffer
-	logging.Logger.Info("target_phase",
-		"job_id", jobID,
-		"arch", arch,
-		"phase", "docker_run",
-		"image", image,
-	)
-	cmd := exec.CommandContext(ctx, "docker", dockerArgs...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+// SupportedArchitectures returns the architectures jobs may target, sorted
+func (r *Runner) SupportedArchitectures() []string {
+	return r.config.SupportedArchitectures()
+}
 
-	// Classify errors
-	exitCode := 0
-	if cmd.ProcessState != nil {
-		exitCode = cmd.ProcessState.ExitCode()
-	}
-	reason := ""
+// ArchImage returns the image and platform configured for arch
+func (r *Runner) ArchImage(arch string) (config.ArchImage, bool) {
+	return r.config.Arch(arch)
+}
 
-	if ctx.Err() == context.DeadlineExceeded {
-		reason = "timeout"
-		exitCode = -2
-	} else if err != nil {
-		exitMsg := err.Error()
-
-		switch {
-		case strings.Contains(exitMsg, "unable to find image"):
-			reason = "docker_image_missing"
-		case strings.Contains(exitMsg, "docker daemon"):
-			reason = "docker_daemon_error"
-		case strings.Contains(stdout.String(), "Username for") ||
-			strings.Contains(stderr.String(), "Username for"):
-			reason = "git_auth_error"
-		default:
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode = exitErr.ExitCode()
-				if strings.Contains(stdout.String(), "Cloning into") && exitCode != 0 {
-					reason = "git_clone_failed"
-				} else {
-					reason = "tests_failed"
-				}
-			} else {
-				reason = "docker_error"
-			}
-		}
-	} else if exitCode != 0 {
-		reason = "tests_failed"
-	}
-	logBuf := bytes.NewBuffer(nil)
-	logBuf.WriteString("STDOUT:\n")
-	logBuf.Write(stdout.Bytes())
-	logBuf.WriteString("\nSTDERR:\n")
-	logBuf.Write(stderr.Bytes())
+// finishTarget records the outcome of an attempt. Failed attempts whose
+// reason the job's retry policy covers are archived and re-queued after the
+// policy's backoff.
+func (r *Runner) finishTarget(jobID, arch string, res Result) {
 	status := core.TargetStatusPassed
-	if err != nil || exitCode != 0 {
+	switch {
+	case res.Reason == core.ReasonCancelled:
+		status = core.TargetStatusCancelled
+	case res.Reason != "" || res.ExitCode != 0:
 		status = core.TargetStatusFailed
 	}
 
-	end := time.Now()
+	var (
+		attempt int
+		retry   bool
+		retryIn time.Duration
+		end     = time.Now()
+	)
+	r.recordTests(jobID, arch, res, end)
 	r.store.UpdateTarget(jobID, arch, func(j *core.Job, t *core.JobTarget) {
 		t.Status = status
-		t.ExitCode = exitCode
-		t.Log = logBuf.String()
+		t.ExitCode = res.ExitCode
 		t.EndedAt = &end
-		t.Reason = reason
+		t.LeaseExpiresAt = nil
+		t.Reason = res.Reason
+		t.ResolvedCommit = res.ResolvedCommit
+		t.Tests = res.Tests
+		attempt = t.Attempt
+
+		if status == core.TargetStatusFailed {
+			retryIn, retry = j.Retry.NextDelay(t.Attempt, res.Reason)
+			if retry {
+				t.ArchiveAttempt()
+			}
+		}
 	})
 	r.store.RecalculateJobStatus(jobID)
+	r.logs.notify(targetKey{jobID, arch})
 	logging.Logger.Info("target_done",
 		"job_id", jobID,
 		"arch", arch,
 		"phase", "done",
 		"status", status,
-		"exit_code", exitCode,
+		"exit_code", res.ExitCode,
+		"reason", res.Reason,
+		"commit", res.ResolvedCommit,
+		"attempt", attempt,
 	)
+
+	if retry {
+		logging.Logger.Info("target_retry_scheduled",
+			"job_id", jobID,
+			"arch", arch,
+			"attempt", attempt+1,
+			"backoff", retryIn,
+		)
+		time.AfterFunc(retryIn, func() {
+			r.queue.push(queueItem{jobID, arch})
+		})
+	}
+}
+
+// recordTests adds the target's per-test outcomes to the repository's test
+// history and flags the tests in res that have flipped between pass and fail
+// on the same commit and architecture.
+func (r *Runner) recordTests(jobID, arch string, res Result, now time.Time) {
+	if len(res.Tests) == 0 || res.ResolvedCommit == "" {
+		return
+	}
+	job, err := r.store.GetJob(jobID)
+	if err != nil {
+		return
+	}
+	attempt := 0
+	for _, t := range job.Targets {
+		if t.Arch == arch {
+			attempt = t.Attempt
+		}
+	}
+
+	outcomes := make([]core.TestOutcome, 0, len(res.Tests))
+	for _, tr := range res.Tests {
+		if tr.Name == "" || (tr.Status != core.TestStatusPass && tr.Status != core.TestStatusFail) {
+			continue
+		}
+		outcomes = append(outcomes, core.TestOutcome{
+			Repo:       job.Repo,
+			Package:    tr.Package,
+			Test:       tr.Name,
+			Arch:       arch,
+			Commit:     res.ResolvedCommit,
+			JobID:      jobID,
+			Attempt:    attempt,
+			Status:     tr.Status,
+			RecordedAt: now,
+		})
+	}
+	if err := r.store.RecordTestOutcomes(outcomes); err != nil {
+		logging.Logger.Warn("test_outcomes_failed", "job_id", jobID, "arch", arch, "error", err)
+		return
+	}
+
+	// only the history of this run's tests can flag them
+	keys := make([]core.TestKey, 0, len(outcomes))
+	for _, o := range outcomes {
+		keys = append(keys, core.TestKey{Package: o.Package, Test: o.Test})
+	}
+	history, err := r.store.TestHistory(job.Repo, arch, keys)
+	if err != nil {
+		logging.Logger.Warn("test_history_failed", "job_id", jobID, "arch", arch, "error", err)
+		return
+	}
+	flaky := report.FlakySet(report.FindFlaky(history))
+	for i := range res.Tests {
+		tr := &res.Tests[i]
+		if flaky[report.FlakyKey{Package: tr.Package, Name: tr.Name, Arch: arch}] {
+			tr.Flaky = true
+		}
+	}
+}
+
+// Execute provisions an environment for the assigned target on prov, clones
+// the repository and runs the test command in it, tearing the environment
+// down afterwards. The server runs it for local workers and agents on their
+// host.
+func Execute(ctx context.Context, prov provisioner.Provisioner, as *Assignment, stdout, stderr io.Writer) Result {
+	// binaries the host cannot run fail in whichever phase comes first, so
+	// the failure is recognised by its message rather than by the phase
+	formatErr := &matchWriter{pattern: []byte(execFormatError)}
+	res := execute(ctx, prov, as, stdout, io.MultiWriter(stderr, formatErr))
+	switch res.Reason {
+	case "", core.ReasonCancelled, core.ReasonTimeout:
+	default:
+		if formatErr.matched() {
+			res.Reason = core.ReasonArchUnsupported
+		}
+	}
+	return res
+}
+
+func execute(ctx context.Context, prov provisioner.Provisioner, as *Assignment, stdout, stderr io.Writer) Result {
+	job, arch, image := as.Job, as.Arch, as.Image
+	if sealed := store.SealedSecrets(job.Env, job.SecretEnv); len(sealed) > 0 {
+		fmt.Fprintf(stderr, "secret env %s cannot be decrypted with the configured secret key\n", strings.Join(sealed, ", "))
+		return Result{ExitCode: -1, Reason: core.ReasonSecretUnavailable}
+	}
+
+	logging.Logger.Info("target_phase",
+		"job_id", job.ID,
+		"arch", arch,
+		"phase", "provision",
+		"image", image,
+		"platform", as.Platform,
+	)
+	env, err := prov.Provision(ctx, provisioner.Spec{
+		JobID:    job.ID,
+		Arch:     arch,
+		Image:    image,
+		Env:      job.Env,
+		Executor: as.Executor,
+		Attempt:  as.Attempt,
+		Repo:     job.Repo,
+		Commit:   job.Commit,
+		Platform: as.Platform,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "provision: %v\n", err)
+		return classifyInfraError(ctx, -1, err)
+	}
+	defer func() {
+		tctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+		defer cancel()
+		if err := prov.Teardown(tctx, env); err != nil {
+			logging.Logger.Warn("target_teardown_failed",
+				"job_id", job.ID,
+				"arch", arch,
+				"env_id", env.ID,
+				"error", err,
+			)
+		}
+	}()
+
+	// Clone separately from the tests so failures can be told apart
+	logging.Logger.Info("target_phase", "job_id", job.ID, "arch", arch, "phase", "clone")
+	var cloneOut bytes.Buffer
+	cloneCmd := fmt.Sprintf("GIT_TERMINAL_PROMPT=0 git clone %s app", shellQuote(job.Repo))
+	exitCode, err := prov.Exec(ctx, env,
+		cloneCmd, io.MultiWriter(stdout, &cloneOut), io.MultiWriter(stderr, &cloneOut))
+	if err != nil {
+		collectEnvLogs(prov, env, stderr)
+		return classifyInfraError(ctx, exitCode, err)
+	}
+	if exitCode != 0 {
+		return classifyCloneFailure(ctx, exitCode, cloneOut.String())
+	}
+
+	if ref := job.Commit; ref != "" && ref != "HEAD" {
+		logging.Logger.Info("target_phase", "job_id", job.ID, "arch", arch, "phase", "checkout", "ref", ref)
+		exitCode, err = prov.Exec(ctx, env, checkoutCommand(ref), stdout, stderr)
+		if err != nil {
+			collectEnvLogs(prov, env, stderr)
+			return classifyInfraError(ctx, exitCode, err)
+		}
+		if exitCode != 0 {
+			return classifyExit(ctx, exitCode, core.ReasonGitCheckoutFailed)
+		}
+	}
+
+	var revOut bytes.Buffer
+	exitCode, err = prov.Exec(ctx, env, "git -C app rev-parse HEAD", &revOut, stderr)
+	if err != nil {
+		collectEnvLogs(prov, env, stderr)
+		return classifyInfraError(ctx, exitCode, err)
+	}
+	resolved := strings.TrimSpace(revOut.String())
+	fmt.Fprintf(stdout, "checked out %s\n", resolved)
+
+	for i, step := range job.Setup {
+		logging.Logger.Info("target_phase", "job_id", job.ID, "arch", arch, "phase", "setup", "step", i+1)
+		fmt.Fprintf(stdout, "setup %d/%d: %s\n", i+1, len(job.Setup), step)
+		exitCode, err = prov.Exec(ctx, env, "cd app && "+step, stdout, stderr)
+		if err != nil {
+			collectEnvLogs(prov, env, stderr)
+			return classifyInfraError(ctx, exitCode, err)
+		}
+		if exitCode != 0 {
+			res := classifyExit(ctx, exitCode, core.ReasonSetupFailed)
+			res.ResolvedCommit = resolved
+			return res
+		}
+	}
+
+	logging.Logger.Info("target_phase", "job_id", job.ID, "arch", arch, "phase", "test", "commit", resolved)
+	// go test -json output is parsed into per-test results as it streams by
+	var parser *gotest.Parser
+	testOut := stdout
+	if gotest.IsGoTest(job.TestCommand) {
+		parser = gotest.NewParser()
+		testOut = io.MultiWriter(stdout, parser)
+	}
+	exitCode, err = prov.Exec(ctx, env, "cd app && "+job.TestCommand, testOut, stderr)
+	res := classifyExit(ctx, exitCode, "")
+	switch {
+	case err != nil:
+		collectEnvLogs(prov, env, stderr)
+		res = classifyInfraError(ctx, exitCode, err)
+	case exitCode != 0:
+		res = classifyExit(ctx, exitCode, core.ReasonTestsFailed)
+	}
+	res.ResolvedCommit = resolved
+	if parser != nil {
+		res.Tests = parser.Results()
+	}
+	return res
+}
+
+// checkoutCommand detaches HEAD at ref. Anything already known to the clone
+// (SHAs, the default branch, tags) is checked out directly; everything else,
+// such as other branches or refs/pull/123/head, is fetched from origin first.
+func checkoutCommand(ref string) string {
+	q := shellQuote(ref)
+	return fmt.Sprintf("cd app && (git checkout --quiet --detach %s 2>/dev/null || "+
+		"(GIT_TERMINAL_PROMPT=0 git fetch --quiet origin %s && git checkout --quiet --detach FETCH_HEAD))", q, q)
+}
+
+// shellQuote quotes s for safe interpolation into an sh -c command
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// collectEnvLogs appends the environment's own logs to help debug
+// infrastructure failures
+func collectEnvLogs(prov provisioner.Provisioner, env *provisioner.Environment, w io.Writer) {
+	ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+	defer cancel()
+	fmt.Fprintln(w, "\nENVIRONMENT LOGS:")
+	if err := prov.Logs(ctx, env, w); err != nil {
+		fmt.Fprintf(w, "(unavailable: %v)\n", err)
+	}
+}
+
+// classifyExit reports a cancellation or timeout when the target context
+// ended early, and reason otherwise
+func classifyExit(ctx context.Context, exitCode int, reason string) Result {
+	if context.Cause(ctx) == ErrCancelled {
+		return Result{ExitCode: -3, Reason: core.ReasonCancelled}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return Result{ExitCode: -2, Reason: core.ReasonTimeout}
+	}
+	return Result{ExitCode: exitCode, Reason: reason}
+}
+
+func classifyInfraError(ctx context.Context, exitCode int, err error) Result {
+	switch {
+	case errors.Is(err, provisioner.ErrImageMissing):
+		return classifyExit(ctx, exitCode, core.ReasonDockerImageMissing)
+	case errors.Is(err, provisioner.ErrDaemonUnavailable):
+		return classifyExit(ctx, exitCode, core.ReasonDockerDaemonError)
+	default:
+		return classifyExit(ctx, exitCode, core.ReasonDockerError)
+	}
+}
+
+func classifyCloneFailure(ctx context.Context, exitCode int, output string) Result {
+	if strings.Contains(output, "Username for") ||
+		strings.Contains(output, "could not read Username") {
+		return classifyExit(ctx, exitCode, core.ReasonGitAuthError)
+	}
+	return classifyExit(ctx, exitCode, core.ReasonGitCloneFailed)
 }
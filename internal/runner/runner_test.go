@@ -0,0 +1,911 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/capability"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/config"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/logging"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/provisioner"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logging.Init()
+	os.Exit(m.Run())
+}
+
+// targetLog reads the log of the current attempt of t
+func targetLog(t *testing.T, r *Runner, target *core.JobTarget) string {
+	log, err := store.ReadLog(r.LogStore(), target.LogRef, 0, target.LogSize)
+	assert.NoError(t, err)
+	return log
+}
+
+func newTestJob(id string) *core.Job {
+	return &core.Job{
+		ID:            id,
+		Repo:          "https://example.com/repo.git",
+		TestCommand:   "go test ./...",
+		Architectures: []string{"amd64"},
+		Status:        core.JobStatusPending,
+		Targets:       []*core.JobTarget{{Arch: "amd64", Status: core.TargetStatusPending}},
+	}
+}
+
+func TestRunTargetClassification(t *testing.T) {
+	tests := []struct {
+		name         string
+		provisionErr error
+		exec         func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error)
+		timeout      string
+		wantStatus   core.TargetStatus
+		wantReason   string
+		wantExitCode int
+	}{
+		{
+			name:       "passes",
+			wantStatus: core.TargetStatusPassed,
+		},
+		{
+			name:         "image missing",
+			provisionErr: fmt.Errorf("docker: %w", provisioner.ErrImageMissing),
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "docker_image_missing",
+			wantExitCode: -1,
+		},
+		{
+			name:         "daemon unavailable",
+			provisionErr: fmt.Errorf("docker: %w", provisioner.ErrDaemonUnavailable),
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "docker_daemon_error",
+			wantExitCode: -1,
+		},
+		{
+			name:         "other provision error",
+			provisionErr: fmt.Errorf("boom"),
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "docker_error",
+			wantExitCode: -1,
+		},
+		{
+			name: "git auth error",
+			exec: func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+				io.WriteString(stderr, "fatal: could not read Username for 'https://example.com'\n")
+				return 128, nil
+			},
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "git_auth_error",
+			wantExitCode: 128,
+		},
+		{
+			name: "binary of unsupported architecture",
+			exec: func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+				io.WriteString(stderr, "exec /usr/bin/git: exec ")
+				io.WriteString(stderr, "format error\n")
+				return 255, nil
+			},
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "arch_unsupported",
+			wantExitCode: 255,
+		},
+		{
+			name: "git clone failed",
+			exec: func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+				if strings.Contains(cmd, "git clone") {
+					io.WriteString(stderr, "fatal: repository not found\n")
+					return 128, nil
+				}
+				return 0, nil
+			},
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "git_clone_failed",
+			wantExitCode: 128,
+		},
+		{
+			name: "tests failed",
+			exec: func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+				if strings.Contains(cmd, "go test") {
+					io.WriteString(stdout, "--- FAIL: TestSomething\n")
+					return 1, nil
+				}
+				return 0, nil
+			},
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "tests_failed",
+			wantExitCode: 1,
+		},
+		{
+			name: "exec daemon error",
+			exec: func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+				return 1, provisioner.ErrDaemonUnavailable
+			},
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "docker_daemon_error",
+			wantExitCode: 1,
+		},
+		{
+			name: "timeout",
+			exec: func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+				<-ctx.Done()
+				return 137, nil
+			},
+			timeout:      "10ms",
+			wantStatus:   core.TargetStatusFailed,
+			wantReason:   "timeout",
+			wantExitCode: -2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemoryStore()
+			prov := provisioner.NewFake()
+			prov.ProvisionErr = tt.provisionErr
+			prov.ExecFunc = tt.exec
+			r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+			job := newTestJob("job-" + strings.ReplaceAll(tt.name, " ", "-"))
+			job.Timeout = tt.timeout
+			st.SaveJob(job)
+
+			r.runTarget(job.ID, job, "amd64")
+
+			got, err := st.GetJob(job.ID)
+			assert.NoError(t, err)
+			target := got.Targets[0]
+			assert.Equal(t, tt.wantStatus, target.Status)
+			assert.Equal(t, tt.wantReason, target.Reason)
+			assert.Equal(t, tt.wantExitCode, target.ExitCode)
+			assert.NotNil(t, target.StartedAt)
+			assert.NotNil(t, target.EndedAt)
+		})
+	}
+}
+
+func TestRunTargetTearsDownEnvironment(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		return 1, nil
+	}
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	job := newTestJob("teardown")
+	job.Env = map[string]string{"FOO": "bar"}
+	st.SaveJob(job)
+
+	r.runTarget(job.ID, job, "amd64")
+
+	assert.Len(t, prov.Provisioned, 1)
+	assert.Equal(t, "amd64", prov.Provisioned[0].Arch)
+	assert.Equal(t, map[string]string{"FOO": "bar"}, prov.Provisioned[0].Env)
+	assert.Equal(t, []string{"fake-1"}, prov.TornDown)
+	// the failed clone must stop the run before the tests execute
+	assert.Len(t, prov.Commands, 1)
+}
+
+func TestRunTargetSelectsImageAndPlatform(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	cfg := &config.Config{
+		DefaultTimeout: time.Minute,
+		Architectures: map[string]config.ArchImage{
+			"amd64": {Image: "runner:amd64", Platform: "linux/amd64"},
+			"arm64": {Image: "runner:arm64", Platform: "linux/arm64/v8"},
+		},
+	}
+	r := NewRunner(st, cfg, prov)
+
+	job := newTestJob("images")
+	job.Architectures = []string{"amd64", "arm64"}
+	job.Targets = append(job.Targets, &core.JobTarget{Arch: "arm64", Status: core.TargetStatusPending})
+	st.SaveJob(job)
+	r.runTarget(job.ID, job, "arm64")
+
+	override := newTestJob("override")
+	override.Image = "golang:1.22"
+	st.SaveJob(override)
+	r.runTarget(override.ID, override, "amd64")
+
+	assert.Len(t, prov.Provisioned, 2)
+	assert.Equal(t, "runner:arm64", prov.Provisioned[0].Image)
+	assert.Equal(t, "linux/arm64/v8", prov.Provisioned[0].Platform)
+	assert.Equal(t, "golang:1.22", prov.Provisioned[1].Image)
+	assert.Equal(t, "linux/amd64", prov.Provisioned[1].Platform)
+}
+
+func TestRunTargetRunsSetupSteps(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "make deps") {
+			return 2, nil
+		}
+		return 0, nil
+	}
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	job := newTestJob("setup")
+	job.Setup = []string{"apt-get update", "make deps", "make more"}
+	st.SaveJob(job)
+	r.runTarget(job.ID, job, "amd64")
+
+	got, _ := st.GetJob(job.ID)
+	target := got.Targets[0]
+	assert.Equal(t, core.TargetStatusFailed, target.Status)
+	assert.Equal(t, core.ReasonSetupFailed, target.Reason)
+	assert.Equal(t, 2, target.ExitCode)
+	assert.Contains(t, targetLog(t, r, target), "setup 2/3: make deps")
+	// the failing step stops the run before later steps and the tests
+	assert.Equal(t, "cd app && make deps", prov.Commands[len(prov.Commands)-1])
+}
+
+func TestRunTargetChecksOutCommit(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		name         string
+		commit       string
+		checkoutExit int
+		wantCheckout bool
+		wantReason   string
+		wantResolved string
+	}{
+		{name: "default branch", commit: "", wantResolved: sha},
+		{name: "explicit head", commit: "HEAD", wantResolved: sha},
+		{name: "pull request ref", commit: "refs/pull/123/head", wantCheckout: true, wantResolved: sha},
+		{name: "missing ref", commit: "no-such-branch", checkoutExit: 128, wantCheckout: true, wantReason: "git_checkout_failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemoryStore()
+			prov := provisioner.NewFake()
+			prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+				switch {
+				case strings.Contains(cmd, "git checkout"):
+					return tt.checkoutExit, nil
+				case strings.Contains(cmd, "rev-parse"):
+					io.WriteString(stdout, sha+"\n")
+				}
+				return 0, nil
+			}
+			r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+			job := newTestJob("checkout-" + strings.ReplaceAll(tt.name, " ", "-"))
+			job.Commit = tt.commit
+			st.SaveJob(job)
+
+			r.runTarget(job.ID, job, "amd64")
+
+			got, _ := st.GetJob(job.ID)
+			target := got.Targets[0]
+			assert.Equal(t, tt.wantReason, target.Reason)
+			assert.Equal(t, tt.wantResolved, target.ResolvedCommit)
+
+			checkedOut := false
+			for _, cmd := range prov.Commands {
+				if strings.Contains(cmd, "git checkout") {
+					checkedOut = true
+					assert.Contains(t, cmd, "'"+tt.commit+"'")
+				}
+			}
+			assert.Equal(t, tt.wantCheckout, checkedOut)
+		})
+	}
+}
+
+func TestCancelRunningTarget(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	started := make(chan struct{})
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "go test") {
+			close(started)
+			<-ctx.Done()
+			return 137, nil
+		}
+		return 0, nil
+	}
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	job := newTestJob("cancel-running")
+	st.SaveJob(job)
+
+	done := make(chan struct{})
+	go func() {
+		r.runTarget(job.ID, job, "amd64")
+		close(done)
+	}()
+	<-started
+
+	assert.NoError(t, r.Cancel(job.ID, ""))
+	<-done
+
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusCancelled, got.Targets[0].Status)
+	assert.Equal(t, "cancelled", got.Targets[0].Reason)
+	assert.Equal(t, core.JobStatusCancelled, got.Status)
+	assert.Equal(t, []string{"fake-1"}, prov.TornDown)
+}
+
+func TestCancelPendingTarget(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	job := newTestJob("cancel-pending")
+	job.Targets = append(job.Targets, &core.JobTarget{Arch: "arm64", Status: core.TargetStatusPending})
+	st.SaveJob(job)
+
+	assert.NoError(t, r.Cancel(job.ID, "arm64"))
+	assert.Error(t, r.Cancel(job.ID, "riscv64"))
+
+	// a cancelled target never provisions an environment
+	r.runTarget(job.ID, job, "arm64")
+	assert.Empty(t, prov.Provisioned)
+
+	r.runTarget(job.ID, job, "amd64")
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusPassed, got.Targets[0].Status)
+	assert.Equal(t, core.TargetStatusCancelled, got.Targets[1].Status)
+	assert.Equal(t, core.JobStatusCancelled, got.Status)
+}
+
+func TestStartRunsQueuedAndRestoredTargets(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	cfg := &config.Config{DefaultTimeout: time.Minute, Workers: 2}
+	r := NewRunner(st, cfg, prov)
+
+	// pending before Start, as if left over from a previous run
+	restored := newTestJob("restored")
+	st.SaveJob(restored)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, r.Start(ctx))
+
+	submitted := newTestJob("submitted")
+	st.SaveJob(submitted)
+	r.Enqueue(submitted)
+
+	for _, id := range []string{"restored", "submitted"} {
+		assert.Eventually(t, func() bool {
+			job, _ := st.GetJob(id)
+			return job.Status == core.JobStatusPassed
+		}, 5*time.Second, 10*time.Millisecond, id)
+	}
+}
+
+func TestRunTargetPersistsLogIncrementally(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	job := newTestJob("log-stream")
+	stale := store.LogRef(job.ID, "amd64", 0)
+	r.LogStore().Append(stale, 0, []byte("stale output from an earlier run"))
+	job.Targets[0].LogRef, job.Targets[0].LogSize = stale, 32
+	st.SaveJob(job)
+
+	notify, unsubscribe := r.WatchLog(job.ID, "amd64")
+	defer unsubscribe()
+
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "go test") {
+			io.WriteString(stdout, strings.Repeat("x", logFlushSize))
+			// the chunk is visible before the command finishes
+			select {
+			case <-notify:
+			case <-time.After(time.Second):
+				t.Error("no log notification while running")
+			}
+			got, _ := st.GetJob(job.ID)
+			assert.Contains(t, targetLog(t, r, got.Targets[0]), strings.Repeat("x", logFlushSize))
+			io.WriteString(stderr, "\ntail on stderr\n")
+		}
+		return 0, nil
+	}
+
+	r.runTarget(job.ID, job, "amd64")
+
+	got, _ := st.GetJob(job.ID)
+	log := targetLog(t, r, got.Targets[0])
+	assert.NotContains(t, log, "stale")
+	assert.True(t, strings.HasSuffix(log, "tail on stderr\n"))
+}
+
+// flakyLogStore fails the first fails appends
+type flakyLogStore struct {
+	store.LogStore
+	fails int
+}
+
+func (s *flakyLogStore) Append(ref string, offset int64, chunk []byte) error {
+	if s.fails > 0 {
+		s.fails--
+		return fmt.Errorf("log store unavailable")
+	}
+	return s.LogStore.Append(ref, offset, chunk)
+}
+
+func TestLogSinkRetriesFailedAppends(t *testing.T) {
+	st := store.NewMemoryStore()
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, provisioner.NewFake())
+	r.SetLogStore(&flakyLogStore{LogStore: store.NewMemoryLogStore(), fails: 1})
+
+	job := newTestJob("log-retry")
+	ref := store.LogRef(job.ID, "amd64", 1)
+	job.Targets[0].LogRef = ref
+	st.SaveJob(job)
+
+	sink := newLogSink(r, targetKey{jobID: job.ID, arch: "amd64"}, ref, 0)
+	io.WriteString(sink, strings.Repeat("x", logFlushSize)) // the append fails
+	io.WriteString(sink, "tail\n")
+	sink.Close()
+
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, strings.Repeat("x", logFlushSize)+"tail\n", targetLog(t, r, got.Targets[0]))
+}
+
+func TestRunTargetWithSealedSecret(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	// as loaded by a store whose key cannot decrypt the value
+	job := newTestJob("sealed")
+	job.Env = map[string]string{"TOKEN": "enc:v1:c2VhbGVk"}
+	job.SecretEnv = []string{"TOKEN"}
+	st.SaveJob(job)
+	r.runTarget(job.ID, job, "amd64")
+
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusFailed, got.Targets[0].Status)
+	assert.Equal(t, core.ReasonSecretUnavailable, got.Targets[0].Reason)
+	assert.Contains(t, targetLog(t, r, got.Targets[0]), "secret env TOKEN cannot be decrypted")
+	assert.Empty(t, prov.Provisioned, "nothing runs with the sealed value")
+}
+
+func TestRunTargetParsesGoTestJSON(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "go test") {
+			io.WriteString(stdout, `{"Action":"run","Package":"example.com/app","Test":"TestA"}`+"\n")
+			io.WriteString(stdout, `{"Action":"fail","Package":"example.com/app","Test":"TestA","Elapsed":0.5}`+"\n")
+			io.WriteString(stdout, `{"Action":"fail","Package":"example.com/app","Elapsed":0.6}`+"\n")
+			return 1, nil
+		}
+		return 0, nil
+	}
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	job := newTestJob("go-test-json")
+	job.TestCommand = "go test -json ./..."
+	st.SaveJob(job)
+
+	r.runTarget(job.ID, job, "amd64")
+
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, "tests_failed", got.Targets[0].Reason)
+	assert.Equal(t, []core.TestResult{
+		{Package: "example.com/app", Name: "TestA", Status: core.TestStatusFail, Elapsed: 0.5},
+		{Package: "example.com/app", Status: core.TestStatusFail, Elapsed: 0.6},
+	}, got.Targets[0].Tests)
+	// the raw events still end up in the log
+	assert.Contains(t, targetLog(t, r, got.Targets[0]), `"Test":"TestA"`)
+}
+
+func TestRunTargetRetriesTransientFailures(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	clones := 0
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "git clone") {
+			clones++
+			if clones == 1 {
+				io.WriteString(stderr, "fatal: unable to access: Connection reset\n")
+				return 128, nil
+			}
+		}
+		return 0, nil
+	}
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute, Workers: 1}, prov)
+
+	job := newTestJob("retry")
+	job.Retry = &core.RetryPolicy{MaxAttempts: 3, RetryOn: []string{core.ReasonGitCloneFailed}, Backoff: "1ms"}
+	st.SaveJob(job)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, r.Start(ctx))
+
+	assert.Eventually(t, func() bool {
+		got, _ := st.GetJob(job.ID)
+		return got.Status == core.JobStatusPassed
+	}, 5*time.Second, 10*time.Millisecond)
+
+	got, _ := st.GetJob(job.ID)
+	target := got.Targets[0]
+	assert.Equal(t, 2, target.Attempt)
+	assert.Len(t, target.Attempts, 1)
+	first := target.Attempts[0]
+	assert.Equal(t, 1, first.Number)
+	assert.Equal(t, core.TargetStatusFailed, first.Status)
+	assert.Equal(t, core.ReasonGitCloneFailed, first.Reason)
+	assert.Equal(t, 128, first.ExitCode)
+	firstLog, err := store.ReadLog(r.LogStore(), first.LogRef, 0, first.LogSize)
+	assert.NoError(t, err)
+	assert.Contains(t, firstLog, "Connection reset")
+	assert.NotContains(t, targetLog(t, r, target), "Connection reset")
+}
+
+func TestRunTargetDoesNotRetryTestFailures(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "go test") {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	job := newTestJob("no-retry")
+	job.Retry = &core.RetryPolicy{MaxAttempts: 3, RetryOn: core.DefaultRetryOn}
+	st.SaveJob(job)
+
+	r.runTarget(job.ID, job, "amd64")
+
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusFailed, got.Targets[0].Status)
+	assert.Equal(t, 1, got.Targets[0].Attempt)
+	assert.Empty(t, got.Targets[0].Attempts)
+	assert.Equal(t, 0, r.QueuePosition(job.ID, "amd64"))
+}
+
+func TestRunTargetFlagsFlakyTests(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	runs := 0
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		switch {
+		case strings.Contains(cmd, "rev-parse"):
+			io.WriteString(stdout, "abc123\n")
+		case strings.Contains(cmd, "go test"):
+			runs++
+			action := "pass"
+			if runs == 1 {
+				action = "fail"
+			}
+			io.WriteString(stdout, `{"Action":"run","Package":"example.com/app","Test":"TestA"}`+"\n")
+			io.WriteString(stdout, `{"Action":"`+action+`","Package":"example.com/app","Test":"TestA"}`+"\n")
+			io.WriteString(stdout, `{"Action":"run","Package":"example.com/app","Test":"TestB"}`+"\n")
+			io.WriteString(stdout, `{"Action":"pass","Package":"example.com/app","Test":"TestB"}`+"\n")
+		}
+		return 0, nil
+	}
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, prov)
+
+	first := newTestJob("flaky-1")
+	first.TestCommand = "go test -json ./..."
+	st.SaveJob(first)
+	r.runTarget(first.ID, first, "amd64")
+	got, _ := st.GetJob(first.ID)
+	assert.False(t, got.Targets[0].Tests[0].Flaky)
+
+	second := newTestJob("flaky-2")
+	second.TestCommand = "go test -json ./..."
+	st.SaveJob(second)
+	r.runTarget(second.ID, second, "amd64")
+
+	got, _ = st.GetJob(second.ID)
+	tests := got.Targets[0].Tests
+	assert.Equal(t, "TestA", tests[0].Name)
+	assert.True(t, tests[0].Flaky)
+	assert.Equal(t, "TestB", tests[1].Name)
+	assert.False(t, tests[1].Flaky)
+
+	history, err := st.TestOutcomes(first.Repo)
+	assert.NoError(t, err)
+	assert.Len(t, history, 4)
+	assert.Equal(t, "abc123", history[0].Commit)
+	assert.Equal(t, 1, history[0].Attempt)
+}
+
+func TestAgentAuthorized(t *testing.T) {
+	r := NewRunner(store.NewMemoryStore(), &config.Config{}, provisioner.NewFake())
+	assert.ErrorIs(t, r.AgentAuthorized(""), ErrAgentsDisabled)
+
+	r = NewRunner(store.NewMemoryStore(), &config.Config{AgentToken: "secret"}, provisioner.NewFake())
+	assert.NoError(t, r.AgentAuthorized("secret"))
+	assert.ErrorIs(t, r.AgentAuthorized("guess"), ErrInvalidAgentToken)
+	assert.ErrorIs(t, r.AgentAuthorized(""), ErrInvalidAgentToken)
+}
+
+func TestRegisterAgentID(t *testing.T) {
+	r := NewRunner(store.NewMemoryStore(), &config.Config{LeaseDuration: time.Minute}, provisioner.NewFake())
+
+	_, err := r.RegisterAgent("server:host/1234", "board", []string{"arm64"})
+	assert.ErrorIs(t, err, ErrReservedAgentID)
+	_, err = r.RegisterAgent("local", "board", []string{"arm64"})
+	assert.ErrorIs(t, err, ErrReservedAgentID)
+
+	agent, err := r.RegisterAgent("", "board", []string{"arm64"})
+	assert.NoError(t, err)
+	_, err = r.RegisterAgent(agent.ID, "impostor", []string{"arm64"})
+	assert.ErrorIs(t, err, ErrAgentIDInUse)
+
+	// once the agent has been silent for a lease it may register again
+	r.mu.Lock()
+	r.agents[agent.ID].LastSeen = time.Now().Add(-2 * time.Minute)
+	r.mu.Unlock()
+	again, err := r.RegisterAgent(agent.ID, "board", []string{"arm64"})
+	assert.NoError(t, err)
+	assert.Equal(t, agent.ID, again.ID)
+}
+
+func TestAgentClaimAndResult(t *testing.T) {
+	st := store.NewMemoryStore()
+	r := NewRunner(st, &config.Config{DefaultTimeout: time.Minute}, provisioner.NewFake())
+
+	job := newTestJob("agent")
+	job.Architectures = []string{"amd64", "riscv64"}
+	job.Targets = append(job.Targets, &core.JobTarget{Arch: "riscv64", Status: core.TargetStatusPending})
+	st.SaveJob(job)
+	r.Enqueue(job)
+
+	agent, err := r.RegisterAgent("", "board", []string{"riscv64"})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	as, err := r.Claim(ctx, agent.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "riscv64", as.Arch)
+	assert.Equal(t, 1, as.Attempt)
+	assert.Equal(t, "1m0s", as.Timeout)
+	assert.Nil(t, as.Job.Targets)
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusRunning, got.Targets[1].Status)
+	assert.Equal(t, 1, r.QueuePosition(job.ID, "amd64"))
+
+	_, err = r.AgentLog("other", job.ID, "riscv64", []byte("x"))
+	assert.ErrorIs(t, err, ErrUnknownAgent)
+	_, err = r.AgentLog(agent.ID, job.ID, "amd64", []byte("x"))
+	assert.ErrorIs(t, err, ErrNotAssigned)
+
+	cancelled, err := r.AgentLog(agent.ID, job.ID, "riscv64", []byte("ok\n"))
+	assert.NoError(t, err)
+	assert.False(t, cancelled)
+	assert.Equal(t, 1, r.Agents()[0].Running)
+
+	// a cancelled target is reported on the agent's next upload
+	assert.NoError(t, r.Cancel(job.ID, "riscv64"))
+	cancelled, err = r.AgentLog(agent.ID, job.ID, "riscv64", nil)
+	assert.NoError(t, err)
+	assert.True(t, cancelled)
+
+	assert.NoError(t, r.AgentResult(agent.ID, job.ID, "riscv64", Result{ExitCode: -3, Reason: core.ReasonCancelled}))
+	got, _ = st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusCancelled, got.Targets[1].Status)
+	assert.Equal(t, "ok\n", targetLog(t, r, got.Targets[1]))
+	assert.Equal(t, 0, r.Agents()[0].Running)
+	assert.ErrorIs(t, r.AgentResult(agent.ID, job.ID, "riscv64", Result{}), ErrNotAssigned)
+
+	// nothing else matches the agent's architectures
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	as, err = r.Claim(ctx, agent.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, as)
+}
+
+func TestReapLostTargets(t *testing.T) {
+	for _, policy := range []string{config.LostTargetError, config.LostTargetRequeue} {
+		t.Run(policy, func(t *testing.T) {
+			st := store.NewMemoryStore()
+			cfg := &config.Config{DefaultTimeout: time.Minute, LeaseDuration: time.Minute, LostTargetPolicy: policy}
+			r := NewRunner(st, cfg, provisioner.NewFake())
+
+			job := newTestJob("lost-" + policy)
+			st.SaveJob(job)
+			r.Enqueue(job)
+
+			agent, _ := r.RegisterAgent("", "board", []string{"amd64"})
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := r.Claim(ctx, agent.ID)
+			assert.NoError(t, err)
+			target := func() *core.JobTarget {
+				got, _ := st.GetJob(job.ID)
+				return got.Targets[0]
+			}
+			assert.Equal(t, agent.ID, target().Executor)
+			assert.NotNil(t, target().LeaseExpiresAt)
+
+			// a heartbeat within the lease keeps the target
+			r.reapLost(time.Now())
+			assert.Equal(t, core.TargetStatusRunning, target().Status)
+
+			// the agent went silent
+			r.reapLost(time.Now().Add(2 * time.Minute))
+			_, err = r.AgentLog(agent.ID, job.ID, "amd64", []byte("late"))
+			assert.ErrorIs(t, err, ErrNotAssigned)
+
+			if policy == config.LostTargetError {
+				assert.Equal(t, core.TargetStatusError, target().Status)
+				assert.Equal(t, core.ReasonExecutorLost, target().Reason)
+				assert.Nil(t, target().LeaseExpiresAt)
+				got, _ := st.GetJob(job.ID)
+				assert.Equal(t, core.JobStatusFailed, got.Status)
+				assert.Equal(t, 0, r.QueuePosition(job.ID, "amd64"))
+				return
+			}
+			assert.Equal(t, core.TargetStatusPending, target().Status)
+			assert.Len(t, target().Attempts, 1)
+			assert.Equal(t, core.ReasonExecutorLost, target().Attempts[0].Reason)
+			assert.Equal(t, 1, r.QueuePosition(job.ID, "amd64"))
+
+			// the slot was released, so the target can be claimed again
+			as, err := r.Claim(ctx, agent.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, as.Attempt)
+		})
+	}
+}
+
+func TestLocalTargetRenewsLease(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	var leases []time.Time
+	job := newTestJob("local-lease")
+	prov.ExecFunc = func(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+		if strings.Contains(cmd, "go test") {
+			for i := 0; i < 3; i++ {
+				time.Sleep(40 * time.Millisecond)
+				got, _ := st.GetJob(job.ID)
+				leases = append(leases, *got.Targets[0].LeaseExpiresAt)
+			}
+		}
+		return 0, nil
+	}
+	cfg := &config.Config{DefaultTimeout: time.Minute, LeaseDuration: 60 * time.Millisecond}
+	r := NewRunner(st, cfg, prov)
+	st.SaveJob(job)
+
+	r.runTarget(job.ID, job, "amd64")
+
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusPassed, got.Targets[0].Status)
+	assert.Equal(t, r.ExecutorID(), got.Targets[0].Executor)
+	assert.Nil(t, got.Targets[0].LeaseExpiresAt)
+	assert.True(t, leases[2].After(leases[0]))
+}
+
+func TestDefaultExecutorID(t *testing.T) {
+	dir := t.TempDir()
+	id := defaultExecutorID(filepath.Join(dir, "executor-id"))
+	assert.True(t, strings.HasPrefix(id, serverExecutorPrefix), id)
+	assert.Equal(t, id, defaultExecutorID(filepath.Join(dir, "executor-id")), "kept across restarts")
+	assert.NotEqual(t, id, defaultExecutorID(filepath.Join(dir, "other-id")), "another process on the host")
+	assert.NotEqual(t, defaultExecutorID(""), defaultExecutorID(""))
+}
+
+func TestBeginClaimsPendingTargetOnce(t *testing.T) {
+	// two servers sharing a store both queued the pending target
+	st := store.NewMemoryStore()
+	cfg := &config.Config{DefaultTimeout: time.Minute}
+	first := NewRunner(st, cfg, provisioner.NewFake())
+	second := NewRunner(st, cfg, provisioner.NewFake())
+	job := newTestJob("claim")
+	st.SaveJob(job)
+
+	_, attempt, ok := first.begin(job.ID, "amd64", "server:first")
+	assert.True(t, ok)
+	assert.Equal(t, 1, attempt)
+	_, _, ok = second.begin(job.ID, "amd64", "server:second")
+	assert.False(t, ok, "the target was claimed already")
+
+	got, _ := st.GetJob(job.ID)
+	assert.Equal(t, core.TargetStatusRunning, got.Targets[0].Status)
+	assert.Equal(t, 1, got.Targets[0].Attempt)
+	assert.Equal(t, "server:first", got.Targets[0].Executor)
+}
+
+func TestStartReconcilesInterruptedTargets(t *testing.T) {
+	st := store.NewMemoryStore()
+	prov := provisioner.NewFake()
+	const self, replica = "server:harness-0", "server:harness-1"
+	prov.Adopt(&provisioner.Environment{ID: "left-local", Spec: provisioner.Spec{JobID: "restarted", Arch: "amd64", Executor: self}})
+	prov.Adopt(&provisioner.Environment{ID: "left-agent", Spec: provisioner.Spec{JobID: "restarted", Arch: "arm64", Executor: "board-1"}})
+	prov.Adopt(&provisioner.Environment{ID: "replica", Spec: provisioner.Spec{JobID: "restarted", Arch: "s390x", Executor: replica}})
+	cfg := &config.Config{DefaultTimeout: time.Minute, LeaseDuration: time.Minute, ExecutorID: self}
+	r := NewRunner(st, cfg, prov)
+
+	started := time.Now().Add(-time.Hour)
+	lease := time.Now().Add(time.Minute)
+	job := newTestJob("restarted")
+	job.Architectures = []string{"amd64", "arm64", "riscv64", "s390x"}
+	job.Status = core.JobStatusRunning
+	job.Targets = []*core.JobTarget{
+		{Arch: "amd64", Status: core.TargetStatusRunning, Executor: self, Attempt: 1, StartedAt: &started},
+		{Arch: "arm64", Status: core.TargetStatusRunning, Executor: "board-1", Attempt: 1, StartedAt: &started,
+			LogRef: store.LogRef("restarted", "arm64", 1)},
+		{Arch: "riscv64", Status: core.TargetStatusPending},
+		{Arch: "s390x", Status: core.TargetStatusRunning, Executor: replica, Attempt: 1, StartedAt: &started,
+			LeaseExpiresAt: &lease},
+	}
+	st.SaveJob(job)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, r.Start(ctx))
+
+	got, _ := st.GetJob(job.ID)
+	local, remote, pending := got.Targets[0], got.Targets[1], got.Targets[2]
+	// another server sharing the store keeps its target and container
+	assert.Equal(t, core.TargetStatusRunning, got.Targets[3].Status)
+	assert.Equal(t, lease.Unix(), got.Targets[3].LeaseExpiresAt.Unix())
+	assert.Equal(t, core.TargetStatusError, local.Status)
+	assert.Equal(t, core.ReasonServerRestarted, local.Reason)
+	assert.Equal(t, 1, r.QueuePosition(job.ID, "riscv64"))
+	assert.Equal(t, core.TargetStatusPending, pending.Status)
+	assert.Equal(t, []string{"left-local"}, prov.TornDown)
+
+	// the agent keeps reporting on its target and must register again
+	// before it gets new work
+	assert.Equal(t, core.TargetStatusRunning, remote.Status)
+	assert.True(t, remote.LeaseExpiresAt.After(time.Now()))
+	_, err := r.AgentLog("board-1", job.ID, "arm64", []byte("still here\n"))
+	assert.NoError(t, err)
+	_, err = r.Claim(ctx, "board-1")
+	assert.ErrorIs(t, err, ErrUnknownAgent)
+	_, err = r.RegisterAgent("board-1", "board", []string{"arm64"})
+	assert.NoError(t, err)
+	assert.NoError(t, r.AgentResult("board-1", job.ID, "arm64", Result{}))
+	got, _ = st.GetJob(job.ID)
+	remote = got.Targets[1]
+	assert.Equal(t, core.TargetStatusPassed, remote.Status)
+	assert.Equal(t, "still here\n", targetLog(t, r, remote))
+}
+
+func TestCheckArchitectures(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "status"), []byte("enabled\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "qemu-aarch64"), []byte("enabled\n"), 0o644))
+
+	r := NewRunner(store.NewMemoryStore(), &config.Config{DefaultTimeout: time.Minute}, provisioner.NewFake())
+	assert.NoError(t, r.CheckArchitectures([]string{"s390x"}), "nothing is rejected before a probe")
+
+	r.SetProber(&capability.Prober{
+		BinfmtDir: dir,
+		HostArch:  func(ctx context.Context) (string, error) { return "amd64", nil },
+	})
+	report := r.ProbeCapabilities(context.Background())
+	a, _ := report.Lookup("arm64")
+	assert.Equal(t, capability.ModeEmulated, a.Mode)
+
+	assert.NoError(t, r.CheckArchitectures([]string{"amd64", "arm64"}))
+	err := r.CheckArchitectures([]string{"amd64", "s390x"})
+	assert.ErrorIs(t, err, ErrArchUnsupported)
+	assert.Contains(t, err.Error(), "qemu-s390x")
+
+	// an agent running the architecture natively makes it supported
+	_, err = r.RegisterAgent("", "mainframe", []string{"s390x"})
+	assert.NoError(t, err)
+	assert.NoError(t, r.CheckArchitectures([]string{"s390x"}))
+	a, _ = r.ProbeCapabilities(context.Background()).Lookup("s390x")
+	assert.Equal(t, capability.ModeAgent, a.Mode)
+}
@@ -0,0 +1,63 @@
+package store_test
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store/storetest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.NewMemoryStore()
+	})
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		s, err := store.NewStoreBuilder().
+			WithSQLite(filepath.Join(t.TempDir(), "store.db")).
+			WithSecrets(testSecretBox(t)).
+			Build()
+		if err != nil {
+			t.Fatalf("open store: %v", err)
+		}
+		return s
+	})
+}
+
+// TestPostgresStoreConformance runs against the database
+// MTH_TEST_POSTGRES_DSN points to, which it empties before every subtest
+func TestPostgresStoreConformance(t *testing.T) {
+	dsn := os.Getenv("MTH_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("MTH_TEST_POSTGRES_DSN not set")
+	}
+	storetest.Run(t, func(t *testing.T) store.Store {
+		s, err := store.NewStoreBuilder().WithPostgres(dsn).WithSecrets(testSecretBox(t)).Build()
+		if err != nil {
+			t.Fatalf("open store: %v", err)
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatalf("open db: %v", err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(`TRUNCATE jobs, job_targets, test_outcomes`); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+		return s
+	})
+}
+
+func testSecretBox(t *testing.T) *store.SecretBox {
+	box, err := store.NewSecretBox(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatalf("secret box: %v", err)
+	}
+	return box
+}
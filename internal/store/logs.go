@@ -0,0 +1,286 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LogStore keeps the output of target attempts. Job records only hold a
+// reference to a log and its size, so listing jobs never loads logs.
+type LogStore interface {
+	// Append adds chunk to the end of the log ref; offset is the size of
+	// the log before chunk. Appending again at the same offset does not
+	// duplicate output, so a failed append can be retried with the same
+	// chunk, or with more output after it.
+	Append(ref string, offset int64, chunk []byte) error
+	// Open reads the log ref from byte offset on. A log nothing was
+	// appended to reads as empty.
+	Open(ref string, offset int64) (io.ReadCloser, error)
+	// Finish is called once no more output is appended to ref; stores may
+	// compact the log then
+	Finish(ref string) error
+}
+
+// interface conformance
+var (
+	_ LogStore = (*FileLogStore)(nil)
+	_ LogStore = (*MemoryLogStore)(nil)
+)
+
+// LogRef names the log of an attempt of a target, e.g. <job>/arm-v7/2
+func LogRef(jobID, arch string, attempt int) string {
+	return fmt.Sprintf("%s/%s/%d", jobID, strings.ReplaceAll(arch, "/", "-"), attempt)
+}
+
+// FileLogStore keeps every log in a gzip file under a directory. Each
+// appended chunk is a gzip member of its own, which gzip readers
+// decompress as one stream.
+type FileLogStore struct {
+	dir string
+
+	mu sync.Mutex
+	// sizes are the decompressed sizes of the logs appended to since they
+	// were last read from disk
+	sizes map[string]int64
+}
+
+// NewFileLogStore keeps logs under dir, which is created when missing
+func NewFileLogStore(dir string) (*FileLogStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("log dir: %w", err)
+	}
+	return &FileLogStore{dir: dir, sizes: make(map[string]int64)}, nil
+}
+
+// path returns the file of ref, which must stay within the directory
+func (s *FileLogStore) path(ref string) (string, error) {
+	rel := filepath.FromSlash(ref) + ".log.gz"
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid log ref %q", ref)
+	}
+	return filepath.Join(s.dir, rel), nil
+}
+
+// Append implements LogStore. Only the part of chunk past the end of the
+// log is written; it is compressed first and written with a single call,
+// so that readers never see half a member in practice.
+func (s *FileLogStore) Append(ref string, offset int64, chunk []byte) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size, ok := s.sizes[ref]
+	if !ok {
+		if size, err = fileLogSize(path); err != nil {
+			return err
+		}
+	}
+	chunk, err = unwritten(ref, size, offset, chunk)
+	if err != nil || len(chunk) == 0 {
+		return err
+	}
+	member, err := compress(chunk)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// a failed write may have left part of the member, so the size is
+	// read from disk again next time
+	delete(s.sizes, ref)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(member); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.sizes[ref] = size + int64(len(chunk))
+	return nil
+}
+
+// fileLogSize returns the decompressed size of the log file at path
+func fileLogSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(io.Discard, newMemberReader(f, nil))
+}
+
+// Open implements LogStore.
+func (s *FileLogStore) Open(ref string, offset int64) (io.ReadCloser, error) {
+	path, err := s.path(ref)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return skip(newMemberReader(f, f), offset)
+}
+
+// Finish implements LogStore. Files are complete as they are.
+func (s *FileLogStore) Finish(ref string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sizes, ref)
+	return nil
+}
+
+// MemoryLogStore keeps logs in memory, for use with MemoryStore
+type MemoryLogStore struct {
+	mu   sync.Mutex
+	logs map[string][]byte
+}
+
+func NewMemoryLogStore() *MemoryLogStore {
+	return &MemoryLogStore{logs: make(map[string][]byte)}
+}
+
+// Append implements LogStore.
+func (s *MemoryLogStore) Append(ref string, offset int64, chunk []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chunk, err := unwritten(ref, int64(len(s.logs[ref])), offset, chunk)
+	if err != nil {
+		return err
+	}
+	s.logs[ref] = append(s.logs[ref], chunk...)
+	return nil
+}
+
+// Open implements LogStore.
+func (s *MemoryLogStore) Open(ref string, offset int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log := s.logs[ref]
+	offset = min(offset, int64(len(log)))
+	return io.NopCloser(bytes.NewReader(bytes.Clone(log[offset:]))), nil
+}
+
+// Finish implements LogStore.
+func (s *MemoryLogStore) Finish(ref string) error {
+	return nil
+}
+
+// ReadLog reads up to n bytes of the log ref from offset on
+func ReadLog(logs LogStore, ref string, offset, n int64) (string, error) {
+	if n <= 0 {
+		return "", nil
+	}
+	rc, err := logs.Open(ref, offset)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, n))
+	return string(b), err
+}
+
+// unwritten returns the part of chunk, appended at offset, that a log of
+// size bytes does not hold yet
+func unwritten(ref string, size, offset int64, chunk []byte) ([]byte, error) {
+	if offset > size {
+		return nil, fmt.Errorf("append to log %s at %d: it has %d bytes", ref, offset, size)
+	}
+	return chunk[min(size-offset, int64(len(chunk))):], nil
+}
+
+// compress returns chunk as one gzip member
+func compress(chunk []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// skip discards the first n bytes of rc; an rc shorter than that reads as
+// empty
+func skip(rc io.ReadCloser, n int64) (io.ReadCloser, error) {
+	if _, err := io.CopyN(io.Discard, rc, n); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// memberReader decompresses a series of gzip members. A member cut short,
+// because it is still being written, ends the stream instead of failing it.
+type memberReader struct {
+	src    *bufio.Reader
+	closer io.Closer
+	zr     *gzip.Reader
+}
+
+func newMemberReader(r io.Reader, closer io.Closer) *memberReader {
+	return &memberReader{src: bufio.NewReader(r), closer: closer}
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	for {
+		if m.zr == nil {
+			if _, err := m.src.Peek(1); err != nil {
+				return 0, io.EOF
+			}
+			zr, err := gzip.NewReader(m.src)
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			zr.Multistream(false)
+			m.zr = zr
+		}
+		n, err := m.zr.Read(p)
+		switch {
+		case err == io.EOF:
+			m.zr = nil
+			if n > 0 {
+				return n, nil
+			}
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return n, io.EOF
+		default:
+			return n, err
+		}
+	}
+}
+
+func (m *memberReader) Close() error {
+	if m.closer == nil {
+		return nil
+	}
+	return m.closer.Close()
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// interface conformance
+var _ LogStore = (*S3LogStore)(nil)
+
+// s3Timeout bounds a single request to the object store
+const s3Timeout = 30 * time.Second
+
+// S3LogStore keeps logs in a bucket of an S3-compatible object store such
+// as MinIO. Objects cannot be appended to, so a running attempt's log is a
+// series of gzip objects under <ref>/, named after the offset they start
+// at; Finish concatenates them into a single <ref>.log.gz.
+type S3LogStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3LogStore connects to the object store at endpoint, e.g.
+// http://localhost:9000, and checks that bucket exists
+func NewS3LogStore(endpoint, bucket, accessKey, secretKey string) (*S3LogStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", endpoint)
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: u.Scheme == "https",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("s3 bucket %s: %w", bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("s3 bucket %s does not exist", bucket)
+	}
+	return &S3LogStore{client: client, bucket: bucket}, nil
+}
+
+// chunkKey is the object holding the output of ref from offset on
+func chunkKey(ref string, offset int64) string {
+	return fmt.Sprintf("%s/%020d.gz", ref, offset)
+}
+
+// logKey is the object of a finished log
+func logKey(ref string) string {
+	return ref + ".log.gz"
+}
+
+// Append implements LogStore.
+func (s *S3LogStore) Append(ref string, offset int64, chunk []byte) error {
+	member, err := compress(chunk)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err = s.client.PutObject(ctx, s.bucket, chunkKey(ref, offset), bytes.NewReader(member), int64(len(member)),
+		minio.PutObjectOptions{ContentType: "application/gzip"})
+	return err
+}
+
+// Open implements LogStore. The log is read from its finished object when
+// there is one, otherwise from the chunks that cover offset.
+func (s *S3LogStore) Open(ref string, offset int64) (io.ReadCloser, error) {
+	// Finish may remove the chunks while they are read, in which case the
+	// finished object exists on the second pass
+	for pass := 0; ; pass++ {
+		rc, err := s.openFinished(ref, offset)
+		if rc != nil || err != nil {
+			return rc, err
+		}
+		rc, err = s.openChunks(ref, offset)
+		if isNoSuchKey(err) && pass == 0 {
+			continue
+		}
+		return rc, err
+	}
+}
+
+// openFinished returns nil without an error when ref is not finished
+func (s *S3LogStore) openFinished(ref string, offset int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	_, err := s.client.StatObject(ctx, s.bucket, logKey(ref), minio.StatObjectOptions{})
+	cancel()
+	if isNoSuchKey(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the body is streamed, so it is not bound by s3Timeout
+	obj, err := s.client.GetObject(context.Background(), s.bucket, logKey(ref), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return skip(newMemberReader(obj, obj), offset)
+}
+
+// openChunks reads the chunks of a running attempt from the one offset
+// falls into
+func (s *S3LogStore) openChunks(ref string, offset int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	chunks, err := s.chunks(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	first := 0
+	for i, c := range chunks {
+		if c.offset <= offset {
+			first = i
+		}
+	}
+
+	var compressed bytes.Buffer
+	start := int64(0)
+	for i, c := range chunks[first:] {
+		if i == 0 {
+			start = c.offset
+		}
+		if err := s.read(ctx, c.key, &compressed); err != nil {
+			return nil, err
+		}
+	}
+	return skip(newMemberReader(&compressed, nil), offset-start)
+}
+
+// Finish implements LogStore.
+func (s *S3LogStore) Finish(ref string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	chunks, err := s.chunks(ctx, ref)
+	if err != nil || len(chunks) == 0 {
+		return err
+	}
+
+	// gzip members concatenate into a valid gzip stream
+	var log bytes.Buffer
+	for _, c := range chunks {
+		if err := s.read(ctx, c.key, &log); err != nil {
+			return err
+		}
+	}
+	if _, err := s.client.PutObject(ctx, s.bucket, logKey(ref), &log, int64(log.Len()),
+		minio.PutObjectOptions{ContentType: "application/gzip"}); err != nil {
+		return err
+	}
+
+	objects := make(chan minio.ObjectInfo, len(chunks))
+	for _, c := range chunks {
+		objects <- minio.ObjectInfo{Key: c.key}
+	}
+	close(objects)
+	for rerr := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		return fmt.Errorf("remove %s: %w", rerr.ObjectName, rerr.Err)
+	}
+	return nil
+}
+
+type s3Chunk struct {
+	key    string
+	offset int64
+}
+
+// chunks lists the chunks of ref in order
+func (s *S3LogStore) chunks(ctx context.Context, ref string) ([]s3Chunk, error) {
+	var chunks []s3Chunk
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: ref + "/"}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(obj.Key, ref+"/"), ".gz")
+		offset, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, s3Chunk{key: obj.Key, offset: offset})
+	}
+	// keys are listed in lexical order, which the padding makes numeric
+	return chunks, nil
+}
+
+// read appends the object key to buf
+func (s *S3LogStore) read(ctx context.Context, key string, buf *bytes.Buffer) error {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	_, err = buf.ReadFrom(obj)
+	return err
+}
+
+func isNoSuchKey(err error) bool {
+	return err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testLogStore checks the behaviour every LogStore shares; ref must not
+// exist yet
+func testLogStore(t *testing.T, logs LogStore, ref string) {
+	read := func(offset int64) string {
+		rc, err := logs.Open(ref, offset)
+		assert.NoError(t, err)
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "", read(0), "a missing log is empty")
+
+	var size int64
+	for _, chunk := range []string{"cloning\n", "ok  \texample.com/app\t0.5s\n", strings.Repeat("x", 100000)} {
+		assert.NoError(t, logs.Append(ref, size, []byte(chunk)))
+		size += int64(len(chunk))
+	}
+	// retried appends, with the same chunk or with more output after it
+	assert.NoError(t, logs.Append(ref, 0, []byte("cloning\n")))
+	assert.NoError(t, logs.Append(ref, size-10, []byte(strings.Repeat("x", 10))))
+	assert.NoError(t, logs.Append(ref, size-10, []byte(strings.Repeat("x", 20))))
+	size += 10
+	want := "cloning\nok  \texample.com/app\t0.5s\n" + strings.Repeat("x", 100010)
+	assert.Equal(t, want, read(0))
+	assert.Equal(t, want[10:], read(10))
+	assert.Equal(t, want[size-5:], read(size-5))
+	assert.Equal(t, "", read(size+10))
+
+	assert.NoError(t, logs.Finish(ref))
+	assert.Equal(t, want, read(0))
+	assert.Equal(t, want[40:], read(40))
+
+	tail, err := ReadLog(logs, ref, 2, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "oning", tail)
+}
+
+func TestMemoryLogStore(t *testing.T) {
+	testLogStore(t, NewMemoryLogStore(), "job/amd64/1")
+}
+
+func TestFileLogStore(t *testing.T) {
+	dir := t.TempDir()
+	logs, err := NewFileLogStore(dir)
+	assert.NoError(t, err)
+	testLogStore(t, logs, LogRef("job", "arm/v7", 1))
+
+	// compressed on disk
+	info, err := os.Stat(filepath.Join(dir, "job", "arm-v7", "1.log.gz"))
+	assert.NoError(t, err)
+	assert.Less(t, info.Size(), int64(10000))
+
+	_, err = logs.Open("../escape", 0)
+	assert.Error(t, err)
+
+	// sizes are read from disk after a restart
+	logs, err = NewFileLogStore(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, logs.Append(LogRef("job", "arm/v7", 1), 5, []byte("x")))
+	assert.Error(t, logs.Append(LogRef("job", "arm/v7", 1), 200000, []byte("gap")))
+	log, err := ReadLog(logs, LogRef("job", "arm/v7", 1), 0, 200000)
+	assert.NoError(t, err)
+	assert.Len(t, log, 100044)
+}
+
+func TestFileLogStoreReadsWhileWritten(t *testing.T) {
+	dir := t.TempDir()
+	logs, err := NewFileLogStore(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, logs.Append("job/amd64/1", 0, []byte("complete\n")))
+
+	// half of the next member has reached the file
+	member, err := compress([]byte("in flight\n"))
+	assert.NoError(t, err)
+	f, err := os.OpenFile(filepath.Join(dir, "job", "amd64", "1.log.gz"), os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	_, err = f.Write(member[:len(member)/2])
+	assert.NoError(t, err)
+	f.Close()
+
+	log, err := ReadLog(logs, "job/amd64/1", 0, 100)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(log, "complete\n"), log)
+}
+
+// TestS3LogStore runs against the bucket MTH_TEST_S3_BUCKET of the object
+// store at MTH_TEST_S3_ENDPOINT, e.g. a local MinIO
+func TestS3LogStore(t *testing.T) {
+	endpoint := os.Getenv("MTH_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MTH_TEST_S3_ENDPOINT not set")
+	}
+	logs, err := NewS3LogStore(endpoint, os.Getenv("MTH_TEST_S3_BUCKET"),
+		os.Getenv("MTH_TEST_S3_ACCESS_KEY"), os.Getenv("MTH_TEST_S3_SECRET_KEY"))
+	assert.NoError(t, err)
+	testLogStore(t, logs, LogRef(time.Now().Format("20060102T150405.000000000"), "arm/v7", 1))
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -11,9 +12,12 @@ import (
 // interface conformance
 var _ Store = (*MemoryStore)(nil)
 
+// MemoryStore keeps jobs in memory. It stores and hands out copies, so that
+// callers see the same isolation as with a database.
 type MemoryStore struct {
-	mu   sync.RWMutex
-	jobs map[string]*core.Job
+	mu       sync.RWMutex
+	jobs     map[string]*core.Job
+	outcomes []core.TestOutcome
 }
 
 func NewMemoryStore() Store {
@@ -23,9 +27,9 @@ func NewMemoryStore() Store {
 }
 
 func (s *MemoryStore) SaveJob(job *core.Job) (*core.Job, error) {
-
-	s.jobs[job.ID] = job
-
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job.Clone()
 	return job, nil
 }
 
@@ -36,7 +40,7 @@ func (s *MemoryStore) GetJob(id string) (*core.Job, error) {
 	if !exists {
 		return nil, fmt.Errorf("job not found: %s", id)
 	}
-	return job, nil
+	return job.Clone(), nil
 }
 
 // updateTarget applies fn to the target for a job and arch and bumps UpdatedAt
@@ -53,13 +57,119 @@ func (s *MemoryStore) UpdateTarget(jobID, arch string, fn func(j *core.Job, t *c
 		if t.Arch == arch {
 			fn(job, t)
 			job.UpdatedAt = time.Now()
-			break
+			return nil
+		}
+	}
+	return fmt.Errorf("target %s not found for job %s", arch, jobID)
+}
+
+// AddTargetLogSize grows the log size of the target for a job and arch
+func (s *MemoryStore) AddTargetLogSize(jobID, arch, ref string, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[jobID]
+	if !ok {
+		return fmt.Errorf("job not found: %s", jobID)
+	}
+
+	for _, t := range job.Targets {
+		if t.Arch == arch && t.LogRef == ref {
+			t.LogSize += n
+			return nil
+		}
+	}
+	return fmt.Errorf("log %s of target %s not found for job %s", ref, arch, jobID)
+}
+
+// RenewLease moves the lease deadline of a running target for a job and arch
+func (s *MemoryStore) RenewLease(jobID, arch string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[jobID]
+	if !ok {
+		return fmt.Errorf("job not found: %s", jobID)
+	}
+
+	for _, t := range job.Targets {
+		if t.Arch == arch && t.Status == core.TargetStatusRunning {
+			until := until
+			t.LeaseExpiresAt = &until
+			return nil
+		}
+	}
+	return fmt.Errorf("running target %s not found for job %s", arch, jobID)
+}
+
+// ExpiredLeases returns the running targets whose lease expired before
+// the given time
+func (s *MemoryStore) ExpiredLeases(before time.Time) ([]TargetRef, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	refs := make([]TargetRef, 0)
+	for _, job := range s.jobs {
+		for _, t := range job.Targets {
+			if t.Status == core.TargetStatusRunning && t.LeaseExpiresAt != nil && t.LeaseExpiresAt.Before(before) {
+				refs = append(refs, TargetRef{JobID: job.ID, Arch: t.Arch})
+			}
 		}
 	}
+	return refs, nil
+}
 
+// RecordTestOutcomes appends outcomes to the test history
+func (s *MemoryStore) RecordTestOutcomes(outcomes []core.TestOutcome) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes = append(s.outcomes, outcomes...)
 	return nil
 }
 
+// TestOutcomes returns the test history of repo, oldest first
+func (s *MemoryStore) TestOutcomes(repo string) ([]core.TestOutcome, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]core.TestOutcome, 0)
+	for _, o := range s.outcomes {
+		if o.Repo == repo {
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+
+// Reruns returns the IDs of the jobs whose RerunOf is jobID, oldest first
+func (s *MemoryStore) Reruns(jobID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var reruns []*core.Job
+	for _, job := range s.jobs {
+		if job.RerunOf == jobID {
+			reruns = append(reruns, job)
+		}
+	}
+	slices.SortFunc(reruns, func(a, b *core.Job) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	ids := make([]string, 0, len(reruns))
+	for _, job := range reruns {
+		ids = append(ids, job.ID)
+	}
+	return ids, nil
+}
+
+// TestHistory returns the history of tests on arch in repo, oldest first
+func (s *MemoryStore) TestHistory(repo, arch string, tests []core.TestKey) ([]core.TestOutcome, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]core.TestOutcome, 0)
+	for _, o := range s.outcomes {
+		if o.Repo == repo && o.Arch == arch && slices.Contains(tests, core.TestKey{Package: o.Package, Test: o.Test}) {
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+
 // RecalculateJobStatus recomputes the overall job.Status from the target statuses
 func (s *MemoryStore) RecalculateJobStatus(jobID string) error {
 	s.mu.Lock()
@@ -70,8 +180,6 @@ func (s *MemoryStore) RecalculateJobStatus(jobID string) error {
 	}
 
 	job.RecalculateJobStatus()
-	s.SaveJob(job)
-
 	return nil
 }
 
@@ -81,7 +189,11 @@ func (s *MemoryStore) ListJobs() ([]*core.Job, error) {
 	defer s.mu.RUnlock()
 	jobs := make([]*core.Job, 0, len(s.jobs))
 	for _, job := range s.jobs {
-		jobs = append(jobs, job)
+		jobs = append(jobs, job.Clone())
 	}
+	// newest first, like the SQL stores
+	slices.SortFunc(jobs, func(a, b *core.Job) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
 	return jobs, nil
 }
@@ -0,0 +1,283 @@
+package store
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrationFS embed.FS
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrationFS embed.FS
+
+// Migration is one numbered schema change
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus tells whether a migration was applied to a database
+type MigrationStatus struct {
+	Migration
+	// AppliedAt is nil for pending migrations
+	AppliedAt *time.Time
+}
+
+// querier is what *sql.DB and *sql.Tx have in common
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// migrationFile matches migration file names, e.g. 0002_resolved_commit.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+// SQLiteMigrations returns the migrations of the SQLite schema, in order
+func SQLiteMigrations() ([]Migration, error) {
+	return loadMigrations(sqliteMigrationFS, "migrations/sqlite")
+}
+
+// PostgresMigrations returns the migrations of the PostgreSQL schema, in
+// order
+func PostgresMigrations() ([]Migration, error) {
+	return loadMigrations(postgresMigrationFS, "migrations/postgres")
+}
+
+// dialect holds the statements of the migration runner that differ
+// between databases
+type dialect struct {
+	// lock, when set, is run first in the migration transaction, so that
+	// servers starting together do not migrate at the same time
+	lock string
+	// record inserts a row into schema_migrations
+	record string
+	// hasMigrations counts the schema_migrations tables
+	hasMigrations string
+}
+
+var sqliteDialect = dialect{
+	record:        `INSERT INTO schema_migrations (version, name, applied_at) VALUES(?, ?, ?)`,
+	hasMigrations: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`,
+}
+
+var postgresDialect = dialect{
+	// a transaction-level lock, released when the migrations commit
+	lock:   `SELECT pg_advisory_xact_lock(7254140)`,
+	record: `INSERT INTO schema_migrations (version, name, applied_at) VALUES($1, $2, $3)`,
+	hasMigrations: `SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = 'schema_migrations'`,
+}
+
+// loadMigrations reads the migration files in dir. Versions must count up
+// from 1 without gaps, so that a missing file is noticed.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("bad migration file name %q", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: m[2], SQL: string(data)})
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %04d_%s: expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// migrate applies the migrations db has not seen yet in one transaction,
+// so that a failing migration leaves the schema as it was. It returns the
+// migrations it applied.
+func migrate(db *sql.DB, d dialect, migrations []Migration) ([]Migration, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if d.lock != "" {
+		if _, err := tx.Exec(d.lock); err != nil {
+			return nil, fmt.Errorf("lock: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TEXT NOT NULL
+		)`); err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if _, err := tx.Exec(m.SQL); err != nil {
+			return nil, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(d.record, m.Version, m.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return nil, fmt.Errorf("record migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return done, nil
+}
+
+// migrationStatus reports which of migrations db has applied, without
+// changing it
+func migrationStatus(db *sql.DB, d dialect, migrations []Migration) ([]MigrationStatus, error) {
+	var exists int
+	if err := db.QueryRow(d.hasMigrations).Scan(&exists); err != nil {
+		return nil, err
+	}
+	var applied map[int]time.Time
+	if exists > 0 {
+		var err error
+		if applied, err = appliedMigrations(db); err != nil {
+			return nil, err
+		}
+	}
+	return withAppliedAt(migrations, applied), nil
+}
+
+// withAppliedAt pairs migrations with the times they were applied at
+func withAppliedAt(migrations []Migration, applied map[int]time.Time) []MigrationStatus {
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// appliedMigrations returns when each recorded migration was applied
+func appliedMigrations(q querier) (map[int]time.Time, error) {
+	rows, err := q.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version], _ = time.Parse(time.RFC3339, at)
+	}
+	return applied, rows.Err()
+}
+
+// MigrateSQLite applies the pending migrations to the SQLite database at
+// path and returns them
+func MigrateSQLite(path string) ([]Migration, error) {
+	db, migrations, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrate(db, sqliteDialect, migrations)
+}
+
+// SQLiteMigrationStatus reports which migrations the SQLite database at
+// path has applied
+func SQLiteMigrationStatus(path string) ([]MigrationStatus, error) {
+	db, migrations, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		// a new database has applied nothing; querying would create it
+		db.Close()
+		return withAppliedAt(migrations, nil), nil
+	}
+	defer db.Close()
+	return migrationStatus(db, sqliteDialect, migrations)
+}
+
+// openSQLite opens the database at path without migrating it
+func openSQLite(path string) (*sql.DB, []Migration, error) {
+	migrations, err := SQLiteMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open db: %w", err)
+	}
+	return db, migrations, nil
+}
+
+// MigratePostgres applies the pending migrations to the PostgreSQL
+// database at dsn and returns them
+func MigratePostgres(dsn string) ([]Migration, error) {
+	db, migrations, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrate(db, postgresDialect, migrations)
+}
+
+// PostgresMigrationStatus reports which migrations the PostgreSQL database
+// at dsn has applied
+func PostgresMigrationStatus(dsn string) ([]MigrationStatus, error) {
+	db, migrations, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrationStatus(db, postgresDialect, migrations)
+}
+
+// openPostgres opens the database at dsn without migrating it
+func openPostgres(dsn string) (*sql.DB, []Migration, error) {
+	migrations, err := PostgresMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open db: %w", err)
+	}
+	return db, migrations, nil
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteMigrationsAreNumbered(t *testing.T) {
+	migrations, err := SQLiteMigrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+	assert.Equal(t, "initial", migrations[0].Name)
+
+	_, err = loadMigrations(fstest.MapFS{
+		"m/0001_a.sql": {Data: []byte("SELECT 1;")},
+		"m/0003_c.sql": {Data: []byte("SELECT 1;")},
+	}, "m")
+	assert.Error(t, err, "gap")
+	_, err = loadMigrations(fstest.MapFS{"m/first.sql": {}}, "m")
+	assert.Error(t, err, "unnumbered")
+}
+
+func TestPostgresMigrationsAreNumbered(t *testing.T) {
+	migrations, err := PostgresMigrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+	assert.Equal(t, "initial", migrations[0].Name)
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+
+	status, err := SQLiteMigrationStatus(path)
+	assert.NoError(t, err)
+	assert.Nil(t, status[0].AppliedAt)
+	assert.NoFileExists(t, path, "status does not create the database")
+
+	migrations, _ := SQLiteMigrations()
+	applied, err := MigrateSQLite(path)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+
+	applied, err = MigrateSQLite(path)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	status, err = SQLiteMigrationStatus(path)
+	assert.NoError(t, err)
+	for _, s := range status {
+		assert.NotNil(t, s.AppliedAt, s.Name)
+	}
+}
+
+// TestMigrateUpgradesUnversionedDatabase opens a database created before
+// versioned migrations existed
+func TestMigrateUpgradesUnversionedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	migrations, _ := SQLiteMigrations()
+	_, err = db.Exec(migrations[0].SQL)
+	assert.NoError(t, err)
+	_, err = db.Exec(`
+		INSERT INTO jobs (id, repo, commit_hash, test_command, architectures, status, created_at, updated_at)
+		VALUES('old', 'repo', 'main', 'go test ./...', 'amd64,arm64', 'passed', '2024-05-01T12:00:00Z', '2024-05-01T12:00:00Z');
+		INSERT INTO job_targets (job_id, arch, status, log, exit_code) VALUES('old', 'amd64', 'passed', 'ok', 0);`)
+	assert.NoError(t, err)
+	db.Close()
+
+	s := NewSQLiteStore(path)
+	job, err := s.GetJob("old")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amd64", "arm64"}, job.Architectures)
+
+	// the log column is left for MoveLogs
+	logs := NewMemoryLogStore()
+	moved, err := s.(*SQLiteStore).MoveLogs(logs)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	job, err = s.GetJob("old")
+	assert.NoError(t, err)
+	log, err := ReadLog(logs, job.Targets[0].LogRef, 0, job.Targets[0].LogSize)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", log)
+
+	// the columns added since are usable
+	assert.NoError(t, s.UpdateTarget("old", "amd64", func(j *core.Job, t *core.JobTarget) {
+		t.Executor = "local"
+		t.Attempt = 1
+	}))
+	job, err = s.GetJob("old")
+	assert.NoError(t, err)
+	assert.Equal(t, "local", job.Targets[0].Executor)
+}
+
+// TestMigratePostgres runs against the database MTH_TEST_POSTGRES_DSN
+// points to
+func TestMigratePostgres(t *testing.T) {
+	dsn := os.Getenv("MTH_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("MTH_TEST_POSTGRES_DSN not set")
+	}
+	_, err := MigratePostgres(dsn)
+	assert.NoError(t, err)
+	applied, err := MigratePostgres(dsn)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	status, err := PostgresMigrationStatus(dsn)
+	assert.NoError(t, err)
+	for _, s := range status {
+		assert.NotNil(t, s.AppliedAt, s.Name)
+	}
+}
+
+func TestMigrateRollsBackOnFailure(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = migrate(db, sqliteDialect, []Migration{
+		{Version: 1, Name: "ok", SQL: "CREATE TABLE a (id INTEGER);"},
+		{Version: 2, Name: "broken", SQL: "CREATE TABLE b (id INTEGER); ALTER TABLE missing ADD COLUMN x TEXT;"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "0002_broken")
+
+	status, err := migrationStatus(db, sqliteDialect, []Migration{{Version: 1, Name: "ok"}})
+	assert.NoError(t, err)
+	assert.Nil(t, status[0].AppliedAt)
+	var tables int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name IN ('a', 'b')`).Scan(&tables))
+	assert.Equal(t, 0, tables)
+}
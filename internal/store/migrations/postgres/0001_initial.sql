@@ -0,0 +1,57 @@
+CREATE TABLE jobs (
+    id TEXT PRIMARY KEY,
+    repo TEXT NOT NULL,
+    commit_hash TEXT NOT NULL,
+    test_command TEXT NOT NULL,
+    architectures TEXT[] NOT NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at TIMESTAMPTZ,
+    ended_at TIMESTAMPTZ,
+    timeout TEXT,
+    env JSONB,
+    retry JSONB,
+    rerun_of TEXT,
+    image TEXT,
+    setup JSONB
+);
+CREATE INDEX jobs_rerun_of ON jobs(rerun_of, created_at);
+
+CREATE TABLE job_targets (
+    job_id TEXT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+    arch TEXT NOT NULL,
+    ordinal INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    reason TEXT,
+    log_ref TEXT,
+    log_size BIGINT NOT NULL DEFAULT 0,
+    exit_code INTEGER,
+    started_at TIMESTAMPTZ,
+    ended_at TIMESTAMPTZ,
+    timeout TEXT,
+    env JSONB,
+    resolved_commit TEXT,
+    tests JSONB,
+    attempt INTEGER,
+    attempts JSONB,
+    executor TEXT,
+    lease_expires_at TIMESTAMPTZ,
+    PRIMARY KEY (job_id, arch)
+);
+-- the reaper looks for running targets whose lease expired
+CREATE INDEX job_targets_lease ON job_targets(status, lease_expires_at);
+
+CREATE TABLE test_outcomes (
+    id BIGSERIAL PRIMARY KEY,
+    repo TEXT NOT NULL,
+    package TEXT NOT NULL,
+    test TEXT NOT NULL,
+    arch TEXT NOT NULL,
+    commit_hash TEXT NOT NULL,
+    job_id TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX test_outcomes_repo ON test_outcomes(repo, package, test, arch);
@@ -0,0 +1,2 @@
+-- env values are JSON; the names in secret_env have encrypted values
+ALTER TABLE jobs ADD COLUMN secret_env JSONB;
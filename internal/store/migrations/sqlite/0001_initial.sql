@@ -0,0 +1,30 @@
+-- The schema before versioned migrations. IF NOT EXISTS adopts databases
+-- that were created by it.
+CREATE TABLE IF NOT EXISTS jobs (
+    id TEXT PRIMARY KEY,
+    repo TEXT NOT NULL,
+    commit_hash TEXT NOT NULL,
+    test_command TEXT NOT NULL,
+    architectures TEXT NOT NULL,
+    status TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT current_timestamp,
+    updated_at TEXT NOT NULL DEFAULT current_timestamp,
+    started_at TEXT,
+    ended_at TEXT,
+    timeout TEXT,
+    env TEXT
+);
+
+CREATE TABLE IF NOT EXISTS job_targets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id TEXT NOT NULL,
+    arch TEXT NOT NULL,
+    status TEXT NOT NULL,
+    reason TEXT,
+    log TEXT,
+    exit_code INTEGER,
+    started_at TEXT,
+    ended_at TEXT,
+    UNIQUE(job_id, arch),
+    FOREIGN KEY(job_id) REFERENCES jobs(id)
+);
@@ -0,0 +1 @@
+ALTER TABLE job_targets ADD COLUMN resolved_commit TEXT;
@@ -0,0 +1,2 @@
+-- per-test results as JSON
+ALTER TABLE job_targets ADD COLUMN tests TEXT;
@@ -0,0 +1,4 @@
+ALTER TABLE jobs ADD COLUMN retry TEXT;
+ALTER TABLE job_targets ADD COLUMN attempt INTEGER;
+-- earlier attempts as JSON
+ALTER TABLE job_targets ADD COLUMN attempts TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE jobs ADD COLUMN rerun_of TEXT;
+CREATE INDEX jobs_rerun_of ON jobs(rerun_of, created_at);
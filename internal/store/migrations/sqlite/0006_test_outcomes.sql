@@ -0,0 +1,13 @@
+CREATE TABLE test_outcomes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    repo TEXT NOT NULL,
+    package TEXT NOT NULL,
+    test TEXT NOT NULL,
+    arch TEXT NOT NULL,
+    commit_hash TEXT NOT NULL,
+    job_id TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    recorded_at TEXT NOT NULL
+);
+CREATE INDEX test_outcomes_repo ON test_outcomes(repo, package, test, arch);
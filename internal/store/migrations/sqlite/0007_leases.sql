@@ -0,0 +1,4 @@
+ALTER TABLE job_targets ADD COLUMN executor TEXT;
+ALTER TABLE job_targets ADD COLUMN lease_expires_at TEXT;
+-- the reaper looks for running targets whose lease expired
+CREATE INDEX job_targets_lease ON job_targets(status, lease_expires_at);
@@ -0,0 +1,2 @@
+-- setup commands as JSON
+ALTER TABLE jobs ADD COLUMN setup TEXT;
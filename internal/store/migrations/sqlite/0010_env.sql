@@ -0,0 +1,4 @@
+-- env values are JSON; the names in secret_env have encrypted values
+ALTER TABLE jobs ADD COLUMN secret_env TEXT;
+ALTER TABLE job_targets ADD COLUMN timeout TEXT;
+ALTER TABLE job_targets ADD COLUMN env TEXT;
@@ -0,0 +1,4 @@
+-- logs live in the log store; the log column only holds output written
+-- before, until SQLiteStore.MoveLogs moves it there
+ALTER TABLE job_targets ADD COLUMN log_ref TEXT;
+ALTER TABLE job_targets ADD COLUMN log_size INTEGER NOT NULL DEFAULT 0;
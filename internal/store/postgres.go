@@ -0,0 +1,473 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// interface conformance
+var _ Store = (*PostgresStore)(nil)
+
+// PostgresStore keeps jobs in PostgreSQL so that several server replicas
+// can share them. Targets are rows of their own and are updated one at a
+// time under a row lock.
+type PostgresStore struct {
+	db      *sql.DB
+	secrets *SecretBox
+}
+
+const pgJobColumns = `id, repo, commit_hash, test_command, architectures, status,
+	created_at, updated_at, started_at, ended_at, timeout, env, retry, rerun_of, image, setup, secret_env`
+
+const pgTargetColumns = `job_id, arch, status, reason, log_ref, log_size, exit_code, started_at, ended_at, timeout, env,
+	resolved_commit, tests, attempt, attempts, executor, lease_expires_at`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// NewPostgresStore connects to the database at dsn and applies the pending
+// migrations
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, migrations, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrate(db, postgresDialect, migrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migration failed: %w", err)
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// SetSecrets sets the key secret env values are encrypted with
+func (s *PostgresStore) SetSecrets(box *SecretBox) {
+	s.secrets = box
+}
+
+// SaveJob implements Store. The job and its targets are upserted; targets
+// the job no longer has are deleted.
+func (s *PostgresStore) SaveJob(job *core.Job) (*core.Job, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	archs := job.Architectures
+	if archs == nil {
+		archs = []string{}
+	}
+	env, err := encodeEnv(job.Env, job.SecretEnv, s.secrets)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO jobs (`+pgJobColumns+`)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT (id) DO UPDATE SET
+			repo = EXCLUDED.repo, commit_hash = EXCLUDED.commit_hash, test_command = EXCLUDED.test_command,
+			architectures = EXCLUDED.architectures, status = EXCLUDED.status,
+			created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at,
+			started_at = EXCLUDED.started_at, ended_at = EXCLUDED.ended_at, timeout = EXCLUDED.timeout,
+			env = EXCLUDED.env, retry = EXCLUDED.retry, rerun_of = EXCLUDED.rerun_of,
+			image = EXCLUDED.image, setup = EXCLUDED.setup, secret_env = EXCLUDED.secret_env`,
+		job.ID, job.Repo, job.Commit, job.TestCommand, pq.Array(archs), job.Status,
+		job.CreatedAt, job.UpdatedAt, job.StartedAt, job.EndedAt, job.Timeout,
+		env, encodeJSON(job.Retry), job.RerunOf, job.Image, encodeJSON(job.Setup),
+		encodeJSON(job.SecretEnv)); err != nil {
+		return nil, fmt.Errorf("upsert job: %w", err)
+	}
+
+	kept := make([]string, 0, len(job.Targets))
+	for i, t := range job.Targets {
+		args, err := s.targetArgs(job, t)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO job_targets (`+pgTargetColumns+`, ordinal)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+			ON CONFLICT (job_id, arch) DO UPDATE SET
+				status = EXCLUDED.status, reason = EXCLUDED.reason,
+				log_ref = EXCLUDED.log_ref, log_size = EXCLUDED.log_size,
+				exit_code = EXCLUDED.exit_code, started_at = EXCLUDED.started_at, ended_at = EXCLUDED.ended_at,
+				timeout = EXCLUDED.timeout, env = EXCLUDED.env, resolved_commit = EXCLUDED.resolved_commit,
+				tests = EXCLUDED.tests, attempt = EXCLUDED.attempt, attempts = EXCLUDED.attempts,
+				executor = EXCLUDED.executor, lease_expires_at = EXCLUDED.lease_expires_at,
+				ordinal = EXCLUDED.ordinal`,
+			append(args, i)...); err != nil {
+			return nil, fmt.Errorf("upsert target: %w", err)
+		}
+		kept = append(kept, t.Arch)
+	}
+	if _, err := tx.Exec(`DELETE FROM job_targets WHERE job_id = $1 AND NOT (arch = ANY($2))`,
+		job.ID, pq.Array(kept)); err != nil {
+		return nil, fmt.Errorf("delete targets: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return job, nil
+}
+
+// GetJob implements Store.
+func (s *PostgresStore) GetJob(id string) (*core.Job, error) {
+	return s.getJob(s.db, id, false)
+}
+
+// getJob loads a job and its targets through q, locking the job
+// row when forUpdate is set
+func (s *PostgresStore) getJob(q querier, id string, forUpdate bool) (*core.Job, error) {
+	query := `SELECT ` + pgJobColumns + ` FROM jobs WHERE id = $1`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	job, err := s.scanJob(q.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("job not found: %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`SELECT `+pgTargetColumns+` FROM job_targets WHERE job_id = $1 ORDER BY ordinal`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		_, t, env, err := scanPostgresTarget(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeEnv(env, job.SecretEnv, s.secrets, &t.Env); err != nil {
+			return nil, err
+		}
+		job.Targets = append(job.Targets, t)
+	}
+	return job, rows.Err()
+}
+
+// ListJobs implements Store.
+func (s *PostgresStore) ListJobs() ([]*core.Job, error) {
+	rows, err := s.db.Query(`SELECT ` + pgJobColumns + ` FROM jobs ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]*core.Job, 0)
+	jobByID := make(map[string]*core.Job)
+	for rows.Next() {
+		job, err := s.scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+		jobByID[job.ID] = job
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return jobs, nil
+	}
+
+	ids := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	targetRows, err := s.db.Query(`
+		SELECT `+pgTargetColumns+` FROM job_targets
+		WHERE job_id = ANY($1) ORDER BY job_id, ordinal`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer targetRows.Close()
+	for targetRows.Next() {
+		jobID, t, env, err := scanPostgresTarget(targetRows)
+		if err != nil {
+			return nil, err
+		}
+		job := jobByID[jobID]
+		if job == nil {
+			continue
+		}
+		if err := decodeEnv(env, job.SecretEnv, s.secrets, &t.Env); err != nil {
+			return nil, err
+		}
+		job.Targets = append(job.Targets, t)
+	}
+	return jobs, targetRows.Err()
+}
+
+// UpdateTarget implements Store. Only the target's row is rewritten; it is
+// locked for the duration of fn so that concurrent updates of the same
+// target are serialised while other targets of the job are not blocked.
+// The job row is left alone, RecalculateJobStatus bumps its UpdatedAt.
+func (s *PostgresStore) UpdateTarget(jobID, arch string, fn func(j *core.Job, t *core.JobTarget)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	var locked string
+	err = tx.QueryRow(`SELECT arch FROM job_targets WHERE job_id = $1 AND arch = $2 FOR UPDATE`,
+		jobID, arch).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("target %s not found for job %s", arch, jobID)
+	}
+	if err != nil {
+		return fmt.Errorf("lock target: %w", err)
+	}
+
+	job, err := s.getJob(tx, jobID, false)
+	if err != nil {
+		return fmt.Errorf("get job %s: %w", jobID, err)
+	}
+	var target *core.JobTarget
+	for _, t := range job.Targets {
+		if t.Arch == arch {
+			target = t
+		}
+	}
+	fn(job, target)
+
+	args, err := s.targetArgs(job, target)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE job_targets SET status = $3, reason = $4, log_ref = $5, log_size = $6, exit_code = $7,
+			started_at = $8, ended_at = $9, timeout = $10, env = $11, resolved_commit = $12, tests = $13,
+			attempt = $14, attempts = $15, executor = $16, lease_expires_at = $17
+		WHERE job_id = $1 AND arch = $2`, args...); err != nil {
+		return fmt.Errorf("update target: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// RecalculateJobStatus implements Store. The job row is locked while the
+// status is derived from the targets.
+func (s *PostgresStore) RecalculateJobStatus(jobID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	job, err := s.getJob(tx, jobID, true)
+	if err != nil {
+		return err
+	}
+	job.RecalculateJobStatus()
+	if _, err := tx.Exec(`
+		UPDATE jobs SET status = $2, started_at = $3, ended_at = $4, updated_at = $5
+		WHERE id = $1`, jobID, job.Status, job.StartedAt, job.EndedAt, job.UpdatedAt); err != nil {
+		return fmt.Errorf("update job: %w", err)
+	}
+	return tx.Commit()
+}
+
+// AddTargetLogSize implements Store.
+func (s *PostgresStore) AddTargetLogSize(jobID, arch, ref string, n int64) error {
+	res, err := s.db.Exec(`
+		UPDATE job_targets SET log_size = log_size + $4
+		WHERE job_id = $1 AND arch = $2 AND log_ref = $3`, jobID, arch, ref, n)
+	if err != nil {
+		return fmt.Errorf("add log size: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("log %s of target %s not found for job %s", ref, arch, jobID)
+	}
+	return nil
+}
+
+// RenewLease implements Store.
+func (s *PostgresStore) RenewLease(jobID, arch string, until time.Time) error {
+	res, err := s.db.Exec(`
+		UPDATE job_targets SET lease_expires_at = $3
+		WHERE job_id = $1 AND arch = $2 AND status = $4`,
+		jobID, arch, until, core.TargetStatusRunning)
+	if err != nil {
+		return fmt.Errorf("renew lease: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("running target %s not found for job %s", arch, jobID)
+	}
+	return nil
+}
+
+// ExpiredLeases implements Store.
+func (s *PostgresStore) ExpiredLeases(before time.Time) ([]TargetRef, error) {
+	rows, err := s.db.Query(`
+		SELECT job_id, arch FROM job_targets WHERE status = $1 AND lease_expires_at < $2`,
+		core.TargetStatusRunning, before)
+	if err != nil {
+		return nil, err
+	}
+	return scanTargetRefs(rows)
+}
+
+// RecordTestOutcomes implements Store.
+func (s *PostgresStore) RecordTestOutcomes(outcomes []core.TestOutcome) error {
+	if len(outcomes) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, o := range outcomes {
+		if _, err := tx.Exec(`
+			INSERT INTO test_outcomes (repo, package, test, arch, commit_hash, job_id, attempt, status, recorded_at)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			o.Repo, o.Package, o.Test, o.Arch, o.Commit, o.JobID, o.Attempt, o.Status, o.RecordedAt); err != nil {
+			return fmt.Errorf("insert outcome: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// TestOutcomes implements Store.
+func (s *PostgresStore) TestOutcomes(repo string) ([]core.TestOutcome, error) {
+	rows, err := s.db.Query(`
+		SELECT repo, package, test, arch, commit_hash, job_id, attempt, status, recorded_at
+		FROM test_outcomes WHERE repo = $1 ORDER BY id`, repo)
+	if err != nil {
+		return nil, err
+	}
+	return scanPostgresOutcomes(rows)
+}
+
+// TestHistory implements Store.
+func (s *PostgresStore) TestHistory(repo, arch string, tests []core.TestKey) ([]core.TestOutcome, error) {
+	packages := make([]string, 0, len(tests))
+	names := make([]string, 0, len(tests))
+	for _, k := range tests {
+		packages = append(packages, k.Package)
+		names = append(names, k.Test)
+	}
+	rows, err := s.db.Query(`
+		SELECT repo, package, test, arch, commit_hash, job_id, attempt, status, recorded_at
+		FROM test_outcomes
+		WHERE repo = $1 AND arch = $2 AND (package, test) IN (
+			SELECT * FROM unnest($3::text[], $4::text[]))
+		ORDER BY id`, repo, arch, pq.Array(packages), pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	return scanPostgresOutcomes(rows)
+}
+
+// scanPostgresOutcomes reads and closes rows of test_outcomes
+func scanPostgresOutcomes(rows *sql.Rows) ([]core.TestOutcome, error) {
+	defer rows.Close()
+
+	out := make([]core.TestOutcome, 0)
+	for rows.Next() {
+		var o core.TestOutcome
+		if err := rows.Scan(&o.Repo, &o.Package, &o.Test, &o.Arch, &o.Commit, &o.JobID,
+			&o.Attempt, &o.Status, &o.RecordedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// Reruns implements Store.
+func (s *PostgresStore) Reruns(jobID string) ([]string, error) {
+	return queryIDs(s.db, `SELECT id FROM jobs WHERE rerun_of = $1 ORDER BY created_at, id`, jobID)
+}
+
+// targetArgs are the values of pgTargetColumns for t, a target of job
+func (s *PostgresStore) targetArgs(job *core.Job, t *core.JobTarget) ([]interface{}, error) {
+	env, err := encodeEnv(t.Env, job.SecretEnv, s.secrets)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		job.ID, t.Arch, t.Status, t.Reason, t.LogRef, t.LogSize, t.ExitCode, t.StartedAt, t.EndedAt, t.Timeout,
+		env, t.ResolvedCommit, encodeJSON(t.Tests), t.Attempt, encodeJSON(t.Attempts),
+		t.Executor, t.LeaseExpiresAt,
+	}, nil
+}
+
+// scanJob scans the pgJobColumns of a row
+func (s *PostgresStore) scanJob(row rowScanner) (*core.Job, error) {
+	job := &core.Job{}
+	var archs pq.StringArray
+	var startedAt, endedAt sql.NullTime
+	var timeout, env, retry, rerunOf, image, setup, secretEnv sql.NullString
+	if err := row.Scan(&job.ID, &job.Repo, &job.Commit, &job.TestCommand, &archs, &job.Status,
+		&job.CreatedAt, &job.UpdatedAt, &startedAt, &endedAt, &timeout, &env, &retry, &rerunOf,
+		&image, &setup, &secretEnv); err != nil {
+		return nil, err
+	}
+	if len(archs) > 0 {
+		job.Architectures = archs
+	}
+	job.StartedAt = nullTimePtr(startedAt)
+	job.EndedAt = nullTimePtr(endedAt)
+	job.Timeout = timeout.String
+	decodeJSON(secretEnv, &job.SecretEnv)
+	if err := decodeEnv(env, job.SecretEnv, s.secrets, &job.Env); err != nil {
+		return nil, err
+	}
+	decodeJSON(retry, &job.Retry)
+	job.RerunOf = rerunOf.String
+	job.Image = image.String
+	decodeJSON(setup, &job.Setup)
+	return job, nil
+}
+
+// scanPostgresTarget scans the pgTargetColumns of a row. The env is
+// returned as stored, decoding it needs the job's secret names.
+func scanPostgresTarget(row rowScanner) (string, *core.JobTarget, sql.NullString, error) {
+	t := &core.JobTarget{}
+	var jobID string
+	var exitCode, attempt sql.NullInt64
+	var startedAt, endedAt, lease sql.NullTime
+	var reason, logRef, timeout, env, resolved, tests, attempts, executor sql.NullString
+	if err := row.Scan(&jobID, &t.Arch, &t.Status, &reason, &logRef, &t.LogSize, &exitCode, &startedAt, &endedAt,
+		&timeout, &env, &resolved, &tests, &attempt, &attempts, &executor, &lease); err != nil {
+		return "", nil, env, err
+	}
+	t.Reason = reason.String
+	t.LogRef = logRef.String
+	t.ExitCode = int(exitCode.Int64)
+	t.StartedAt = nullTimePtr(startedAt)
+	t.EndedAt = nullTimePtr(endedAt)
+	t.Timeout = timeout.String
+	t.ResolvedCommit = resolved.String
+	decodeJSON(tests, &t.Tests)
+	t.Attempt = int(attempt.Int64)
+	decodeJSON(attempts, &t.Attempts)
+	t.Executor = executor.String
+	t.LeaseExpiresAt = nullTimePtr(lease)
+	return jobID, t, env, nil
+}
+
+// nullTimePtr returns nil for NULL
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrNoSecretKey is returned when a job with secret env values is saved to
+// a store that has no key to encrypt them with
+var ErrNoSecretKey = errors.New("no secret key configured for secret env values")
+
+// sealedPrefix marks an encrypted env value in the database
+const sealedPrefix = "enc:v1:"
+
+// SecretBox encrypts secret env values at rest with AES-256-GCM
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox returns a box for key, 32 base64-encoded bytes, e.g. the
+// output of openssl rand -base64 32
+func NewSecretBox(key string) (*SecretBox, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("secret key: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("secret key must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts plain under a fresh nonce
+func (b *SecretBox) Seal(plain string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal
+func (b *SecretBox) Open(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil || !strings.HasPrefix(sealed, sealedPrefix) || len(data) < b.aead.NonceSize() {
+		return "", errors.New("malformed secret value")
+	}
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret value: %w", err)
+	}
+	return string(plain), nil
+}
+
+// SealedSecrets returns the secret names whose values in env are still
+// sealed because the store could not decrypt them, e.g. after the secret
+// key was changed. Such a job cannot run.
+func SealedSecrets(env map[string]string, secret []string) []string {
+	var sealed []string
+	for _, k := range secret {
+		if strings.HasPrefix(env[k], sealedPrefix) {
+			sealed = append(sealed, k)
+		}
+	}
+	return sealed
+}
+
+// encodeEnv stores env as JSON with the values of the secret names sealed
+// by box, or NULL when env is empty. Values decodeEnv could not open are
+// still sealed and are kept as they are.
+func encodeEnv(env map[string]string, secret []string, box *SecretBox) (interface{}, error) {
+	if len(env) == 0 {
+		return nil, nil
+	}
+	stored := make(map[string]string, len(env))
+	for k, v := range env {
+		if slices.Contains(secret, k) && !strings.HasPrefix(v, sealedPrefix) {
+			if box == nil {
+				return nil, ErrNoSecretKey
+			}
+			sealed, err := box.Seal(v)
+			if err != nil {
+				return nil, err
+			}
+			v = sealed
+		}
+		stored[k] = v
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// decodeEnv reverses encodeEnv, leaving env untouched for NULL. Secret
+// values box cannot open, or all of them without a box, stay sealed, so
+// that one job saved under another key does not make every job unreadable;
+// SealedSecrets finds them.
+func decodeEnv(s sql.NullString, secret []string, box *SecretBox, env *map[string]string) error {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var stored map[string]string
+	if err := json.Unmarshal([]byte(s.String), &stored); err != nil {
+		return fmt.Errorf("decode env: %w", err)
+	}
+	for k, v := range stored {
+		if !slices.Contains(secret, k) || box == nil {
+			continue
+		}
+		if plain, err := box.Open(v); err == nil {
+			stored[k] = plain
+		}
+	}
+	*env = stored
+	return nil
+}
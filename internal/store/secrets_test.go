@@ -0,0 +1,31 @@
+package store
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	assert.NoError(t, err)
+
+	sealed, err := box.Seal("s3cret")
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "s3cret")
+	again, _ := box.Seal("s3cret")
+	assert.NotEqual(t, sealed, again, "every value gets a fresh nonce")
+
+	plain, err := box.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", plain)
+
+	_, err = box.Open("s3cret")
+	assert.Error(t, err, "not sealed")
+
+	_, err = NewSecretBox(base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	assert.Error(t, err, "short key")
+	_, err = NewSecretBox("not base64!")
+	assert.Error(t, err)
+}
@@ -2,8 +2,10 @@ package store
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -16,22 +18,33 @@ var _ Store = (*SQLiteStore)(nil)
 
 type SQLiteStore struct {
 	db *sql.DB
+	// mu serialises writes; UpdateTarget and RecalculateJobStatus read the
+	// job and save it back, which must not interleave with other writes
+	mu sync.Mutex
+	// secrets encrypts secret env values; without it, jobs with secrets
+	// cannot be saved
+	secrets *SecretBox
+}
+
+// SetSecrets sets the box secret env values are encrypted with
+func (s *SQLiteStore) SetSecrets(box *SecretBox) {
+	s.secrets = box
 }
 
 // GetJob implements Store.
 func (s *SQLiteStore) GetJob(id string) (*core.Job, error) {
 	job := &core.Job{}
 	var createdAt, updatedAt string
-	var startedAt, endedAt sql.NullString
+	var startedAt, endedAt, timeout, env, secretEnv, retry, rerunOf, image, setup sql.NullString
 	var architecturesStr string
 
 	err := s.db.QueryRow(`
 		SELECT id, repo, commit_hash, test_command, architectures, status, 
-		       created_at, updated_at, started_at, ended_at, timeout
+		       created_at, updated_at, started_at, ended_at, timeout, env, secret_env, retry, rerun_of, image, setup
 		FROM jobs WHERE id = ?`, id).Scan(
 		&job.ID, &job.Repo, &job.Commit, &job.TestCommand,
 		&architecturesStr, &job.Status, &createdAt, &updatedAt,
-		&startedAt, &endedAt, &job.Timeout)
+		&startedAt, &endedAt, &timeout, &env, &secretEnv, &retry, &rerunOf, &image, &setup)
 
 	if err != nil {
 		return nil, err
@@ -40,7 +53,16 @@ func (s *SQLiteStore) GetJob(id string) (*core.Job, error) {
 	job.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 	job.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
 
-	job.Architectures = strings.Split(architecturesStr, ",")
+	job.Architectures = splitArchitectures(architecturesStr)
+	job.Timeout = timeout.String
+	decodeJSON(secretEnv, &job.SecretEnv)
+	if err := decodeEnv(env, job.SecretEnv, s.secrets, &job.Env); err != nil {
+		return nil, fmt.Errorf("job %s: %w", id, err)
+	}
+	decodeJSON(retry, &job.Retry)
+	job.RerunOf = rerunOf.String
+	job.Image = image.String
+	decodeJSON(setup, &job.Setup)
 	if startedAt.Valid && startedAt.String != "" {
 		ts, _ := time.Parse(time.RFC3339, startedAt.String)
 		job.StartedAt = &ts
@@ -50,15 +72,37 @@ func (s *SQLiteStore) GetJob(id string) (*core.Job, error) {
 		job.EndedAt = &ts
 	}
 
-	rows, _ := s.db.Query(`
-		SELECT arch, status, reason, log, exit_code, started_at, ended_at
-		FROM job_targets WHERE job_id = ?`, id)
+	rows, err := s.db.Query(`
+		SELECT arch, status, reason, log_ref, log_size, exit_code, started_at, ended_at, timeout, env, resolved_commit, tests,
+		       attempt, attempts, executor, lease_expires_at
+		FROM job_targets WHERE job_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
 		t := &core.JobTarget{}
-		var startedAtStr, endedAtStr sql.NullString
-		rows.Scan(&t.Arch, &t.Status, &t.Reason, &t.Log, &t.ExitCode, &startedAt, &endedAt)
+		var reason, logRef, startedAtStr, endedAtStr, timeout, env, resolvedCommit, tests, attempts, executor, leaseStr sql.NullString
+		var logSize, exitCode, attempt sql.NullInt64
+		if err := rows.Scan(&t.Arch, &t.Status, &reason, &logRef, &logSize, &exitCode, &startedAtStr, &endedAtStr,
+			&timeout, &env, &resolvedCommit, &tests, &attempt, &attempts, &executor, &leaseStr); err != nil {
+			return nil, err
+		}
+		t.Timeout = timeout.String
+		if err := decodeEnv(env, job.SecretEnv, s.secrets, &t.Env); err != nil {
+			return nil, fmt.Errorf("job %s target %s: %w", id, t.Arch, err)
+		}
+		t.Reason = reason.String
+		t.LogRef = logRef.String
+		t.LogSize = logSize.Int64
+		t.ExitCode = int(exitCode.Int64)
+		t.ResolvedCommit = resolvedCommit.String
+		t.Executor = executor.String
+		t.LeaseExpiresAt = parseTimePtr(leaseStr)
+		t.Attempt = int(attempt.Int64)
+		decodeJSON(tests, &t.Tests)
+		decodeJSON(attempts, &t.Attempts)
 		if startedAtStr.Valid && startedAtStr.String != "" {
 			ts, _ := time.Parse(time.RFC3339, startedAtStr.String)
 			t.StartedAt = &ts
@@ -70,14 +114,14 @@ func (s *SQLiteStore) GetJob(id string) (*core.Job, error) {
 		job.Targets = append(job.Targets, t)
 	}
 
-	return job, nil
+	return job, rows.Err()
 }
 
 // ListJobs implements Store.
 func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 	rows, err := s.db.Query(`
         SELECT id, repo, commit_hash, test_command, architectures, status,
-               created_at, updated_at, started_at, ended_at, timeout
+               created_at, updated_at, started_at, ended_at, timeout, env, secret_env, retry, rerun_of, image, setup
         FROM jobs
         ORDER BY created_at DESC
     `)
@@ -102,6 +146,12 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 			startedAtStr  sql.NullString
 			endedAtStr    sql.NullString
 			timeout       sql.NullString
+			env           sql.NullString
+			secretEnv     sql.NullString
+			retry         sql.NullString
+			rerunOf       sql.NullString
+			image         sql.NullString
+			setup         sql.NullString
 		)
 
 		if err := rows.Scan(
@@ -109,7 +159,7 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 			&architectures, &status,
 			&createdAtStr, &updatedAtStr,
 			&startedAtStr, &endedAtStr,
-			&timeout,
+			&timeout, &env, &secretEnv, &retry, &rerunOf, &image, &setup,
 		); err != nil {
 			return nil, err
 		}
@@ -138,7 +188,7 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 			Repo:          repo,
 			Commit:        commit,
 			TestCommand:   testCommand,
-			Architectures: strings.Split(architectures, ","),
+			Architectures: splitArchitectures(architectures),
 			Status:        core.JobStatus(status),
 			CreatedAt:     createdAt,
 			UpdatedAt:     updatedAt,
@@ -148,6 +198,14 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 		if timeout.Valid {
 			job.Timeout = timeout.String
 		}
+		decodeJSON(secretEnv, &job.SecretEnv)
+		if err := decodeEnv(env, job.SecretEnv, s.secrets, &job.Env); err != nil {
+			return nil, fmt.Errorf("job %s: %w", id, err)
+		}
+		decodeJSON(retry, &job.Retry)
+		job.RerunOf = rerunOf.String
+		job.Image = image.String
+		decodeJSON(setup, &job.Setup)
 
 		jobs = append(jobs, job)
 		jobByID[id] = job
@@ -171,9 +229,11 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 
 	targetRows, err := s.db.Query(
 		fmt.Sprintf(`
-            SELECT job_id, arch, status, reason, log, exit_code, started_at, ended_at
+            SELECT job_id, arch, status, reason, log_ref, log_size, exit_code, started_at, ended_at, timeout, env,
+                   resolved_commit, tests, attempt, attempts, executor, lease_expires_at
             FROM job_targets
             WHERE job_id IN (%s)
+            ORDER BY id
         `, strings.Join(placeholders, ",")),
 		ids...,
 	)
@@ -188,15 +248,25 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 			arch         string
 			status       string
 			reason       sql.NullString
-			logText      sql.NullString
+			logRef       sql.NullString
+			logSize      sql.NullInt64
 			exitCode     sql.NullInt64
 			startedAtStr sql.NullString
 			endedAtStr   sql.NullString
+			timeout      sql.NullString
+			env          sql.NullString
+			resolved     sql.NullString
+			tests        sql.NullString
+			attempt      sql.NullInt64
+			attempts     sql.NullString
+			executor     sql.NullString
+			leaseStr     sql.NullString
 		)
 
 		if err := targetRows.Scan(
-			&jobID, &arch, &status, &reason, &logText, &exitCode,
-			&startedAtStr, &endedAtStr,
+			&jobID, &arch, &status, &reason, &logRef, &logSize, &exitCode,
+			&startedAtStr, &endedAtStr, &timeout, &env, &resolved, &tests,
+			&attempt, &attempts, &executor, &leaseStr,
 		); err != nil {
 			return nil, err
 		}
@@ -207,18 +277,29 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 		}
 
 		t := &core.JobTarget{
-			Arch:   arch,
-			Status: core.TargetStatus(status),
+			Arch:    arch,
+			Status:  core.TargetStatus(status),
+			Timeout: timeout.String,
+		}
+		if err := decodeEnv(env, job.SecretEnv, s.secrets, &t.Env); err != nil {
+			return nil, fmt.Errorf("job %s target %s: %w", jobID, arch, err)
 		}
 		if reason.Valid {
 			t.Reason = reason.String
 		}
-		if logText.Valid {
-			t.Log = logText.String
-		}
+		t.LogRef = logRef.String
+		t.LogSize = logSize.Int64
 		if exitCode.Valid {
 			t.ExitCode = int(exitCode.Int64)
 		}
+		if resolved.Valid {
+			t.ResolvedCommit = resolved.String
+		}
+		t.Attempt = int(attempt.Int64)
+		t.Executor = executor.String
+		t.LeaseExpiresAt = parseTimePtr(leaseStr)
+		decodeJSON(tests, &t.Tests)
+		decodeJSON(attempts, &t.Attempts)
 		if startedAtStr.Valid && startedAtStr.String != "" {
 			ts, err := time.Parse(time.RFC3339, startedAtStr.String)
 			if err == nil {
@@ -244,85 +325,207 @@ func (s *SQLiteStore) ListJobs() ([]*core.Job, error) {
 
 // RecalculateJobStatus implements Store.
 func (s *SQLiteStore) RecalculateJobStatus(jobID string) error {
-	job := &core.Job{}
-	var createdAt, updatedAt string
-	var startedAt, endedAt sql.NullString
-	var architecturesStr string
-
-	err := s.db.QueryRow(`
-		SELECT id, repo, commit_hash, test_command, architectures, status, 
-		       created_at, updated_at, started_at, ended_at, timeout
-		FROM jobs WHERE id = ?`, jobID).Scan(
-		&job.ID, &job.Repo, &job.Commit, &job.TestCommand,
-		&architecturesStr, &job.Status, &createdAt, &updatedAt,
-		&startedAt, &endedAt, &job.Timeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	// the status derives from the targets, so load the whole job
+	job, err := s.GetJob(jobID)
 	if err != nil {
 		return err
 	}
+	job.RecalculateJobStatus()
+	return s.saveJob(job)
+}
 
-	if startedAt.Valid && startedAt.String != "" {
-		ts, err := time.Parse(time.RFC3339, startedAt.String)
-		if err == nil {
-			job.StartedAt = &ts
+// AddTargetLogSize implements Store.
+func (s *SQLiteStore) AddTargetLogSize(jobID, arch, ref string, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, err := s.db.Exec(`
+		UPDATE job_targets SET log_size = COALESCE(log_size, 0) + ?
+		WHERE job_id = ? AND arch = ? AND log_ref = ?`, n, jobID, arch, ref)
+	if err != nil {
+		return fmt.Errorf("add log size: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("log %s of target %s not found for job %s", ref, arch, jobID)
+	}
+	return nil
+}
+
+// RenewLease implements Store.
+func (s *SQLiteStore) RenewLease(jobID, arch string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, err := s.db.Exec(`
+		UPDATE job_targets SET lease_expires_at = ?
+		WHERE job_id = ? AND arch = ? AND status = ?`,
+		formatTimePtr(&until), jobID, arch, core.TargetStatusRunning)
+	if err != nil {
+		return fmt.Errorf("renew lease: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("running target %s not found for job %s", arch, jobID)
+	}
+	return nil
+}
+
+// RecordTestOutcomes implements Store.
+func (s *SQLiteStore) RecordTestOutcomes(outcomes []core.TestOutcome) error {
+	if len(outcomes) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, o := range outcomes {
+		if _, err := tx.Exec(`
+			INSERT INTO test_outcomes (repo, package, test, arch, commit_hash, job_id, attempt, status, recorded_at)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			o.Repo, o.Package, o.Test, o.Arch, o.Commit, o.JobID, o.Attempt, o.Status,
+			formatTimePtr(&o.RecordedAt)); err != nil {
+			return fmt.Errorf("insert outcome: %w", err)
 		}
 	}
+	return tx.Commit()
+}
 
-	if endedAt.Valid && endedAt.String != "" {
-		ts, err := time.Parse(time.RFC3339, endedAt.String)
-		if err == nil {
-			job.EndedAt = &ts
+// ExpiredLeases implements Store. Leases are stored with the offset of
+// the server that wrote them, so they are compared as julian days.
+func (s *SQLiteStore) ExpiredLeases(before time.Time) ([]TargetRef, error) {
+	rows, err := s.db.Query(`
+		SELECT job_id, arch FROM job_targets
+		WHERE status = ? AND lease_expires_at IS NOT NULL AND julianday(lease_expires_at) < julianday(?)`,
+		core.TargetStatusRunning, formatTimePtr(&before))
+	if err != nil {
+		return nil, err
+	}
+	return scanTargetRefs(rows)
+}
+
+// TestOutcomes implements Store.
+func (s *SQLiteStore) TestOutcomes(repo string) ([]core.TestOutcome, error) {
+	rows, err := s.db.Query(`
+		SELECT repo, package, test, arch, commit_hash, job_id, attempt, status, recorded_at
+		FROM test_outcomes WHERE repo = ? ORDER BY id`, repo)
+	if err != nil {
+		return nil, err
+	}
+	return scanSQLiteOutcomes(rows)
+}
+
+// scanSQLiteOutcomes reads and closes rows of test_outcomes
+func scanSQLiteOutcomes(rows *sql.Rows) ([]core.TestOutcome, error) {
+	defer rows.Close()
+
+	out := make([]core.TestOutcome, 0)
+	for rows.Next() {
+		var o core.TestOutcome
+		var recordedAt string
+		if err := rows.Scan(&o.Repo, &o.Package, &o.Test, &o.Arch, &o.Commit, &o.JobID,
+			&o.Attempt, &o.Status, &recordedAt); err != nil {
+			return nil, err
 		}
+		o.RecordedAt, _ = time.Parse(time.RFC3339, recordedAt)
+		out = append(out, o)
 	}
-	job.RecalculateJobStatus()
-	s.SaveJob(job)
+	return out, rows.Err()
+}
 
-	return nil
+// TestHistory implements Store. The tests are passed as a JSON array of
+// [package, test] pairs.
+func (s *SQLiteStore) TestHistory(repo, arch string, tests []core.TestKey) ([]core.TestOutcome, error) {
+	pairs := make([][2]string, 0, len(tests))
+	for _, k := range tests {
+		pairs = append(pairs, [2]string{k.Package, k.Test})
+	}
+	keys, _ := json.Marshal(pairs)
+	rows, err := s.db.Query(`
+		SELECT repo, package, test, arch, commit_hash, job_id, attempt, status, recorded_at
+		FROM test_outcomes
+		WHERE repo = ? AND arch = ? AND (package, test) IN (
+			SELECT value ->> 0, value ->> 1 FROM json_each(?))
+		ORDER BY id`, repo, arch, string(keys))
+	if err != nil {
+		return nil, err
+	}
+	return scanSQLiteOutcomes(rows)
 }
 
 // SaveJob implements Store.
 func (s *SQLiteStore) SaveJob(job *core.Job) (*core.Job, error) {
-	tx, _ := s.db.Begin()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.saveJob(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// saveJob writes the job and replaces its targets; the caller holds mu
+func (s *SQLiteStore) saveJob(job *core.Job) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
 	defer tx.Rollback()
 
+	env, err := encodeEnv(job.Env, job.SecretEnv, s.secrets)
+	if err != nil {
+		return err
+	}
 	// upsert job
 	if _, err := tx.Exec(`
 		INSERT OR REPLACE INTO jobs 
 		(id, repo, commit_hash, test_command, architectures, status, created_at, updated_at, 
-		 started_at, ended_at, timeout, env)
-		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		 started_at, ended_at, timeout, env, secret_env, retry, rerun_of, image, setup)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		job.ID, job.Repo, job.Commit, job.TestCommand,
 		strings.Join(job.Architectures, ","), job.Status,
 		formatTimePtr(&job.CreatedAt), formatTimePtr(&job.UpdatedAt),
 		formatTimePtr(job.StartedAt), formatTimePtr(job.EndedAt),
-		job.Timeout, ""); err != nil {
-		return nil, fmt.Errorf("upsert job: %w", err)
+		job.Timeout, env, encodeJSON(job.SecretEnv), encodeJSON(job.Retry), job.RerunOf, job.Image,
+		encodeJSON(job.Setup)); err != nil {
+		return fmt.Errorf("upsert job: %w", err)
 	}
 
 	// Delete old targets
-	_, _ = tx.Exec(`DELETE FROM job_targets WHERE job_id = ?`, job.ID)
+	if _, err := tx.Exec(`DELETE FROM job_targets WHERE job_id = ?`, job.ID); err != nil {
+		return fmt.Errorf("delete targets: %w", err)
+	}
 
 	// Insert targets
 	for _, t := range job.Targets {
+		env, err := encodeEnv(t.Env, job.SecretEnv, s.secrets)
+		if err != nil {
+			return err
+		}
 		if _, err := tx.Exec(`
-			INSERT INTO job_targets (job_id, arch, status, reason, log, exit_code, started_at, ended_at)
-			VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
-			job.ID, t.Arch, t.Status, t.Reason, t.Log, t.ExitCode,
-			formatTimePtr(t.StartedAt), formatTimePtr(t.EndedAt)); err != nil {
-			return nil, fmt.Errorf("insert target: %w", err)
+			INSERT INTO job_targets (job_id, arch, status, reason, log_ref, log_size, exit_code, started_at, ended_at,
+			                         timeout, env, resolved_commit, tests, attempt, attempts, executor, lease_expires_at)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			job.ID, t.Arch, t.Status, t.Reason, t.LogRef, t.LogSize, t.ExitCode,
+			formatTimePtr(t.StartedAt), formatTimePtr(t.EndedAt), t.Timeout, env, t.ResolvedCommit,
+			encodeJSON(t.Tests), t.Attempt, encodeJSON(t.Attempts),
+			t.Executor, formatTimePtr(t.LeaseExpiresAt)); err != nil {
+			return fmt.Errorf("insert target: %w", err)
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("commit: %w", err)
+		return fmt.Errorf("commit: %w", err)
 	}
-
-	return job, nil
+	return nil
 }
 
-// UpdateTarget implements Store.
 // UpdateTarget implements Store.
 func (s *SQLiteStore) UpdateTarget(jobID string, arch string, fn func(j *core.Job, t *core.JobTarget)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	// Step 1: Fetch the job
 	job, err := s.GetJob(jobID)
 	if err != nil {
@@ -344,57 +547,79 @@ func (s *SQLiteStore) UpdateTarget(jobID string, arch string, fn func(j *core.Jo
 	}
 
 	// Step 3: Save the updated job back to DB
-	_, err = s.SaveJob(job)
-	if err != nil {
+	if err := s.saveJob(job); err != nil {
 		return fmt.Errorf("save updated job %s: %w", jobID, err)
 	}
 
 	return nil
 }
 
+// Reruns implements Store.
+func (s *SQLiteStore) Reruns(jobID string) ([]string, error) {
+	return queryIDs(s.db, `SELECT id FROM jobs WHERE rerun_of = ? ORDER BY created_at, id`, jobID)
+}
+
+// queryIDs returns the single string column of the rows of query
+func queryIDs(q querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// scanTargetRefs reads and closes rows of job IDs and architectures
+func scanTargetRefs(rows *sql.Rows) ([]TargetRef, error) {
+	defer rows.Close()
+
+	refs := make([]TargetRef, 0)
+	for rows.Next() {
+		var ref TargetRef
+		if err := rows.Scan(&ref.JobID, &ref.Arch); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
 func NewSQLiteStore(path string) Store {
 	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		panic(fmt.Errorf("open db: %w", err))
 	}
+	// one connection, so that concurrent readers never see SQLITE_BUSY
+	db.SetMaxOpenConns(1)
 
-	// Auto-migrate WITH error checking
-	if _, err := db.Exec(`
-        CREATE TABLE IF NOT EXISTS jobs (
-            id TEXT PRIMARY KEY,
-            repo TEXT NOT NULL,
-            commit_hash TEXT NOT NULL,  -- Fixed column name
-            test_command TEXT NOT NULL,
-            architectures TEXT NOT NULL,
-            status TEXT NOT NULL,
-            created_at TEXT NOT NULL DEFAULT current_timestamp,
-            updated_at TEXT NOT NULL DEFAULT current_timestamp,
-            started_at TEXT,
-            ended_at TEXT,
-            timeout TEXT,
-            env TEXT
-        );
-        
-        CREATE TABLE IF NOT EXISTS job_targets (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            job_id TEXT NOT NULL,
-            arch TEXT NOT NULL,
-            status TEXT NOT NULL,
-            reason TEXT,
-            log TEXT,
-            exit_code INTEGER,
-            started_at TEXT,
-            ended_at TEXT,
-            UNIQUE(job_id, arch),
-            FOREIGN KEY(job_id) REFERENCES jobs(id)
-        );
-    `); err != nil {
+	migrations, err := SQLiteMigrations()
+	if err != nil {
+		panic(fmt.Errorf("load migrations: %w", err))
+	}
+	if _, err := migrate(db, sqliteDialect, migrations); err != nil {
 		panic(fmt.Errorf("migration failed: %w", err))
 	}
 
 	return &SQLiteStore{db: db}
 }
 
+// splitArchitectures parses the comma-separated architectures column
+func splitArchitectures(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 // formatTimePtr formats a time pointer to RFC3339 or returns nil if the pointer is nil
 func formatTimePtr(t *time.Time) interface{} {
 	if t == nil {
@@ -402,3 +627,36 @@ func formatTimePtr(t *time.Time) interface{} {
 	}
 	return t.Format(time.RFC3339)
 }
+
+// parseTimePtr parses an RFC3339 column, returning nil for NULL or bad values
+func parseTimePtr(s sql.NullString) *time.Time {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	ts, err := time.Parse(time.RFC3339, s.String)
+	if err != nil {
+		return nil
+	}
+	return &ts
+}
+
+// encodeJSON stores v as JSON, or NULL when it is nil or empty
+func encodeJSON(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	switch string(b) {
+	case "null", "[]", "{}":
+		return nil
+	}
+	return string(b)
+}
+
+// decodeJSON unmarshals a JSON column into v, leaving v untouched for NULL
+func decodeJSON(s sql.NullString, v interface{}) {
+	if !s.Valid || s.String == "" {
+		return
+	}
+	_ = json.Unmarshal([]byte(s.String), v)
+}
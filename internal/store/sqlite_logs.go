@@ -0,0 +1,109 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
+
+// legacyAttempt is an attempt as earlier releases stored it, log included
+type legacyAttempt struct {
+	core.Attempt
+	Log string `json:"log,omitempty"`
+}
+
+// MoveLogs moves the output earlier releases kept in the database into
+// logs and returns how many logs it moved. Only the IDs of the targets with
+// logs are read up front; each target's logs are then loaded, moved and
+// cleared one target at a time, so that at most one target's output is in
+// memory and an interrupted move can simply be run again.
+func (s *SQLiteStore) MoveLogs(logs LogStore) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(`
+		SELECT id FROM job_targets
+		WHERE log != '' OR attempts LIKE '%"log":%'`)
+	if err != nil {
+		return 0, fmt.Errorf("find logs: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range ids {
+		n, err := s.moveTargetLogs(logs, id)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// moveTargetLogs moves the logs of the target row id and returns how many
+// it moved
+func (s *SQLiteStore) moveTargetLogs(logs LogStore, id int64) (int, error) {
+	var (
+		jobID, arch   string
+		attempt       sql.NullInt64
+		log, attempts sql.NullString
+	)
+	if err := s.db.QueryRow(`SELECT job_id, arch, attempt, log, attempts FROM job_targets WHERE id = ?`, id).
+		Scan(&jobID, &arch, &attempt, &log, &attempts); err != nil {
+		return 0, fmt.Errorf("load logs of target %d: %w", id, err)
+	}
+
+	moved := 0
+	move := func(attempt int, log string) (string, error) {
+		ref := LogRef(jobID, arch, attempt)
+		if err := logs.Append(ref, 0, []byte(log)); err != nil {
+			return "", fmt.Errorf("move log %s: %w", ref, err)
+		}
+		moved++
+		return ref, logs.Finish(ref)
+	}
+
+	var old []legacyAttempt
+	decodeJSON(attempts, &old)
+	kept := make([]core.Attempt, 0, len(old))
+	for _, a := range old {
+		if a.Log != "" {
+			ref, err := move(a.Number, a.Log)
+			if err != nil {
+				return moved, err
+			}
+			a.LogRef, a.LogSize = ref, int64(len(a.Log))
+		}
+		kept = append(kept, a.Attempt)
+	}
+
+	var err error
+	if log.String == "" {
+		_, err = s.db.Exec(`UPDATE job_targets SET attempts = ? WHERE id = ?`, encodeJSON(kept), id)
+	} else {
+		var ref string
+		ref, err = move(int(attempt.Int64), log.String)
+		if err != nil {
+			return moved, err
+		}
+		_, err = s.db.Exec(`UPDATE job_targets SET log = NULL, log_ref = ?, log_size = ?, attempts = ? WHERE id = ?`,
+			ref, len(log.String), encodeJSON(kept), id)
+	}
+	if err != nil {
+		return moved, fmt.Errorf("update target %s of job %s: %w", arch, jobID, err)
+	}
+	return moved, nil
+}
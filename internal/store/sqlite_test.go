@@ -1,6 +1,8 @@
 package store
 
 import (
+	"encoding/base64"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -139,3 +141,135 @@ func TestSQLiteStoreUpdateTarget(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, core.TargetStatusPassed, updated.Targets[0].Status)
 }
+
+func TestSQLiteStoreRenewLease(t *testing.T) {
+	s := NewSQLiteStore("file::memory:?cache=shared")
+
+	job := &core.Job{
+		ID:      "lease-test",
+		Repo:    "test/repo",
+		Targets: []*core.JobTarget{{Arch: "arm64", Status: core.TargetStatusRunning, Executor: "agent-1"}},
+	}
+	s.SaveJob(job)
+
+	until := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	assert.NoError(t, s.RenewLease(job.ID, "arm64", until))
+
+	got, err := s.GetJob(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "agent-1", got.Targets[0].Executor)
+	assert.True(t, until.Equal(*got.Targets[0].LeaseExpiresAt))
+
+	// finished targets hold no lease
+	assert.Error(t, s.RenewLease(job.ID, "amd64", until))
+	s.UpdateTarget(job.ID, "arm64", func(j *core.Job, t *core.JobTarget) {
+		t.Status = core.TargetStatusPassed
+	})
+	assert.Error(t, s.RenewLease(job.ID, "arm64", until))
+}
+
+func TestSQLiteStoreRecalculateJobStatusKeepsTargets(t *testing.T) {
+	s := NewSQLiteStore("file::memory:?cache=shared")
+
+	job := &core.Job{
+		ID:     "recalc-targets",
+		Status: core.JobStatusRunning,
+		Targets: []*core.JobTarget{
+			{Arch: "amd64", Status: core.TargetStatusPassed},
+			{Arch: "arm64", Status: core.TargetStatusError, Reason: core.ReasonServerRestarted},
+		},
+	}
+	s.SaveJob(job)
+
+	assert.NoError(t, s.RecalculateJobStatus(job.ID))
+
+	got, err := s.GetJob(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, core.JobStatusFailed, got.Status)
+	assert.Len(t, got.Targets, 2)
+	assert.Equal(t, core.ReasonServerRestarted, got.Targets[1].Reason)
+}
+
+func TestSQLiteStoreEncryptsSecretEnv(t *testing.T) {
+	box, err := NewSecretBox(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	assert.NoError(t, err)
+	s := NewSQLiteStore(filepath.Join(t.TempDir(), "data.db")).(*SQLiteStore)
+
+	job := &core.Job{
+		ID:        "secret",
+		Env:       map[string]string{"TOKEN": "s3cret", "GOFLAGS": "-count=1"},
+		SecretEnv: []string{"TOKEN"},
+		Targets:   []*core.JobTarget{{Arch: "amd64", Env: map[string]string{"TOKEN": "s3cret"}}},
+	}
+	_, err = s.SaveJob(job)
+	assert.ErrorIs(t, err, ErrNoSecretKey)
+
+	s.SetSecrets(box)
+	_, err = s.SaveJob(job)
+	assert.NoError(t, err)
+
+	var jobEnv, targetEnv string
+	assert.NoError(t, s.db.QueryRow(`SELECT env FROM jobs WHERE id = 'secret'`).Scan(&jobEnv))
+	assert.NoError(t, s.db.QueryRow(`SELECT env FROM job_targets WHERE job_id = 'secret'`).Scan(&targetEnv))
+	assert.NotContains(t, jobEnv, "s3cret")
+	assert.NotContains(t, targetEnv, "s3cret")
+	assert.Contains(t, jobEnv, "-count=1", "only secret values are encrypted")
+
+	got, err := s.GetJob("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, job.Env, got.Env)
+	assert.Equal(t, job.Targets[0].Env, got.Targets[0].Env)
+
+	// a store with another key leaves the values sealed, without failing
+	// for the job or for others
+	other, _ := NewSecretBox(base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")))
+	s.SetSecrets(other)
+	_, err = s.SaveJob(&core.Job{ID: "plain", Targets: []*core.JobTarget{{Arch: "amd64"}}})
+	assert.NoError(t, err)
+	jobs, err := s.ListJobs()
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 2)
+	got, err = s.GetJob("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TOKEN"}, SealedSecrets(got.Env, got.SecretEnv))
+	assert.Equal(t, "-count=1", got.Env["GOFLAGS"])
+
+	// and keeps them when the job is saved again
+	got.Status = core.JobStatusFailed
+	_, err = s.SaveJob(got)
+	assert.NoError(t, err)
+	s.SetSecrets(box)
+	got, err = s.GetJob("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, job.Env, got.Env)
+	assert.Empty(t, SealedSecrets(got.Env, got.SecretEnv))
+}
+
+func TestSQLiteStoreMoveLogs(t *testing.T) {
+	s := NewSQLiteStore(filepath.Join(t.TempDir(), "data.db")).(*SQLiteStore)
+	_, err := s.SaveJob(&core.Job{ID: "old", Targets: []*core.JobTarget{{Arch: "arm/v7", Attempt: 2}}})
+	assert.NoError(t, err)
+	// as written before logs moved out of the database
+	_, err = s.db.Exec(`UPDATE job_targets SET log = 'second', attempts = ? WHERE job_id = 'old'`,
+		`[{"number":1,"status":"failed","exit_code":1,"log":"first"}]`)
+	assert.NoError(t, err)
+
+	logs := NewMemoryLogStore()
+	moved, err := s.MoveLogs(logs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	job, err := s.GetJob("old")
+	assert.NoError(t, err)
+	target := job.Targets[0]
+	assert.Equal(t, "old/arm-v7/2", target.LogRef)
+	assert.Equal(t, int64(6), target.LogSize)
+	assert.Equal(t, "old/arm-v7/1", target.Attempts[0].LogRef)
+	assert.Equal(t, core.TargetStatusFailed, target.Attempts[0].Status)
+	first, _ := ReadLog(logs, target.Attempts[0].LogRef, 0, target.Attempts[0].LogSize)
+	assert.Equal(t, "first", first)
+
+	moved, err = s.MoveLogs(logs)
+	assert.NoError(t, err)
+	assert.Zero(t, moved, "moved logs are not moved again")
+}
@@ -1,17 +1,47 @@
 package store
 
-import "github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+import (
+	"time"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+)
 
 type Store interface {
 	SaveJob(job *core.Job) (*core.Job, error)
 	GetJob(id string) (*core.Job, error)
 	UpdateTarget(jobID, arch string, fn func(j *core.Job, t *core.JobTarget)) error
 	RecalculateJobStatus(jobID string) error
+	// AddTargetLogSize records that n bytes were appended to the log ref
+	// of a target; it fails once the target moved on to another log
+	AddTargetLogSize(jobID, arch, ref string, n int64) error
+	// RenewLease moves the heartbeat deadline of a running target
+	RenewLease(jobID, arch string, until time.Time) error
+	// ExpiredLeases returns the running targets whose lease expired before
+	// the given time
+	ExpiredLeases(before time.Time) ([]TargetRef, error)
+	// RecordTestOutcomes appends to the per-test outcome history
+	RecordTestOutcomes(outcomes []core.TestOutcome) error
+	// TestOutcomes returns the outcome history of a repository, oldest first
+	TestOutcomes(repo string) ([]core.TestOutcome, error)
+	// TestHistory returns the outcome history of tests on arch in repo,
+	// oldest first
+	TestHistory(repo, arch string, tests []core.TestKey) ([]core.TestOutcome, error)
 	ListJobs() ([]*core.Job, error)
+	// Reruns returns the IDs of the jobs that re-ran jobID, oldest first
+	Reruns(jobID string) ([]string, error)
+}
+
+// TargetRef names a target of a job
+type TargetRef struct {
+	JobID string
+	Arch  string
 }
 
 type StoreBuilder struct {
-	store Store
+	store   Store
+	secrets *SecretBox
+	// err is the error of opening the store, returned by Build
+	err error
 }
 
 func NewStoreBuilder() *StoreBuilder {
@@ -25,7 +55,24 @@ func (b *StoreBuilder) WithSQLite(path string) *StoreBuilder {
 	b.store = NewSQLiteStore(path)
 	return b
 }
+func (b *StoreBuilder) WithPostgres(dsn string) *StoreBuilder {
+	b.store, b.err = NewPostgresStore(dsn)
+	return b
+}
+
+// WithSecrets encrypts secret env values with box in stores that persist
+// them
+func (b *StoreBuilder) WithSecrets(box *SecretBox) *StoreBuilder {
+	b.secrets = box
+	return b
+}
 
-func (b *StoreBuilder) Build() Store {
-	return b.store
+func (b *StoreBuilder) Build() (Store, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if s, ok := b.store.(interface{ SetSecrets(*SecretBox) }); ok && b.secrets != nil {
+		s.SetSecrets(b.secrets)
+	}
+	return b.store, nil
 }
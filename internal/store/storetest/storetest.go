@@ -0,0 +1,494 @@
+// Package storetest is a conformance suite for store.Store implementations.
+// A new backend gets the same behavioural checks as the existing ones by
+// calling Run from its tests.
+package storetest
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/core"
+	"github.com/kiptoonkipkurui/multi-arch-test-harness/internal/store"
+)
+
+// NewStore returns an empty store for one subtest
+type NewStore func(t *testing.T) store.Store
+
+// Run runs the suite against the stores newStore returns. Subtests named in
+// skip are skipped, for gaps a store has yet to close.
+func Run(t *testing.T, newStore NewStore, skip ...string) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store)
+	}{
+		{"JobRoundTrip", testJobRoundTrip},
+		{"EnvRoundTrip", testEnvRoundTrip},
+		{"ListJobs", testListJobs},
+		{"Reruns", testReruns},
+		{"SaveJobReplacesTargets", testSaveJobReplacesTargets},
+		{"Isolation", testIsolation},
+		{"UpdateTarget", testUpdateTarget},
+		{"ConcurrentUpdateTarget", testConcurrentUpdateTarget},
+		{"RecalculateJobStatus", testRecalculateJobStatus},
+		{"AddTargetLogSize", testAddTargetLogSize},
+		{"RenewLease", testRenewLease},
+		{"ExpiredLeases", testExpiredLeases},
+		{"TestOutcomes", testTestOutcomes},
+		{"TestHistory", testTestHistory},
+		{"NotFound", testNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if slices.Contains(skip, tt.name) {
+				t.Skip("skipped for this store")
+			}
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+// base is the reference time of the fixtures. Stores keep at least second
+// precision, so it has none finer.
+var base = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func at(d time.Duration) *time.Time {
+	ts := base.Add(d)
+	return &ts
+}
+
+// fullJob returns a job with every field set except the environments and
+// the target timeout, which testEnvRoundTrip covers
+func fullJob(id string) *core.Job {
+	return &core.Job{
+		ID:            id,
+		Repo:          "https://github.com/example/app.git",
+		Commit:        "refs/pull/7/head",
+		TestCommand:   "go test -json ./...",
+		Architectures: []string{"arm64", "amd64"},
+		Status:        core.JobStatusRunning,
+		CreatedAt:     base,
+		UpdatedAt:     base.Add(3 * time.Minute),
+		StartedAt:     at(time.Minute),
+		EndedAt:       at(2 * time.Minute),
+		Timeout:       "10m",
+		Retry:         &core.RetryPolicy{MaxAttempts: 3, RetryOn: []string{core.ReasonGitCloneFailed}, Backoff: "10s"},
+		Image:         "golang:1.22",
+		Setup:         []string{"go mod download", "make generate"},
+		RerunOf:       "earlier-job",
+		Targets: []*core.JobTarget{
+			{
+				Arch:           "arm64",
+				Status:         core.TargetStatusFailed,
+				Reason:         core.ReasonTestsFailed,
+				LogRef:         store.LogRef(id, "arm64", 2),
+				LogSize:        16,
+				ExitCode:       1,
+				StartedAt:      at(time.Minute),
+				EndedAt:        at(2 * time.Minute),
+				ResolvedCommit: "0123456789abcdef0123456789abcdef01234567",
+				Tests: []core.TestResult{
+					{Package: "example.com/app", Name: "TestA", Status: core.TestStatusFail, Elapsed: 0.5, Output: "boom\n", Flaky: true},
+					{Package: "example.com/app", Status: core.TestStatusFail, Elapsed: 0.6},
+				},
+				Attempt: 2,
+				Attempts: []core.Attempt{{
+					Number:         1,
+					Status:         core.TargetStatusFailed,
+					Reason:         core.ReasonGitCloneFailed,
+					ExitCode:       128,
+					StartedAt:      at(10 * time.Second),
+					EndedAt:        at(20 * time.Second),
+					ResolvedCommit: "fedcba",
+					LogRef:         store.LogRef(id, "arm64", 1),
+					LogSize:        17,
+					Tests:          []core.TestResult{{Package: "example.com/app", Status: core.TestStatusSkip}},
+				}},
+				Executor: "local",
+			},
+			{
+				Arch:           "amd64",
+				Status:         core.TargetStatusRunning,
+				StartedAt:      at(time.Minute),
+				LogRef:         store.LogRef(id, "amd64", 1),
+				Attempt:        1,
+				Executor:       "agent-1",
+				LeaseExpiresAt: at(5 * time.Minute),
+			},
+		},
+	}
+}
+
+// normalize puts the times of job in UTC, as the fixtures have them
+func normalize(job *core.Job) *core.Job {
+	utc := func(t *time.Time) {
+		if t != nil {
+			*t = t.UTC()
+		}
+	}
+	utc(&job.CreatedAt)
+	utc(&job.UpdatedAt)
+	utc(job.StartedAt)
+	utc(job.EndedAt)
+	for _, t := range job.Targets {
+		utc(t.StartedAt)
+		utc(t.EndedAt)
+		utc(t.LeaseExpiresAt)
+		for i := range t.Attempts {
+			utc(t.Attempts[i].StartedAt)
+			utc(t.Attempts[i].EndedAt)
+		}
+	}
+	return job
+}
+
+func mustSave(t *testing.T, s store.Store, job *core.Job) {
+	t.Helper()
+	_, err := s.SaveJob(job)
+	require.NoError(t, err)
+}
+
+func mustGet(t *testing.T, s store.Store, id string) *core.Job {
+	t.Helper()
+	job, err := s.GetJob(id)
+	require.NoError(t, err)
+	return normalize(job)
+}
+
+func testJobRoundTrip(t *testing.T, s store.Store) {
+	mustSave(t, s, fullJob("full"))
+	assert.Equal(t, fullJob("full"), mustGet(t, s, "full"))
+
+	// zero values come back as zero values
+	empty := &core.Job{ID: "empty", Status: core.JobStatusPending, CreatedAt: base, UpdatedAt: base}
+	mustSave(t, s, empty)
+	assert.Equal(t, empty, mustGet(t, s, "empty"))
+}
+
+// testEnvRoundTrip needs a store that can encrypt secret env values
+func testEnvRoundTrip(t *testing.T, s store.Store) {
+	job := fullJob("env")
+	job.Env = map[string]string{"CGO_ENABLED": "0", "GOFLAGS": "-count=1", "TOKEN": "s3cret"}
+	job.SecretEnv = []string{"TOKEN"}
+	job.Targets[0].Env = map[string]string{"GOARM": "7", "TOKEN": "arm-s3cret"}
+	job.Targets[0].Timeout = "30s"
+	mustSave(t, s, job)
+
+	got := mustGet(t, s, "env")
+	assert.Equal(t, job.Env, got.Env)
+	assert.Equal(t, job.SecretEnv, got.SecretEnv)
+	assert.Equal(t, job.Targets[0].Env, got.Targets[0].Env)
+	assert.Equal(t, "30s", got.Targets[0].Timeout)
+
+	// and survive a target update and listing
+	require.NoError(t, s.UpdateTarget("env", "arm64", func(j *core.Job, t *core.JobTarget) {
+		t.Attempt++
+	}))
+	jobs, err := s.ListJobs()
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, job.Env, jobs[0].Env)
+	assert.Equal(t, job.Targets[0].Env, jobs[0].Targets[0].Env)
+	assert.Equal(t, "30s", jobs[0].Targets[0].Timeout)
+}
+
+func testListJobs(t *testing.T, s store.Store) {
+	jobs, err := s.ListJobs()
+	require.NoError(t, err)
+	assert.NotNil(t, jobs)
+	assert.Empty(t, jobs)
+
+	older := fullJob("older")
+	newer := fullJob("newer")
+	newer.CreatedAt = base.Add(time.Hour)
+	mustSave(t, s, older)
+	mustSave(t, s, newer)
+
+	jobs, err = s.ListJobs()
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	// newest first, with their targets
+	assert.Equal(t, newer, normalize(jobs[0]))
+	assert.Equal(t, older, normalize(jobs[1]))
+}
+
+func testReruns(t *testing.T, s store.Store) {
+	mustSave(t, s, fullJob("original"))
+	reruns, err := s.Reruns("original")
+	require.NoError(t, err)
+	assert.Empty(t, reruns)
+
+	for i, id := range []string{"second", "first", "unrelated"} {
+		job := fullJob(id)
+		job.RerunOf = "original"
+		job.CreatedAt = base.Add(time.Duration(2-i) * time.Hour)
+		if id == "unrelated" {
+			job.RerunOf = "other"
+		}
+		mustSave(t, s, job)
+	}
+	reruns, err = s.Reruns("original")
+	require.NoError(t, err)
+	// oldest first
+	assert.Equal(t, []string{"first", "second"}, reruns)
+}
+
+func testSaveJobReplacesTargets(t *testing.T, s store.Store) {
+	job := fullJob("replace")
+	mustSave(t, s, job)
+
+	job.Architectures = []string{"amd64"}
+	job.Targets = job.Targets[1:]
+	job.Status = core.JobStatusPassed
+	mustSave(t, s, job)
+
+	got := mustGet(t, s, "replace")
+	assert.Equal(t, core.JobStatusPassed, got.Status)
+	require.Len(t, got.Targets, 1)
+	assert.Equal(t, "amd64", got.Targets[0].Arch)
+}
+
+func testIsolation(t *testing.T, s store.Store) {
+	job := fullJob("isolated")
+	mustSave(t, s, job)
+
+	// neither the saved job nor a loaded one alias what the store holds
+	job.Status = core.JobStatusCancelled
+	job.Targets[0].LogSize = 1
+	got := mustGet(t, s, "isolated")
+	got.Targets[1].Status = core.TargetStatusCancelled
+	*got.Targets[1].StartedAt = base.Add(time.Hour)
+
+	got = mustGet(t, s, "isolated")
+	assert.Equal(t, fullJob("isolated"), got)
+}
+
+func testUpdateTarget(t *testing.T, s store.Store) {
+	mustSave(t, s, fullJob("update"))
+
+	ended := base.Add(4 * time.Minute)
+	err := s.UpdateTarget("update", "amd64", func(j *core.Job, tg *core.JobTarget) {
+		assert.Equal(t, "update", j.ID)
+		assert.Equal(t, "golang:1.22", j.Image)
+		tg.Status = core.TargetStatusPassed
+		tg.EndedAt = &ended
+		tg.LeaseExpiresAt = nil
+		tg.Tests = []core.TestResult{{Package: "example.com/app", Status: core.TestStatusPass}}
+	})
+	require.NoError(t, err)
+
+	want := fullJob("update")
+	got := mustGet(t, s, "update")
+	target := got.Targets[1]
+	assert.Equal(t, core.TargetStatusPassed, target.Status)
+	assert.Equal(t, ended, *target.EndedAt)
+	assert.Nil(t, target.LeaseExpiresAt)
+	assert.Equal(t, []core.TestResult{{Package: "example.com/app", Status: core.TestStatusPass}}, target.Tests)
+	// the other target and the job's own fields are untouched
+	assert.Equal(t, want.Targets[0], got.Targets[0])
+	assert.Equal(t, want.Status, got.Status)
+	assert.Equal(t, want.Setup, got.Setup)
+}
+
+func testConcurrentUpdateTarget(t *testing.T, s store.Store) {
+	const n = 20
+	job := &core.Job{ID: "concurrent", CreatedAt: base, Targets: []*core.JobTarget{
+		{Arch: "amd64", Status: core.TargetStatusRunning, LogRef: "concurrent/amd64/1"},
+		{Arch: "arm64", Status: core.TargetStatusRunning, LogRef: "concurrent/arm64/1"},
+	}}
+	mustSave(t, s, job)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		for _, arch := range []string{"amd64", "arm64"} {
+			wg.Add(1)
+			go func(i int, arch string) {
+				defer wg.Done()
+				assert.NoError(t, s.UpdateTarget("concurrent", arch, func(j *core.Job, tg *core.JobTarget) {
+					tg.Attempt++
+				}))
+				assert.NoError(t, s.AddTargetLogSize("concurrent", arch, "concurrent/"+arch+"/1", int64(i)))
+			}(i, arch)
+		}
+	}
+	wg.Wait()
+
+	got := mustGet(t, s, "concurrent")
+	for _, target := range got.Targets {
+		// no update was lost
+		assert.Equal(t, n, target.Attempt, target.Arch)
+		assert.Equal(t, int64(n*(n-1)/2), target.LogSize, target.Arch)
+	}
+}
+
+func testRecalculateJobStatus(t *testing.T, s store.Store) {
+	tests := []struct {
+		name     string
+		statuses []core.TargetStatus
+		want     core.JobStatus
+	}{
+		{"no targets", nil, core.JobStatusPending},
+		{"running", []core.TargetStatus{core.TargetStatusPassed, core.TargetStatusRunning}, core.JobStatusRunning},
+		{"failed", []core.TargetStatus{core.TargetStatusPassed, core.TargetStatusError}, core.JobStatusFailed},
+		{"cancelled", []core.TargetStatus{core.TargetStatusPassed, core.TargetStatusCancelled}, core.JobStatusCancelled},
+		{"passed", []core.TargetStatus{core.TargetStatusPassed, core.TargetStatusPassed}, core.JobStatusPassed},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := fmt.Sprintf("recalc-%d", i)
+			job := &core.Job{ID: id, Status: core.JobStatusPending, CreatedAt: base}
+			for k, status := range tt.statuses {
+				job.Targets = append(job.Targets, &core.JobTarget{
+					Arch:      fmt.Sprintf("arch-%d", k),
+					Status:    status,
+					Reason:    "reason",
+					StartedAt: at(time.Duration(k+1) * time.Minute),
+					EndedAt:   at(time.Duration(k+5) * time.Minute),
+				})
+			}
+			mustSave(t, s, job)
+
+			require.NoError(t, s.RecalculateJobStatus(id))
+
+			got := mustGet(t, s, id)
+			assert.Equal(t, tt.want, got.Status)
+			// the targets survive and the job's times derive from them
+			assert.Equal(t, job.Targets, got.Targets)
+			if len(job.Targets) > 0 {
+				assert.Equal(t, base.Add(time.Minute), *got.StartedAt)
+				assert.Equal(t, base.Add(time.Duration(len(job.Targets)+4)*time.Minute), *got.EndedAt)
+			}
+		})
+	}
+}
+
+func testAddTargetLogSize(t *testing.T, s store.Store) {
+	mustSave(t, s, fullJob("append"))
+
+	require.NoError(t, s.AddTargetLogSize("append", "amd64", "append/amd64/1", 6))
+	require.NoError(t, s.AddTargetLogSize("append", "amd64", "append/amd64/1", 6))
+	require.NoError(t, s.AddTargetLogSize("append", "arm64", "append/arm64/2", 5))
+	// the target moved on to another attempt
+	assert.Error(t, s.AddTargetLogSize("append", "arm64", "append/arm64/1", 5))
+
+	got := mustGet(t, s, "append")
+	assert.Equal(t, int64(21), got.Targets[0].LogSize)
+	assert.Equal(t, int64(12), got.Targets[1].LogSize)
+	assert.Equal(t, int64(17), got.Targets[0].Attempts[0].LogSize)
+}
+
+func testRenewLease(t *testing.T, s store.Store) {
+	mustSave(t, s, fullJob("lease"))
+
+	until := base.Add(10 * time.Minute)
+	require.NoError(t, s.RenewLease("lease", "amd64", until))
+	got := mustGet(t, s, "lease")
+	assert.Equal(t, until, *got.Targets[1].LeaseExpiresAt)
+	assert.Equal(t, "agent-1", got.Targets[1].Executor)
+
+	// only running targets hold a lease
+	assert.Error(t, s.RenewLease("lease", "arm64", until))
+	assert.Error(t, s.RenewLease("lease", "riscv64", until))
+}
+
+func testExpiredLeases(t *testing.T, s store.Store) {
+	mustSave(t, s, fullJob("lease"))
+	refs, err := s.ExpiredLeases(base)
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+
+	// the lease is kept in another zone than the time it is compared to
+	until := base.Add(10 * time.Minute).In(time.FixedZone("east", 5*3600))
+	require.NoError(t, s.RenewLease("lease", "amd64", until))
+	refs, err = s.ExpiredLeases(base.Add(10 * time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, refs, "expiring at the given time")
+	refs, err = s.ExpiredLeases(base.Add(11 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []store.TargetRef{{JobID: "lease", Arch: "amd64"}}, refs)
+
+	// finished targets hold no lease
+	require.NoError(t, s.UpdateTarget("lease", "amd64", func(j *core.Job, tg *core.JobTarget) {
+		tg.Status = core.TargetStatusPassed
+	}))
+	refs, err = s.ExpiredLeases(base.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+}
+
+func testTestOutcomes(t *testing.T, s store.Store) {
+	outcomes, err := s.TestOutcomes("https://github.com/example/app.git")
+	require.NoError(t, err)
+	assert.NotNil(t, outcomes)
+	assert.Empty(t, outcomes)
+	require.NoError(t, s.RecordTestOutcomes(nil))
+
+	recorded := []core.TestOutcome{
+		{Repo: "https://github.com/example/app.git", Package: "example.com/app", Test: "TestA", Arch: "amd64",
+			Commit: "abc", JobID: "j1", Attempt: 1, Status: core.TestStatusFail, RecordedAt: base},
+		{Repo: "https://github.com/example/other.git", Package: "example.com/other", Test: "TestB", Arch: "amd64",
+			Commit: "def", JobID: "j2", Attempt: 1, Status: core.TestStatusPass, RecordedAt: base},
+		{Repo: "https://github.com/example/app.git", Package: "example.com/app", Test: "TestA", Arch: "amd64",
+			Commit: "abc", JobID: "j1", Attempt: 2, Status: core.TestStatusPass, RecordedAt: base.Add(time.Minute)},
+	}
+	require.NoError(t, s.RecordTestOutcomes(recorded))
+
+	outcomes, err = s.TestOutcomes("https://github.com/example/app.git")
+	require.NoError(t, err)
+	for i := range outcomes {
+		outcomes[i].RecordedAt = outcomes[i].RecordedAt.UTC()
+	}
+	// oldest first
+	assert.Equal(t, []core.TestOutcome{recorded[0], recorded[2]}, outcomes)
+}
+
+func testTestHistory(t *testing.T, s store.Store) {
+	const repo = "https://github.com/example/app.git"
+	outcome := func(pkg, test, arch string, status core.TestStatus) core.TestOutcome {
+		return core.TestOutcome{Repo: repo, Package: pkg, Test: test, Arch: arch,
+			Commit: "abc", JobID: "j1", Attempt: 1, Status: status, RecordedAt: base}
+	}
+	recorded := []core.TestOutcome{
+		outcome("example.com/app", "TestA", "amd64", core.TestStatusFail),
+		outcome("example.com/app", "TestA", "arm64", core.TestStatusFail),
+		outcome("example.com/app", "TestB", "amd64", core.TestStatusPass),
+		outcome("example.com/app/sub", "TestA", "amd64", core.TestStatusPass),
+		outcome("example.com/app", "TestA", "amd64", core.TestStatusPass),
+	}
+	require.NoError(t, s.RecordTestOutcomes(recorded))
+
+	history, err := s.TestHistory(repo, "amd64", []core.TestKey{
+		{Package: "example.com/app", Test: "TestA"},
+		{Package: "example.com/app/sub", Test: "TestA"},
+		{Package: "example.com/app", Test: "TestMissing"},
+	})
+	require.NoError(t, err)
+	for i := range history {
+		history[i].RecordedAt = history[i].RecordedAt.UTC()
+	}
+	// only the given tests on the given arch, oldest first
+	assert.Equal(t, []core.TestOutcome{recorded[0], recorded[3], recorded[4]}, history)
+
+	history, err = s.TestHistory(repo, "amd64", nil)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func testNotFound(t *testing.T, s store.Store) {
+	mustSave(t, s, fullJob("present"))
+	noop := func(j *core.Job, tg *core.JobTarget) {}
+
+	_, err := s.GetJob("missing")
+	assert.Error(t, err)
+	assert.Error(t, s.UpdateTarget("missing", "amd64", noop))
+	assert.Error(t, s.UpdateTarget("present", "riscv64", noop))
+	assert.Error(t, s.RecalculateJobStatus("missing"))
+	assert.Error(t, s.AddTargetLogSize("missing", "amd64", "missing/amd64/1", 1))
+	assert.Error(t, s.AddTargetLogSize("present", "riscv64", "present/riscv64/1", 1))
+	assert.Error(t, s.RenewLease("missing", "amd64", base))
+}